@@ -3,3 +3,12 @@ package main
 type contextKey string
 
 const isAuthenticatedContextKey = contextKey("isAuthenticated")
+
+const isAdminContextKey = contextKey("isAdmin")
+
+// Set by authenticateToken for requests authenticated with an API token
+// rather than a session.
+const (
+	userIDContextKey   = contextKey("userID")
+	apiTokenContextKey = contextKey("apiToken")
+)
@@ -1,15 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
+	"image/png"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/burstman/baseRegistry/cmd/web/internal/data"
+	"github.com/burstman/baseRegistry/cmd/web/internal/storage"
+	"github.com/burstman/baseRegistry/cmd/web/internal/validator"
+	"github.com/burstman/baseRegistry/cmd/web/internal/webhook"
+	"github.com/burstman/baseRegistry/cmd/web/internal/websocket"
 	"github.com/julienschmidt/httprouter"
+	"github.com/pquerna/otp/totp"
 )
 
 // home is an HTTP handler function that retrieves the latest list of workers from the registry
@@ -25,20 +43,43 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 	// 	return
 	// }
 
-	data := &templateData{
-		//WorkersRegistry: lastList,
-		IsAuthenticated: app.isAuthenticated(r),
-		Flash:           app.sessionManager.PopString(r.Context(), "flash"),
-	}
+	data := app.newTemplateData(r)
+	data.Form = userLoginForm{}
 
 	app.render(w, "login.tmpl.html", http.StatusOK, data)
 }
 
 type userSignupForm struct {
-	Name     string `form:"username"`
-	Email    string `form:"email"`
-	Password string `form:"password"`
-	//validator.Validator `form:"-"`
+	Name                string `form:"username"`
+	Email               string `form:"email"`
+	Password            string `form:"password"`
+	ConfirmPassword     string `form:"confirm_password"`
+	validator.Validator `form:"-"`
+}
+
+// validate checks the sign up form fields against the constraints of the users
+// table and the password policy.
+func (f *userSignupForm) validate() {
+	f.CheckField(validator.NotBlank(f.Name), "username", "This field cannot be blank")
+	f.CheckField(validator.MinChars(f.Name, 3), "username", "This field must be at least 3 characters long")
+	f.CheckField(validator.MaxChars(f.Name, 50), "username", "This field cannot be more than 50 characters long")
+	f.CheckField(validator.Matches(f.Name, validator.UsernameRX), "username",
+		"This field can only contain letters, digits, dots, dashes and underscores")
+	f.CheckField(validator.NotBlank(f.Email), "email", "This field cannot be blank")
+	f.CheckField(validator.MaxChars(f.Email, 100), "email", "This field cannot be more than 100 characters long")
+	f.CheckField(validator.Matches(f.Email, validator.EmailRX), "email", "This field must be a valid email address")
+	checkPassword(&f.Validator, f.Password, f.ConfirmPassword)
+}
+
+// checkPassword applies the password policy to a new password and its
+// confirmation.
+func checkPassword(v *validator.Validator, password, confirm string) {
+	v.CheckField(validator.NotBlank(password), "password", "This field cannot be blank")
+	v.CheckField(validator.MinChars(password, 8), "password", "This field must be at least 8 characters long")
+	// bcrypt ignores anything past 72 bytes.
+	v.CheckField(validator.MaxBytes(password, 72), "password", "This field cannot be more than 72 bytes long")
+	v.CheckField(validator.StrongPassword(password), "password", "This field must contain at least one letter and one digit")
+	v.CheckField(confirm == password, "confirm_password", "The passwords do not match")
 }
 
 func (app *application) logoutPost(w http.ResponseWriter, r *http.Request) {
@@ -51,8 +92,10 @@ func (app *application) logoutPost(w http.ResponseWriter, r *http.Request) {
 	err := app.sessionManager.RenewToken(r.Context())
 	if err != nil {
 		app.serverError(w, err)
+		return
 	}
 	app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+	app.sessionManager.Remove(r.Context(), "chatMessage")
 	app.sessionManager.Put(r.Context(), "flash", "You've been logged out successfully!")
 	// Redirect the user to the application home page.
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -60,9 +103,17 @@ func (app *application) logoutPost(w http.ResponseWriter, r *http.Request) {
 }
 
 type userLoginForm struct {
-	UserName string `form:"username"`
-	Password string `form:"password"`
-	//validator.Validator `form:"-"` //Todo
+	UserName            string `form:"username"`
+	Password            string `form:"password"`
+	NotActivated        bool   `form:"-"`
+	validator.Validator `form:"-"`
+}
+
+// validate only checks that the login form fields are filled in; the
+// credentials themselves are checked against the database.
+func (f *userLoginForm) validate() {
+	f.CheckField(validator.NotBlank(f.UserName), "username", "This field cannot be blank")
+	f.CheckField(validator.NotBlank(f.Password), "password", "This field cannot be blank")
 }
 
 func (app *application) getLogin(w http.ResponseWriter, r *http.Request) {
@@ -85,27 +136,109 @@ func (app *application) postLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	form.validate()
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, "login.tmpl.html", http.StatusUnprocessableEntity, data)
+		return
+	}
+
+	// The lockout is checked before the password so that a locked account
+	// does not cost a bcrypt comparison.
+	ip := clientIP(r)
+	wait, err := app.userData.LoginLockedFor(form.UserName, ip)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if wait > 0 {
+		form.AddNonFieldError(tooManyAttempts(w, wait))
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, "login.tmpl.html", http.StatusTooManyRequests, data)
+		return
+	}
+
 	id, err := app.userData.Athentificate(form.UserName, form.Password)
 
 	if err != nil {
 		if errors.Is(err, data.ErrInvalidCredentials) {
-			app.sessionManager.Put(r.Context(), "flash", "Invalid credentials")
+			wait, err := app.userData.RecordLoginFailure(form.UserName, ip, data.LoginFailed)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			status := http.StatusUnprocessableEntity
+			if wait > 0 {
+				status = http.StatusTooManyRequests
+				form.AddNonFieldError(tooManyAttempts(w, wait))
+			} else {
+				form.AddNonFieldError("Username or password is incorrect")
+			}
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, "login.tmpl.html", status, data)
+			return
+		}
+		if errors.Is(err, data.ErrDisabled) {
+			form.AddNonFieldError("This account is disabled, please contact an administrator")
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, "login.tmpl.html", http.StatusForbidden, data)
+			return
+		}
+		if errors.Is(err, data.ErrNotActivated) {
+			form.AddNonFieldError("Please confirm your email address before logging in")
+			form.NotActivated = true
 			data := app.newTemplateData(r)
 			data.Form = form
-			app.render(w, "login.tmpl.html", http.StatusUnprocessableEntity, data)
+			app.render(w, "login.tmpl.html", http.StatusForbidden, data)
 			return
 		}
 		app.serverError(w, err)
 		return
 	}
 
-	err = app.sessionManager.RenewToken(r.Context())
+	enabled, err := app.userData.TOTPEnabled(id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if enabled {
+		// The session is only renewed and authenticated once the second
+		// factor is verified.
+		app.sessionManager.Put(r.Context(), "twoFactorUserID", id)
+		app.sessionManager.Put(r.Context(), "twoFactorStartedAt", time.Now().Unix())
+		http.Redirect(w, r, "/user/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	err = app.userData.ResetLoginFailures(form.UserName)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.completeLogin(w, r, id)
+}
+
+// completeLogin renews the session token, marks the session as authenticated
+// for the user and sends them to the page they asked for before logging in,
+// or to their dashboard.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, id int) {
+	err := app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	version, err := app.userData.SessionVersion(id)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 	//Add ID to the session Manager
 	app.sessionManager.Put(r.Context(), "authenticatedUserID", id)
+	app.sessionManager.Put(r.Context(), "sessionVersion", version)
 	chatHistories := []*ChatHistory{
 		{
 			ChatMessage: "Welcome to the \"Task Manager\" what can i help you today?",
@@ -119,365 +252,641 @@ func (app *application) postLogin(w http.ResponseWriter, r *http.Request) {
 	// data in one step. If no matching key exists this will return the empty
 	// string.
 	path := app.sessionManager.PopString(r.Context(), "redirectPathAfterLogin")
+	app.sessionManager.Put(r.Context(), "flash", "Login successfull")
 	if path != "" {
 		http.Redirect(w, r, path, http.StatusSeeOther)
 		return
 	}
-	app.sessionManager.Put(r.Context(), "flash", "Login successfull")
 	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", id), http.StatusSeeOther)
 
 }
 
-func (app *application) getSignUp(w http.ResponseWriter, r *http.Request) {
-	data := app.newTemplateData(r)
-	data.Form = userSignupForm{}
+type twoFactorForm struct {
+	Code                string `form:"code"`
+	validator.Validator `form:"-"`
+}
 
-	app.render(w, "sign_up.tmpl.html", http.StatusOK, data)
+// twoFactorLoginTTL is how long a user has to enter their second factor after
+// their password was accepted.
+const twoFactorLoginTTL = 5 * time.Minute
+
+// pendingTwoFactorUser returns the ID of the user whose password was accepted
+// and who still has to enter their second factor, or 0 if there is none or it
+// took too long.
+func (app *application) pendingTwoFactorUser(r *http.Request) int {
+	id := app.sessionManager.GetInt(r.Context(), "twoFactorUserID")
+	startedAt := app.sessionManager.GetInt64(r.Context(), "twoFactorStartedAt")
+	if id == 0 || time.Since(time.Unix(startedAt, 0)) > twoFactorLoginTTL {
+		return 0
+	}
+	return id
 }
 
-func (app *application) postSignUp(w http.ResponseWriter, r *http.Request) {
-	var form userSignupForm
-	err := app.decodePostForm(r, &form)
+func (app *application) getLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if app.pendingTwoFactorUser(r) == 0 {
+		app.sessionManager.Put(r.Context(), "flash", "Please log in again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
 
+	data := app.newTemplateData(r)
+	data.Form = twoFactorForm{}
+	app.render(w, "login_2fa.tmpl.html", http.StatusOK, data)
+}
+
+// postLoginTwoFactor completes the login of a user with two-factor
+// authentication. It accepts either a code of their authenticator app or one
+// of their recovery codes.
+func (app *application) postLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id := app.pendingTwoFactorUser(r)
+	if id == 0 {
+		app.sessionManager.Put(r.Context(), "flash", "Please log in again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.userData.Get(id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	var form twoFactorForm
+	err = app.decodePostForm(r, &form)
 	if err != nil {
 		app.clientError(w, http.StatusBadRequest)
 		return
 	}
-	_, err = app.userData.Register(data.User{
-		Name:     form.Name,
-		Email:    form.Email,
-		Password: form.Password,
-	})
+
+	// Codes are short, so failures count towards the same lockout as
+	// passwords.
+	ip := clientIP(r)
+	status := http.StatusUnprocessableEntity
+	wait, err := app.userData.LoginLockedFor(user.Name, ip)
 	if err != nil {
-		if errors.Is(err, data.ErrDuplicateName) {
-			app.sessionManager.Put(r.Context(), "flash", "Name  all ready exist")
-			data := app.newTemplateData(r)
-			data.Form = form
-			app.render(w, "login.tmpl.html", http.StatusUnprocessableEntity, data)
-			return
-		} else if errors.Is(err, data.ErrDuplicateEmail) {
-			app.sessionManager.Put(r.Context(), "flash", "Email  all ready exist")
-			data := app.newTemplateData(r)
-			data.Form = form
-			app.render(w, "login.tmpl.html", http.StatusUnprocessableEntity, data)
+		app.serverError(w, err)
+		return
+	}
+	if wait > 0 {
+		status = http.StatusTooManyRequests
+		form.AddNonFieldError(tooManyAttempts(w, wait))
+	}
+
+	form.CheckField(validator.NotBlank(form.Code), "code", "This field cannot be blank")
+	if form.Valid() {
+		code := strings.TrimSpace(form.Code)
+		if validator.Matches(code, totpCodeRX) {
+			err = app.userData.VerifyTOTP(id, code, time.Now())
+		} else {
+			err = app.userData.UseRecoveryCode(id, code)
+		}
+		switch {
+		case errors.Is(err, data.ErrInvalidCredentials):
+			wait, err := app.userData.RecordLoginFailure(user.Name, ip, data.SecondFactorFailed)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			if wait > 0 {
+				status = http.StatusTooManyRequests
+				form.AddNonFieldError(tooManyAttempts(w, wait))
+			} else {
+				form.AddFiledError("code", "This code is not valid")
+			}
+		case err != nil:
+			app.serverError(w, err)
 			return
 		}
+	}
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, "login_2fa.tmpl.html", status, data)
+		return
+	}
+
+	err = app.userData.ResetLoginFailures(user.Name)
+	if err != nil {
 		app.serverError(w, err)
 		return
 	}
+	app.sessionManager.Remove(r.Context(), "twoFactorUserID")
+	app.sessionManager.Remove(r.Context(), "twoFactorStartedAt")
+	app.completeLogin(w, r, id)
+}
 
-	app.sessionManager.Put(r.Context(), "flash", "Account created successfully!")
+// totpCodeRX matches the codes shown by authenticator apps.
+var totpCodeRX = regexp.MustCompile(`^[0-9]{6}$`)
 
-	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+// totpSetup holds what the two-factor settings page shows.
+type totpSetup struct {
+	Enabled       bool
+	Secret        string
+	URI           string
+	QRCode        template.URL
+	RecoveryCodes []string
 }
 
-type userChatForm struct {
-	Message string `form:"message"`
+// getTwoFactor shows the two-factor authentication settings of the logged in
+// user. When it is not enabled yet, it provisions a secret and shows it as a
+// QR code to scan with an authenticator app.
+func (app *application) getTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := app.userData.Get(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	setup, err := app.totpSetup(user)
+	if err != nil {
+		if errors.Is(err, data.ErrNoSecretKey) {
+			app.sessionManager.Put(r.Context(), "flash", "Two-factor authentication is not available on this server")
+			http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", user.Id), http.StatusSeeOther)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.User = user
+	data.TOTP = setup
+	data.Form = twoFactorForm{}
+	app.render(w, "two_factor.tmpl.html", http.StatusOK, data)
 }
 
-func (app *application) SendchatMessage(w http.ResponseWriter, r *http.Request) {
-	var form userChatForm
+// totpSetup returns the two-factor settings of a user, provisioning a pending
+// secret if two-factor authentication is not enabled yet.
+func (app *application) totpSetup(user *data.User) (*totpSetup, error) {
+	enabled, err := app.userData.TOTPEnabled(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return &totpSetup{Enabled: true}, nil
+	}
 
-	err := app.decodePostForm(r, &form)
+	opts := totp.GenerateOpts{Issuer: "Task manager", AccountName: user.Name}
+	secret, err := app.userData.PendingTOTP(user.Id)
 	if err != nil {
-		app.clientError(w, http.StatusUnprocessableEntity)
+		return nil, err
+	}
+	if secret != "" {
+		opts.Secret, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	key, err := totp.Generate(opts)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		err = app.userData.SetPendingTOTP(user.Id, key.Secret())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err = png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return &totpSetup{
+		Secret: key.Secret(),
+		URI:    key.URL(),
+		QRCode: template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())),
+	}, nil
+}
+
+// postTwoFactorEnable enables two-factor authentication once the user entered
+// a valid code of their authenticator app, and shows their recovery codes.
+func (app *application) postTwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+	user, err := app.userData.Get(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
 		return
 	}
-	form.Message = strings.ReplaceAll(form.Message, "\"", "'")
 
-	userID, ok := app.sessionManager.Get(r.Context(), "authenticatedUserID").(int)
-	if !ok {
-		app.serverError(w, fmt.Errorf("failed to convert authenticatedUserID to int"))
+	var form twoFactorForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
 		return
 	}
-	chatHistories, ok := app.sessionManager.Get(r.Context(), "chatMessage").([]*ChatHistory)
-	if !ok {
-		app.errlog.Println("failed to convert chatMessage to []*ChatHistory")
+
+	form.CheckField(validator.Matches(strings.TrimSpace(form.Code), totpCodeRX), "code", "Enter the 6 digit code of your app")
+	if form.Valid() {
+		err = app.userData.VerifyTOTP(user.Id, form.Code, time.Now())
+		switch {
+		case errors.Is(err, data.ErrInvalidCredentials):
+			form.AddFiledError("code", "This code is not valid")
+		case err != nil:
+			app.serverError(w, err)
+			return
+		}
+	}
+	if !form.Valid() {
+		setup, err := app.totpSetup(user)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		data := app.newTemplateData(r)
+		data.User = user
+		data.TOTP = setup
+		data.Form = form
+		app.render(w, "two_factor.tmpl.html", http.StatusUnprocessableEntity, data)
 		return
 	}
-	userData, err := app.userData.Get(userID)
+
+	codes, err := app.userData.EnableTOTP(user.Id)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 
-	chatHistories = append(chatHistories, &ChatHistory{ChatUser: userData.Name,
-		ChatMessage: form.Message,
-		ChatTime:    time.Now().Format("15:04")})
+	data := app.newTemplateData(r)
+	data.User = user
+	data.TOTP = &totpSetup{Enabled: true, RecoveryCodes: codes}
+	data.Form = twoFactorForm{}
+	data.Flash = "Two-factor authentication is enabled"
+	app.render(w, "two_factor.tmpl.html", http.StatusOK, data)
+}
 
-	chatBotResponse, err := app.sendRecive.SendReceive(userID, form.Message)
+// postTwoFactorDisable disables two-factor authentication. It asks for a
+// current code, or a recovery code, so that a session left open is not
+// enough to do it.
+func (app *application) postTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	user, err := app.userData.Get(app.authenticatedUserID(r))
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
-	var chatOrder *data.ChatOrder
-	fmt.Println("chatresponse", chatBotResponse.Id)
-	if chatBotResponse.Id != 0 {
-		chatOrder, err = app.chatData.RetrieveUserOrder(chatBotResponse.Id)
-		//fmt.Println("chatresponse", *chatOrder)
-		if err != nil {
+
+	var form twoFactorForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Code), "code", "This field cannot be blank")
+	if form.Valid() {
+		code := strings.TrimSpace(form.Code)
+		if validator.Matches(code, totpCodeRX) {
+			err = app.userData.VerifyTOTP(user.Id, code, time.Now())
+		} else {
+			err = app.userData.UseRecoveryCode(user.Id, code)
+		}
+		switch {
+		case errors.Is(err, data.ErrInvalidCredentials):
+			form.AddFiledError("code", "This code is not valid")
+		case err != nil:
 			app.serverError(w, err)
 			return
 		}
-		fmt.Println(chatOrder)
-		chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
-			ChatMessage: fmt.Sprintf("%s : %s : %s : %s : %s", chatOrder.Intent, chatOrder.Projects,
-				chatOrder.Tasks, chatOrder.Users, chatBotResponse.Message),
-			ChatTime: time.Now().Format("15:04")})
-		fmt.Println(len(chatHistories))
-		app.sessionManager.Put(r.Context(), "chatMessage", chatHistories)
-	} else {
-		chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
-			ChatMessage: chatBotResponse.Message,
-			ChatTime:    time.Now().Format("15:04")})
-		app.sessionManager.Put(r.Context(), "chatMessage", chatHistories)
+	}
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.User = user
+		data.TOTP = &totpSetup{Enabled: true}
+		data.Form = form
+		app.render(w, "two_factor.tmpl.html", http.StatusUnprocessableEntity, data)
+		return
+	}
 
-		http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", userID), http.StatusSeeOther)
+	err = app.userData.DisableTOTP(user.Id)
+	if err != nil {
+		app.serverError(w, err)
 		return
 	}
-	var p data.Project
-	var t data.Task
-	var c data.Comment
-	var a data.Attachment
+	app.sessionManager.Put(r.Context(), "flash", "Two-factor authentication is disabled")
+	http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+}
 
-	if chatOrder != nil {
-		switch chatOrder.Intent {
-		case "create":
-			fmt.Println("create")
-			var idProject, taskID int64
-			if len(chatOrder.Projects) > 0 {
-				for _, project := range chatOrder.Projects {
-					fmt.Println("project", project)
+type profileForm struct {
+	DisplayName         string `form:"display_name"`
+	Timezone            string `form:"timezone"`
+	NotifyAssigned      bool   `form:"notify_assigned"`
+	NotifyComments      bool   `form:"notify_comments"`
+	validator.Validator `form:"-"`
+}
 
-					idProject, err = app.GetProjectID(project)
-					if err != nil {
-						app.serverError(w, err)
-						return
-					}
+func (f *profileForm) validate() {
+	f.CheckField(validator.MaxChars(f.DisplayName, 50), "display_name", "This field cannot be more than 50 characters long")
+	f.CheckField(validator.NotBlank(f.Timezone), "timezone", "This field cannot be blank")
+	if f.Timezone != "" {
+		_, err := time.LoadLocation(f.Timezone)
+		f.CheckField(err == nil, "timezone", "This field must be a time zone such as Europe/Paris")
+	}
+}
 
-					p.Name = &project
-					createdByInt64 := int64(userData.Id)
-					p.CreatedBy = &createdByInt64
-					fmt.Println(p.CreatedBy)
-					// Insert the project
-					if idProject == 0 {
-						idProject, err = app.InsertProject(p)
-					}
-					if err != nil {
-						app.serverError(w, err)
-						return
-					}
-				}
-			} else {
-				fmt.Println("no project")
-				chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
-					ChatMessage: "please refrase you word and spacify a project availeble"})
-				app.sessionManager.Put(r.Context(), "chatMessage", chatHistories)
-			}
+type emailChangeForm struct {
+	Email               string `form:"email"`
+	validator.Validator `form:"-"`
+}
 
-			if len(chatOrder.Tasks) > 0 && len(chatOrder.Projects) > 0 {
-				fmt.Println("Ok Task")
-				for _, taskName := range chatOrder.Tasks {
-					t.ProjectID = &idProject
-					t.Title = &taskName
+type changePasswordForm struct {
+	CurrentPassword     string `form:"current_password"`
+	Password            string `form:"password"`
+	ConfirmPassword     string `form:"confirm_password"`
+	validator.Validator `form:"-"`
+}
 
-					t.CreatedBy = userData
-					fmt.Println("task Name:", taskName)
-					fmt.Println("task projectID:", idProject)
-					idTask, err := app.GetTaskID(taskName)
-					if err != nil {
-						app.serverError(w, err)
-						return
-					}
-					fmt.Printf("taskID: %d\n", idTask)
-					if idTask == 0 {
-						taskID, err = app.InsertTask(t)
-					}
-					if err != nil {
-						app.serverError(w, err)
-						return
-					} else {
-						if len(chatOrder.Projects) == 0 {
-							fmt.Println("no project")
-							chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
-								ChatMessage: "please refrase you word and spacify a project availeble"})
-							app.sessionManager.Put(r.Context(), "chatMessage", chatHistories)
-						} else if len(chatOrder.Tasks) == 0 {
-							fmt.Println("no task")
-							chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
-								ChatMessage: "please refrase you word and specify a task availeble"})
-							app.sessionManager.Put(r.Context(), "chatMessage", chatHistories)
-						}
-					}
+// profilePage holds the forms of the profile page, each posted to its own
+// route.
+type profilePage struct {
+	Profile  profileForm
+	Email    emailChangeForm
+	Password changePasswordForm
+}
 
-					if len(chatOrder.Projects) > 0 && len(chatOrder.Tasks) > 0 && len(chatOrder.Comments) > 0 {
-						fmt.Println("Comment", chatOrder.Comments)
-						taskID, err = app.GetTaskID(*t.Title)
-						if err != nil {
-							app.serverError(w, err)
-							return
-						}
-						for _, commentText := range chatOrder.Comments {
-							c.TaskID = &taskID
-							c.User.Id = userID
-							c.CommentText = &commentText
+// emailChangeTTL is how long the link confirming a new email address is valid.
+const emailChangeTTL = 24 * time.Hour
 
-							if err := app.AddComment(c); err != nil {
-								app.serverError(w, err)
-								return
-							}
-						}
-					} else {
-						if len(chatOrder.Projects) == 0 {
-							fmt.Println("no project")
-							chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
-								ChatMessage: "please refrase you word and spacify a project availeble"})
-							app.sessionManager.Put(r.Context(), "chatMessage", chatHistories)
-						} else if len(chatOrder.Tasks) == 0 {
-							fmt.Println("no task")
-							chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
-								ChatMessage: "please refrase you word and specify a task availeble"})
-							app.sessionManager.Put(r.Context(), "chatMessage", chatHistories)
-						}
+// avatarMaxSize is the maximum size of an avatar in bytes.
+const avatarMaxSize = 1 << 20
 
-					}
+// avatarTypes are the content types accepted for avatars.
+var avatarTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true}
 
-				}
-			} else {
-				fmt.Println("Projects=", len(chatOrder.Projects))
-			}
-		case "assign":
-			if len(chatOrder.Projects) > 0 && len(chatOrder.Tasks) > 0 && len(chatOrder.Users) > 0 {
-				for _, taskName := range chatOrder.Tasks {
-					for _, username := range chatOrder.Users {
-						uploadedByID, err := app.GetUserID(username)
-						if err != nil {
-							app.serverError(w, err)
-							return
-						}
-						t.Title = &taskName
-						taskID, err := app.GetTaskID(*t.Title)
-						if err != nil {
-							app.serverError(w, err)
-							return
-						}
-						a.TaskID = &taskID
-						a.UploadedBy = &uploadedByID
+// renderProfile renders the profile page of the logged in user. Forms left
+// empty in page are filled with the current settings.
+func (app *application) renderProfile(w http.ResponseWriter, r *http.Request, status int, user *data.User, page profilePage) {
+	if page.Profile.Timezone == "" && page.Profile.FieldErrors == nil {
+		page.Profile = profileForm{
+			DisplayName:    user.DisplayName,
+			Timezone:       user.Timezone,
+			NotifyAssigned: user.NotifyAssigned,
+			NotifyComments: user.NotifyComments,
+		}
+	}
+	data := app.newTemplateData(r)
+	data.User = user
+	data.Form = page
+	app.render(w, "profile.tmpl.html", status, data)
+}
 
-						if err := app.AddAttachment(a); err != nil {
-							app.serverError(w, err)
-							return
-						}
-					}
+func (app *application) getProfile(w http.ResponseWriter, r *http.Request) {
+	user, err := app.userData.Get(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.renderProfile(w, r, http.StatusOK, user, profilePage{})
+}
 
-				}
+// postProfile updates the display name, time zone and notification
+// preferences of the logged in user.
+func (app *application) postProfile(w http.ResponseWriter, r *http.Request) {
+	user, err := app.userData.Get(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
 
-			}
-		case "update":
-			fmt.Println("update")
-			if len(chatOrder.Tasks) == 0 {
-				for _, project := range chatOrder.Projects {
-					fmt.Println("project", project)
-					idproject, err := app.GetProjectID(project)
-					if err != nil {
-						app.serverError(w, err)
-						return
-					}
-					if idproject != 0 {
-						fmt.Println("description project ok")
-						for _, description := range chatOrder.Description {
-							err := app.projects.UpdateProjectDescription(idproject, description)
-							if err != nil {
-								app.serverError(w, err)
-								return
-							}
-						}
-						for _, deadline := range chatOrder.Deadline {
-							err := app.projects.UpdateprojectDeadline(idproject, deadline)
-							if err != nil {
-								app.serverError(w, err)
-								return
-							}
-						}
-					}
-				}
-				if len(chatOrder.Projects) == 0 {
-					fmt.Println("no project")
-				}
-			} else {
-				for _, project := range chatOrder.Projects {
-					fmt.Println("project", project)
-					idproject, err := app.GetProjectID(project)
-					if err != nil {
-						app.serverError(w, err)
-						return
-					}
-					for _, task := range chatOrder.Tasks {
+	var form profileForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.DisplayName = strings.TrimSpace(form.DisplayName)
+	form.Timezone = strings.TrimSpace(form.Timezone)
 
-						idTask, err := app.GetTaskID(task)
-						if err != nil {
-							app.serverError(w, err)
-							return
-						}
-						if idproject != 0 && idTask != 0 {
-							for _, description := range chatOrder.Description {
-								err := app.projects.UpdateTaskDescription(idproject, idTask, description)
-								if err != nil {
-									app.serverError(w, err)
-									return
-								}
-							}
-							for _, commentText := range chatOrder.Comments {
-								c.TaskID = &idTask
-								c.User.Id = userID
-								c.CommentText = &commentText
+	form.validate()
+	if !form.Valid() {
+		app.renderProfile(w, r, http.StatusUnprocessableEntity, user, profilePage{Profile: form})
+		return
+	}
 
-								if err := app.AddComment(c); err != nil {
-									app.serverError(w, err)
-									return
-								}
-							}
+	user.DisplayName = form.DisplayName
+	user.Timezone = form.Timezone
+	user.NotifyAssigned = form.NotifyAssigned
+	user.NotifyComments = form.NotifyComments
+	err = app.userData.UpdateProfile(user)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
 
-							for _, deadline := range chatOrder.Deadline {
-								err := app.projects.UpdateTaskDeadline(idproject, idTask, deadline)
-								if err != nil {
-									app.serverError(w, err)
-									return
-								}
-							}
-						}
-					}
-				}
+	app.sessionManager.Put(r.Context(), "flash", "Your profile is updated")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
 
-			}
+// postProfileEmail sends a confirmation link to the new email address of the
+// logged in user. The address only changes once the link is opened.
+func (app *application) postProfileEmail(w http.ResponseWriter, r *http.Request) {
+	user, err := app.userData.Get(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	var form emailChangeForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Email = strings.TrimSpace(form.Email)
+
+	form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
+	form.CheckField(validator.MaxChars(form.Email, 100), "email", "This field cannot be more than 100 characters long")
+	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
+	form.CheckField(form.Email != user.Email, "email", "This is already your email address")
+
+	var token string
+	if form.Valid() {
+		token, err = app.userData.NewEmailChange(user.Id, form.Email, emailChangeTTL)
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			form.AddFiledError("email", "Email address is already in use")
+		case err != nil:
+			app.serverError(w, err)
+			return
 		}
+	}
+	if !form.Valid() {
+		app.renderProfile(w, r, http.StatusUnprocessableEntity, user, profilePage{Email: form})
+		return
+	}
 
-	} else {
-		//fmt.Println("chatorder is nil")
-		chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
-			ChatMessage: "please refrase you words and specify an order availeble"})
-		app.sessionManager.Put(r.Context(), "chatMessage", chatHistories)
+	body := fmt.Sprintf("Hello %s,\n\n"+
+		"Open the link below within the next day to use this address for your Task manager account:\n\n"+
+		"%s/user/email/confirm?token=%s\n\n"+
+		"If you did not ask for this change, you can ignore this email.\n",
+		user.Shown(), app.baseURL, url.QueryEscape(token))
+	err = app.mailer.Send(r.Context(), form.Email, "Confirm your new email address", body)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
 
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("We sent a confirmation link to %s", form.Email))
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+func (app *application) getConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	_, err := app.userData.ConfirmEmailChange(r.URL.Query().Get("token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidToken):
+			app.sessionManager.Put(r.Context(), "flash", "This confirmation link is invalid or has expired")
+		case errors.Is(err, data.ErrDuplicateEmail):
+			app.sessionManager.Put(r.Context(), "flash", "This email address is now used by another account")
+		default:
+			app.serverError(w, err)
+			return
+		}
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
 	}
 
-	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", userID), http.StatusSeeOther)
+	app.sessionManager.Put(r.Context(), "flash", "Your email address is updated")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
 }
 
-// userTasksView is an HTTP handler function that retrieves a data registry entry by its ID.
-// It extracts the ID from the URL parameters, fetches the corresponding registry entry,
-// and renders the view.tmpl.html template with the retrieved data.
-// If the ID is invalid or the registry entry is not found, it returns a 404 Not Found response.
-// If there is any other error, it logs the error and returns a server error response.
-func (app *application) userTasksView(w http.ResponseWriter, r *http.Request) {
-	params := httprouter.ParamsFromContext(r.Context())
+// postProfilePassword changes the password of the logged in user. Their
+// other sessions are logged out, the current one is kept.
+func (app *application) postProfilePassword(w http.ResponseWriter, r *http.Request) {
+	user, err := app.userData.Get(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
 
-	id, err := strconv.Atoi(params.ByName("id"))
-	if err != nil || id < 1 {
+	var form changePasswordForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.CurrentPassword), "current_password", "This field cannot be blank")
+	checkPassword(&form.Validator, form.Password, form.ConfirmPassword)
+	if form.Valid() {
+		err = app.userData.ChangePassword(user.Id, form.CurrentPassword, form.Password)
+		switch {
+		case errors.Is(err, data.ErrInvalidCredentials):
+			form.AddFiledError("current_password", "Your current password is incorrect")
+		case err != nil:
+			app.serverError(w, err)
+			return
+		}
+	}
+	if !form.Valid() {
+		app.renderProfile(w, r, http.StatusUnprocessableEntity, user, profilePage{Password: form})
+		return
+	}
+
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	version, err := app.userData.SessionVersion(user.Id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "sessionVersion", version)
+
+	app.sessionManager.Put(r.Context(), "flash", "Your password is changed, your other sessions are logged out")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// postProfileAvatar replaces the avatar of the logged in user with an
+// uploaded image.
+func (app *application) postProfileAvatar(w http.ResponseWriter, r *http.Request) {
+	id := app.authenticatedUserID(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, avatarMaxSize+1<<20)
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			app.sessionManager.Put(r.Context(), "flash", "The image is too large")
+			http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+			return
+		}
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("avatar")
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if header.Size > avatarMaxSize {
+		app.sessionManager.Put(r.Context(), "flash", "The image is too large")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	contentType, err := sniffContentType(file)
+	if err != nil && !errors.Is(err, io.EOF) {
+		app.serverError(w, err)
+		return
+	}
+	if !avatarTypes[contentType] {
+		app.sessionManager.Put(r.Context(), "flash", "The avatar must be a PNG, JPEG or GIF image")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	key, stored, err := app.storeFile(r.Context(), file, header.Size, contentType)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	old, err := app.userData.SetAvatar(id, key, contentType)
+	if err != nil {
+		if stored {
+			app.releaseFiles(r.Context(), []string{key})
+		}
+		app.serverError(w, err)
+		return
+	}
+	if old != "" && old != key {
+		app.releaseFiles(r.Context(), []string{old})
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your avatar is updated")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+func (app *application) postProfileAvatarRemove(w http.ResponseWriter, r *http.Request) {
+	old, err := app.userData.SetAvatar(app.authenticatedUserID(r), "", "")
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if old != "" {
+		app.releaseFiles(r.Context(), []string{old})
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your avatar is removed")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// getAvatar serves the avatar of a user.
+func (app *application) getAvatar(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
 		app.notFound(w)
 		return
 	}
 
-	user, err := app.userData.Get(id)
+	user, err := app.userData.Get(int(id))
 	if err != nil {
 		if errors.Is(err, data.ErrNoRecord) {
 			app.notFound(w)
@@ -486,38 +895,3229 @@ func (app *application) userTasksView(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if user.AvatarKey == "" {
+		app.notFound(w)
+		return
+	}
+
+	content, err := app.files.Get(r.Context(), user.AvatarKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	defer content.Close()
+
+	// Avatar URLs carry the storage key, so a new avatar gets a new URL.
+	w.Header().Set("Content-Type", user.AvatarType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	_, err = io.Copy(w, content)
+	if err != nil {
+		app.errlog.Println(err)
+	}
+}
 
+func (app *application) getSignUp(w http.ResponseWriter, r *http.Request) {
 	data := app.newTemplateData(r)
-	data.User = user
-	projects, err := app.projects.GetAllProjects()
+	data.Form = userSignupForm{}
+
+	app.render(w, "sign_up.tmpl.html", http.StatusOK, data)
+}
+
+func (app *application) postSignUp(w http.ResponseWriter, r *http.Request) {
+	var form userSignupForm
+	err := app.decodePostForm(r, &form)
+
 	if err != nil {
-		app.serverError(w, err)
+		app.clientError(w, http.StatusBadRequest)
 		return
 	}
-	//Enhanced debugging output
-	// for i, project := range projects {
-	// 	fmt.Printf("Project %d: %+v\n", i, project)
-	// 	for j, task := range project.Tasks {
-	// 		fmt.Printf("  Task %d: %+v\n", j, task)
-	// 		for k, comment := range task.Comments {
-	// 			fmt.Printf("    Comment %d: %+v\n", k+1, &comment.CommentText)
-	// 		}
-	// 	}
-	// }
 
-	chathistory, ok := app.sessionManager.Get(r.Context(), "chatMessage").([]*ChatHistory)
-	if !ok {
-		app.serverError(w, fmt.Errorf("enable to extract chat history"))
+	form.validate()
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, "sign_up.tmpl.html", http.StatusUnprocessableEntity, data)
+		return
+	}
+
+	id, err := app.userData.Register(data.User{
+		Name:     form.Name,
+		Email:    form.Email,
+		Password: form.Password,
+	})
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateName) {
+			form.AddFiledError("username", "This username is already taken")
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, "sign_up.tmpl.html", http.StatusUnprocessableEntity, data)
+			return
+		} else if errors.Is(err, data.ErrDuplicateEmail) {
+			form.AddFiledError("email", "This email address is already in use")
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, "sign_up.tmpl.html", http.StatusUnprocessableEntity, data)
+			return
+		}
+		app.serverError(w, err)
+		return
 	}
-	users, err := app.userData.GetAllUserNames()
+
+	err = app.sendActivationEmail(r.Context(), &data.User{Id: id, Name: form.Name, Email: form.Email})
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
-	data.ChatHistories = chathistory
-	data.Projects = projects
-	data.ListUsers = users
-	//fmt.Println("data:", data.ChatHistories)
 
-	app.render(w, "tasks.tmpl.html", http.StatusOK, data)
+	app.sessionManager.Put(r.Context(), "flash", "Account created! Check your email to activate it.")
+
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// activationTTL is how long an email verification link stays valid.
+const activationTTL = 48 * time.Hour
+
+// sendActivationEmail emails a new verification link to a user.
+func (app *application) sendActivationEmail(ctx context.Context, user *data.User) error {
+	token, err := app.userData.NewActivation(user.Id, activationTTL)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hello %s,\n\n"+
+		"Welcome to Task manager! Open the link below within the next two days to confirm your email\n"+
+		"address and activate your account:\n\n%s/user/activate?token=%s\n\n"+
+		"If you did not sign up, you can ignore this email.\n",
+		user.Name, app.baseURL, url.QueryEscape(token))
+	return app.mailer.Send(ctx, user.Email, "Confirm your email address", body)
+}
+
+// getActivate activates the account a verification link was sent for.
+func (app *application) getActivate(w http.ResponseWriter, r *http.Request) {
+	_, err := app.userData.Activate(r.URL.Query().Get("token"))
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidToken) {
+			app.sessionManager.Put(r.Context(), "flash", "This activation link is invalid or has expired, please ask for a new one")
+			http.Redirect(w, r, "/user/activate/resend", http.StatusSeeOther)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your account is activated, you can now log in")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+func (app *application) getResendActivation(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = forgotPasswordForm{}
+	app.render(w, "resend_activation.tmpl.html", http.StatusOK, data)
+}
+
+// postResendActivation emails a new verification link if the address belongs
+// to an account that is not activated yet. Like postForgotPassword, the
+// answer does not tell whether an account matched.
+func (app *application) postResendActivation(w http.ResponseWriter, r *http.Request) {
+	var form forgotPasswordForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
+	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, "resend_activation.tmpl.html", http.StatusUnprocessableEntity, data)
+		return
+	}
+
+	user, err := app.userData.GetByEmail(form.Email)
+	switch {
+	case err == nil:
+		if !user.Activated {
+			err = app.sendActivationEmail(r.Context(), user)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+	case !errors.Is(err, data.ErrNoRecord):
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "If an account waits for activation with this address, a new link is on its way")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+type forgotPasswordForm struct {
+	Email               string `form:"email"`
+	validator.Validator `form:"-"`
+}
+
+// passwordResetTTL is how long a password reset link stays valid.
+const passwordResetTTL = time.Hour
+
+func (app *application) getForgotPassword(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = forgotPasswordForm{}
+	app.render(w, "forgot_password.tmpl.html", http.StatusOK, data)
+}
+
+// postForgotPassword emails a password reset link to the owner of the given
+// address. The answer is the same whether an account matches or not, so that
+// the form cannot be used to find out who has an account.
+func (app *application) postForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var form forgotPasswordForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
+	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, "forgot_password.tmpl.html", http.StatusUnprocessableEntity, data)
+		return
+	}
+
+	user, err := app.userData.GetByEmail(form.Email)
+	switch {
+	case err == nil:
+		// A link that is still valid is not sent again, without telling
+		// apart the addresses that have an account.
+		err = app.sendPasswordReset(r.Context(), user)
+		if err != nil && !errors.Is(err, data.ErrResetPending) {
+			app.serverError(w, err)
+			return
+		}
+	case !errors.Is(err, data.ErrNoRecord):
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "If an account uses this address, a reset link is on its way")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+type resetPasswordForm struct {
+	Token               string `form:"token"`
+	Password            string `form:"password"`
+	ConfirmPassword     string `form:"confirm_password"`
+	validator.Validator `form:"-"`
+}
+
+// sendPasswordReset creates a password reset token for a user and emails them
+// the link to use it. It returns data.ErrResetPending if a link sent earlier
+// is still valid.
+func (app *application) sendPasswordReset(ctx context.Context, user *data.User) error {
+	token, err := app.userData.NewPasswordReset(user.Id, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hello %s,\n\n"+
+		"Someone asked to reset the password of your Task manager account. If it was you, open the link\n"+
+		"below within the next hour to choose a new password:\n\n%s/user/password/reset?token=%s\n\n"+
+		"If you did not ask for it, you can ignore this email: your password will not change.\n",
+		user.Name, app.baseURL, url.QueryEscape(token))
+	return app.mailer.Send(ctx, user.Email, "Reset your password", body)
+}
+
+func (app *application) getResetPassword(w http.ResponseWriter, r *http.Request) {
+	form := resetPasswordForm{Token: r.URL.Query().Get("token")}
+	valid, err := app.userData.PasswordResetValid(form.Token)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if !valid {
+		form.AddNonFieldError("This reset link is invalid or has expired, please ask for a new one")
+		status = http.StatusBadRequest
+	}
+
+	data := app.newTemplateData(r)
+	data.Form = form
+	app.render(w, "reset_password.tmpl.html", status, data)
+}
+
+// postResetPassword sets the new password. Changing it logs the user out of
+// every session, so they are sent to the login page.
+func (app *application) postResetPassword(w http.ResponseWriter, r *http.Request) {
+	var form resetPasswordForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	checkPassword(&form.Validator, form.Password, form.ConfirmPassword)
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, "reset_password.tmpl.html", http.StatusUnprocessableEntity, data)
+		return
+	}
+
+	_, err = app.userData.ResetPassword(form.Token, form.Password)
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidToken) {
+			form.AddNonFieldError("This reset link is invalid or has expired, please ask for a new one")
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, "reset_password.tmpl.html", http.StatusBadRequest, data)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+	app.sessionManager.Put(r.Context(), "flash", "Your password has been changed, please log in")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+type userChatForm struct {
+	Message string `form:"message"`
+}
+
+// SendchatMessage is the form post of the chat, used when the chat socket
+// cannot be opened.
+func (app *application) SendchatMessage(w http.ResponseWriter, r *http.Request) {
+	var form userChatForm
+
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	userID := app.authenticatedUserID(r)
+	lines, err := app.chatReply(userID, form.Message)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	// Sessions opened before the chat existed have no history yet.
+	chatHistories, _ := app.sessionManager.Get(r.Context(), "chatMessage").([]*ChatHistory)
+	app.sessionManager.Put(r.Context(), "chatMessage", append(chatHistories, lines...))
+
+	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", userID), http.StatusSeeOther)
+}
+
+// chatReply sends a message of the user to the bot and carries out the order
+// the bot makes of it. It returns the lines to add to the chat: the message of
+// the user followed by the answers of the bot.
+func (app *application) chatReply(userID int, message string) ([]*ChatHistory, error) {
+	message = strings.ReplaceAll(message, "\"", "'")
+
+	userData, err := app.userData.Get(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	chatHistories := []*ChatHistory{{ChatUser: userData.Shown(),
+		ChatMessage: message,
+		ChatTime:    userData.Local(time.Now()).Format("15:04")}}
+
+	chatBotResponse, err := app.sendRecive.SendReceive(userID, message)
+	if err != nil {
+		return nil, err
+	}
+	var chatOrder *data.ChatOrder
+	if chatBotResponse.Id != 0 {
+		chatOrder, err = app.chatData.RetrieveUserOrder(chatBotResponse.Id)
+		if err != nil {
+			return nil, err
+		}
+		chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+			ChatMessage: fmt.Sprintf("%s : %s : %s : %s : %s", chatOrder.Intent, chatOrder.Projects,
+				chatOrder.Tasks, chatOrder.Users, chatBotResponse.Message),
+			ChatTime: time.Now().Format("15:04")})
+	} else {
+		chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+			ChatMessage: chatBotResponse.Message,
+			ChatTime:    time.Now().Format("15:04")})
+		return chatHistories, nil
+	}
+	var p data.Project
+	var t data.Task
+	var c data.Comment
+
+	if chatOrder != nil {
+		switch chatOrder.Intent {
+		case "create":
+			var idProject, taskID int64
+			if len(chatOrder.Projects) > 0 {
+				for _, project := range chatOrder.Projects {
+					idProject, err = app.GetProjectID(project)
+					if err != nil {
+						return nil, err
+					}
+
+					p.Name = &project
+					createdByInt64 := int64(userData.Id)
+					p.CreatedBy = &createdByInt64
+					// Insert the project
+					if idProject == 0 {
+						idProject, err = app.InsertProject(p)
+					}
+					if err != nil {
+						return nil, err
+					}
+				}
+			} else {
+				chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+					ChatMessage: "please refrase you word and spacify a project availeble"})
+			}
+
+			if len(chatOrder.Tasks) > 0 && len(chatOrder.Projects) > 0 {
+				for _, taskName := range chatOrder.Tasks {
+					allowed, err := chatAuthorize(app.projects.Authorize(userID, idProject, data.ActionEditTasks),
+						&chatHistories, "add tasks to this project")
+					if err != nil {
+						return nil, err
+					}
+					if !allowed {
+						break
+					}
+					t.ProjectID = &idProject
+					t.Title = &taskName
+
+					t.CreatedBy = userData
+					// The task is looked for in the project only: titles are
+					// unique across the projects, and the ones of the others
+					// are not to be touched.
+					taskID, err = app.GetProjectTaskID(idProject, taskName)
+					if err != nil {
+						return nil, err
+					}
+					if taskID == 0 {
+						taskID, err = app.InsertTask(t)
+					}
+					if errors.Is(err, data.ErrDuplicateRecord) {
+						chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+							ChatMessage: fmt.Sprintf("task %s already exists in another project", taskName),
+							ChatTime:    time.Now().Format("15:04")})
+						continue
+					}
+					if err != nil {
+						return nil, err
+					} else {
+						if len(chatOrder.Projects) == 0 {
+							chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+								ChatMessage: "please refrase you word and spacify a project availeble"})
+						} else if len(chatOrder.Tasks) == 0 {
+							chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+								ChatMessage: "please refrase you word and specify a task availeble"})
+						}
+					}
+
+					if len(chatOrder.Projects) > 0 && len(chatOrder.Tasks) > 0 && len(chatOrder.Comments) > 0 {
+						for _, commentText := range chatOrder.Comments {
+							c.TaskID = &taskID
+							c.User.Id = userID
+							c.CommentText = &commentText
+
+							if err := app.AddComment(c); err != nil {
+								return nil, err
+							}
+						}
+					} else {
+						if len(chatOrder.Projects) == 0 {
+							chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+								ChatMessage: "please refrase you word and spacify a project availeble"})
+						} else if len(chatOrder.Tasks) == 0 {
+							chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+								ChatMessage: "please refrase you word and specify a task availeble"})
+						}
+
+					}
+
+				}
+			}
+		case "assign":
+			if len(chatOrder.Projects) > 0 && len(chatOrder.Tasks) > 0 && len(chatOrder.Users) > 0 {
+				for _, taskName := range chatOrder.Tasks {
+					for _, username := range chatOrder.Users {
+						assigneeID, err := app.GetUserID(username)
+						if errors.Is(err, data.ErrNoRecord) {
+							chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+								ChatMessage: fmt.Sprintf("there is no user named %s", username),
+								ChatTime:    time.Now().Format("15:04")})
+							continue
+						}
+						if err != nil {
+							return nil, err
+						}
+						taskID, err := app.GetTaskID(taskName)
+						if err != nil {
+							return nil, err
+						}
+						allowed, err := chatAuthorize(app.projects.AuthorizeTask(userID, taskID, data.ActionEditTasks),
+							&chatHistories, fmt.Sprintf("assign users to task %s", taskName))
+						if err != nil {
+							return nil, err
+						}
+						if !allowed {
+							continue
+						}
+
+						err = app.projects.AssignUser(taskID, int(assigneeID), userID)
+						if errors.Is(err, data.ErrNotMember) {
+							chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+								ChatMessage: fmt.Sprintf("%s is not a member of the project of task %s", username, taskName),
+								ChatTime:    time.Now().Format("15:04")})
+						} else if err != nil {
+							return nil, err
+						}
+					}
+
+				}
+
+			}
+		case "unassign":
+			if len(chatOrder.Tasks) > 0 && len(chatOrder.Users) > 0 {
+				for _, taskName := range chatOrder.Tasks {
+					for _, username := range chatOrder.Users {
+						assigneeID, err := app.GetUserID(username)
+						if errors.Is(err, data.ErrNoRecord) {
+							chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+								ChatMessage: fmt.Sprintf("there is no user named %s", username),
+								ChatTime:    time.Now().Format("15:04")})
+							continue
+						}
+						if err != nil {
+							return nil, err
+						}
+						taskID, err := app.GetTaskID(taskName)
+						if err != nil {
+							return nil, err
+						}
+						allowed, err := chatAuthorize(app.projects.AuthorizeTask(userID, taskID, data.ActionEditTasks),
+							&chatHistories, fmt.Sprintf("unassign users from task %s", taskName))
+						if err != nil {
+							return nil, err
+						}
+						if !allowed {
+							continue
+						}
+
+						err = app.projects.UnassignUser(taskID, int(assigneeID), userID)
+						if errors.Is(err, data.ErrNoRecord) {
+							chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+								ChatMessage: fmt.Sprintf("%s is not assigned to task %s", username, taskName),
+								ChatTime:    time.Now().Format("15:04")})
+						} else if err != nil {
+							return nil, err
+						}
+					}
+				}
+			}
+		case "status":
+			if len(chatOrder.Tasks) == 0 || len(chatOrder.Status) == 0 {
+				chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+					ChatMessage: "please specify a task and the status to set",
+					ChatTime:    time.Now().Format("15:04")})
+				break
+			}
+			status := data.NormalizeStatus(chatOrder.Status[0])
+			for _, taskName := range chatOrder.Tasks {
+				idTask, err := app.GetTaskID(taskName)
+				if err != nil {
+					return nil, err
+				}
+				if idTask == 0 {
+					chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+						ChatMessage: fmt.Sprintf("task %s does not exist", taskName),
+						ChatTime:    time.Now().Format("15:04")})
+					continue
+				}
+				allowed, err := chatAuthorize(app.projects.AuthorizeTask(userID, idTask, data.ActionEditTasks),
+					&chatHistories, fmt.Sprintf("change the status of task %s", taskName))
+				if err != nil {
+					return nil, err
+				}
+				if !allowed {
+					continue
+				}
+				err = app.projects.UpdateTaskStatus(idTask, status, userID)
+				var transitionErr *data.TransitionError
+				switch {
+				case errors.As(err, &transitionErr):
+					chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+						ChatMessage: fmt.Sprintf("task %s cannot move from %s to %s", taskName,
+							transitionErr.From, transitionErr.To),
+						ChatTime: time.Now().Format("15:04")})
+				case errors.Is(err, data.ErrInvalidStatus):
+					chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+						ChatMessage: fmt.Sprintf("%s is not a valid status", chatOrder.Status[0]),
+						ChatTime:    time.Now().Format("15:04")})
+				case err != nil:
+					return nil, err
+				}
+			}
+		case "update":
+			if len(chatOrder.Tasks) == 0 {
+				for _, project := range chatOrder.Projects {
+					idproject, err := app.GetProjectID(project)
+					if err != nil {
+						return nil, err
+					}
+					if idproject != 0 {
+						allowed, err := chatAuthorize(app.projects.Authorize(userID, idproject, data.ActionEditProject),
+							&chatHistories, fmt.Sprintf("update project %s", project))
+						if err != nil {
+							return nil, err
+						}
+						if !allowed {
+							continue
+						}
+						for _, description := range chatOrder.Description {
+							err := app.projects.UpdateProjectDescription(idproject, description)
+							if err != nil {
+								return nil, err
+							}
+						}
+						for _, deadline := range chatOrder.Deadline {
+							err := app.projects.UpdateprojectDeadline(idproject, deadline)
+							if err != nil {
+								return nil, err
+							}
+						}
+					}
+				}
+				if len(chatOrder.Projects) == 0 {
+					chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+						ChatMessage: "please refrase you word and spacify a project availeble",
+						ChatTime:    time.Now().Format("15:04")})
+				}
+			} else {
+				for _, project := range chatOrder.Projects {
+					idproject, err := app.GetProjectID(project)
+					if err != nil {
+						return nil, err
+					}
+					for _, task := range chatOrder.Tasks {
+
+						idTask, err := app.GetTaskID(task)
+						if err != nil {
+							return nil, err
+						}
+						if idproject != 0 && idTask != 0 {
+							allowed, err := chatAuthorize(app.projects.AuthorizeTask(userID, idTask, data.ActionEditTasks),
+								&chatHistories, fmt.Sprintf("update task %s", task))
+							if err != nil {
+								return nil, err
+							}
+							if !allowed {
+								continue
+							}
+							for _, description := range chatOrder.Description {
+								err := app.projects.UpdateTaskDescription(idTask, idproject, description, userID)
+								if errors.Is(err, data.ErrNoRecord) {
+									chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+										ChatMessage: fmt.Sprintf("task %s is not part of project %s", task, project),
+										ChatTime:    time.Now().Format("15:04")})
+									break
+								}
+								if err != nil {
+									return nil, err
+								}
+							}
+							for _, commentText := range chatOrder.Comments {
+								c.TaskID = &idTask
+								c.User.Id = userID
+								c.CommentText = &commentText
+
+								if err := app.AddComment(c); err != nil {
+									return nil, err
+								}
+							}
+
+							for _, deadline := range chatOrder.Deadline {
+								err := app.projects.UpdateTaskDeadline(idTask, idproject, deadline, userID)
+								if errors.Is(err, data.ErrNoRecord) {
+									chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+										ChatMessage: fmt.Sprintf("task %s is not part of project %s", task, project),
+										ChatTime:    time.Now().Format("15:04")})
+									break
+								}
+								if err != nil {
+									return nil, err
+								}
+							}
+						}
+					}
+				}
+
+			}
+		}
+
+	} else {
+		chatHistories = append(chatHistories, &ChatHistory{ChatUser: "Bot",
+			ChatMessage: "please refrase you words and specify an order availeble"})
+
+	}
+	return chatHistories, nil
+}
+
+// chatAuthorize interprets the result of an authorization check made for a
+// chat order. A forbidden order is answered by a bot message added to the
+// chat histories and reported as not allowed; other errors are returned.
+func chatAuthorize(err error, chatHistories *[]*ChatHistory, action string) (bool, error) {
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, data.ErrForbidden):
+		*chatHistories = append(*chatHistories, &ChatHistory{ChatUser: "Bot",
+			ChatMessage: fmt.Sprintf("you are not allowed to %s", action),
+			ChatTime:    time.Now().Format("15:04")})
+		return false, nil
+	case errors.Is(err, data.ErrNoRecord):
+		*chatHistories = append(*chatHistories, &ChatHistory{ChatUser: "Bot",
+			ChatMessage: fmt.Sprintf("cannot %s: it does not exist", action),
+			ChatTime:    time.Now().Format("15:04")})
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+type dashboardFilterForm struct {
+	Status              string `form:"status"`
+	Priority            int    `form:"priority"`
+	DueFrom             string `form:"due_from"`
+	DueTo               string `form:"due_to"`
+	AssigneeID          int    `form:"assignee"`
+	ProjectID           int64  `form:"project"`
+	validator.Validator `form:"-"`
+}
+
+// Statuses lists the values offered by the status filter.
+func (f dashboardFilterForm) Statuses() []string {
+	return data.TaskStatuses
+}
+
+// filter validates the form and converts it into a data.TaskFilter. Invalid
+// values are reported as field errors and ignored.
+func (f *dashboardFilterForm) filter() data.TaskFilter {
+	filter := data.TaskFilter{
+		AssigneeID: f.AssigneeID,
+		ProjectID:  f.ProjectID,
+	}
+
+	f.CheckField(f.Status == "" || data.ValidStatus(f.Status), "status", "Unknown status")
+	if _, invalid := f.FieldErrors["status"]; !invalid {
+		filter.Status = f.Status
+	}
+	f.CheckField(validator.PermittedInt(f.Priority, 0, 1, 2, 3), "priority", "Unknown priority")
+	if _, invalid := f.FieldErrors["priority"]; !invalid {
+		filter.Priority = f.Priority
+	}
+	if f.DueFrom != "" {
+		date, err := time.Parse("02/01/2006", f.DueFrom)
+		f.CheckField(err == nil, "due_from", "The date must use the dd/mm/yyyy format")
+		if err == nil {
+			filter.DueAfter = &date
+		}
+	}
+	if f.DueTo != "" {
+		date, err := time.Parse("02/01/2006", f.DueTo)
+		f.CheckField(err == nil, "due_to", "The date must use the dd/mm/yyyy format")
+		if err == nil {
+			filter.DueBefore = &date
+		}
+	}
+	return filter
+}
+
+// userTasksView renders the dashboard of a user: the projects they created or
+// take part in, with their tasks narrowed by the filters passed as query
+// parameters (status, priority, due_from, due_to, assignee and project).
+// Users can only view their own dashboard.
+func (app *application) userTasksView(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+	if id != app.authenticatedUserID(r) {
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	user, err := app.userData.Get(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	var form dashboardFilterForm
+	err = app.formDecoder.Decode(&form, r.URL.Query())
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	filter := form.filter()
+	users, _, err := app.userData.ListUsers(data.UserFilter{ActiveOnly: true})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.User = user
+	projects, err := app.projects.GetUserProjects(id, filter)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	projectOptions, err := app.projects.ListUserProjects(id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	chathistory, _ := app.sessionManager.Get(r.Context(), "chatMessage").([]*ChatHistory)
+	data.ChatHistories = chathistory
+	data.Projects = projects
+	data.ProjectOptions = projectOptions
+	data.ListUsers = users
+	data.Form = form
+
+	app.render(w, "tasks.tmpl.html", http.StatusOK, data)
+}
+
+// projectForm is also decoded from the JSON body of the API requests.
+type projectForm struct {
+	Name                string `form:"name" json:"name"`
+	Description         string `form:"description" json:"description"`
+	Deadline            string `form:"deadline" json:"deadline"`
+	validator.Validator `form:"-" json:"-"`
+}
+
+// newProjectForm returns a project form filled with the values of a project.
+func newProjectForm(project *data.Project) projectForm {
+	form := projectForm{}
+	if project.Name != nil {
+		form.Name = *project.Name
+	}
+	if project.Description != nil {
+		form.Description = *project.Description
+	}
+	if project.Deadline != nil {
+		form.Deadline = *project.Deadline
+	}
+	return form
+}
+
+// validate checks the project form fields against the constraints of the
+// projects table.
+func (f *projectForm) validate() {
+	f.CheckField(validator.NotBlank(f.Name), "name", "This field cannot be blank")
+	f.CheckField(validator.MaxChars(f.Name, 100), "name", "This field cannot be more than 100 characters long")
+	f.CheckField(f.Deadline == "" || validator.ValidDate(f.Deadline, "02/01/2006"), "deadline", "The deadline must use the dd/mm/yyyy format")
+}
+
+// project builds a data.Project from the submitted form values.
+func (f *projectForm) project() data.Project {
+	p := data.Project{Name: &f.Name}
+	if f.Description != "" {
+		p.Description = &f.Description
+	}
+	if f.Deadline != "" {
+		p.Deadline = &f.Deadline
+	}
+	return p
+}
+
+func (app *application) getProjectCreate(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = projectForm{}
+
+	app.render(w, "project_form.tmpl.html", http.StatusOK, data)
+}
+
+func (app *application) postProjectCreate(w http.ResponseWriter, r *http.Request) {
+	var form projectForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.validate()
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, "project_form.tmpl.html", http.StatusUnprocessableEntity, data)
+		return
+	}
+
+	userID := app.authenticatedUserID(r)
+	p := form.project()
+	createdBy := int64(userID)
+	p.CreatedBy = &createdBy
+
+	_, err = app.projects.InsertProject(p)
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateRecord) {
+			form.AddFiledError("name", "A project with this name already exists")
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, "project_form.tmpl.html", http.StatusUnprocessableEntity, data)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Project created successfully!")
+	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", userID), http.StatusSeeOther)
+}
+
+func (app *application) getProjectEdit(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorize(w, r, id, data.ActionEditProject) {
+		return
+	}
+
+	project, err := app.projects.GetProject(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Project = project
+	data.Form = newProjectForm(project)
+	app.render(w, "project_form.tmpl.html", http.StatusOK, data)
+}
+
+func (app *application) postProjectEdit(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorize(w, r, id, data.ActionEditProject) {
+		return
+	}
+
+	project, err := app.projects.GetProject(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	var form projectForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.validate()
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Project = project
+		data.Form = form
+		app.render(w, "project_form.tmpl.html", http.StatusUnprocessableEntity, data)
+		return
+	}
+
+	p := form.project()
+	p.ProjectID = id
+	err = app.projects.UpdateProject(p)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecord):
+			form.AddFiledError("name", "A project with this name already exists")
+			data := app.newTemplateData(r)
+			data.Project = project
+			data.Form = form
+			app.render(w, "project_form.tmpl.html", http.StatusUnprocessableEntity, data)
+		case errors.Is(err, data.ErrNoRecord):
+			app.notFound(w)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Project updated successfully!")
+	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", app.authenticatedUserID(r)), http.StatusSeeOther)
+}
+
+func (app *application) postProjectDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorize(w, r, id, data.ActionDeleteProject) {
+		return
+	}
+
+	keys, err := app.projects.ProjectStorageKeys(id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.projects.DeleteProject(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	app.releaseFiles(r.Context(), keys)
+
+	app.sessionManager.Put(r.Context(), "flash", "Project deleted successfully!")
+	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", app.authenticatedUserID(r)), http.StatusSeeOther)
+}
+
+type memberForm struct {
+	Username            string `form:"username"`
+	Role                string `form:"role"`
+	validator.Validator `form:"-"`
+}
+
+// Roles returns the roles offered by the invitation form.
+func (f memberForm) Roles() []string {
+	return data.ProjectRoles
+}
+
+// renderMembers renders the member list of a project with the invitation form.
+// The project role of the logged in user decides which actions are offered.
+func (app *application) renderMembers(w http.ResponseWriter, r *http.Request, status int, project *data.Project, form memberForm) {
+	userID := app.authenticatedUserID(r)
+	role, err := app.projects.ProjectRole(project.ProjectID, userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	project.Role = role
+
+	members, err := app.projects.ListMembers(project.ProjectID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	user, err := app.userData.Get(userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Project = project
+	data.Members = members
+	data.User = user
+	data.Form = form
+	app.render(w, "project_members.tmpl.html", status, data)
+}
+
+func (app *application) getProjectMembers(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorize(w, r, id, data.ActionView) {
+		return
+	}
+
+	project, err := app.projects.GetProject(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.renderMembers(w, r, http.StatusOK, project, memberForm{Role: data.RoleMember})
+}
+
+// postProjectMember invites a user in a project, or changes their role when
+// they already are a member.
+func (app *application) postProjectMember(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorize(w, r, id, data.ActionManageMembers) {
+		return
+	}
+
+	project, err := app.projects.GetProject(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	var form memberForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Username), "username", "This field cannot be blank")
+	form.CheckField(data.ValidRole(form.Role), "role", "Please select a role")
+	var memberID int64
+	if form.Valid() {
+		memberID, err = app.GetUserID(strings.TrimSpace(form.Username))
+		if err != nil && !errors.Is(err, data.ErrNoRecord) {
+			app.serverError(w, err)
+			return
+		}
+		form.CheckField(err == nil, "username", "No user with this name")
+	}
+	if !form.Valid() {
+		app.renderMembers(w, r, http.StatusUnprocessableEntity, project, form)
+		return
+	}
+
+	err = app.projects.SetMember(id, int(memberID), form.Role, app.authenticatedUserID(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrForbidden):
+			form.AddFiledError("role", "Only owners can grant or take away the owner role")
+			app.renderMembers(w, r, http.StatusForbidden, project, form)
+		case errors.Is(err, data.ErrLastOwner):
+			form.AddFiledError("role", "The project needs at least one owner")
+			app.renderMembers(w, r, http.StatusUnprocessableEntity, project, form)
+		case errors.Is(err, data.ErrNoRecord):
+			app.notFound(w)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%s is now %s of the project", form.Username, form.Role))
+	http.Redirect(w, r, fmt.Sprintf("/projects/members/%d", id), http.StatusSeeOther)
+}
+
+// postProjectMemberRemove removes a member from a project. Members can always
+// leave a project on their own.
+func (app *application) postProjectMemberRemove(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form taskAssignForm
+	err = app.decodePostForm(r, &form)
+	if err != nil || form.UserID < 1 {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	userID := app.authenticatedUserID(r)
+	redirectURL := fmt.Sprintf("/projects/members/%d", id)
+	err = app.projects.RemoveMember(id, form.UserID, userID)
+	switch {
+	case err == nil:
+		if form.UserID == userID {
+			app.sessionManager.Put(r.Context(), "flash", "You left the project")
+			redirectURL = fmt.Sprintf("/tasks/view/%d", userID)
+		} else {
+			app.sessionManager.Put(r.Context(), "flash", "Member removed from the project")
+		}
+	case errors.Is(err, data.ErrLastOwner):
+		app.sessionManager.Put(r.Context(), "flash", "The project needs at least one owner")
+	case errors.Is(err, data.ErrForbidden):
+		app.clientError(w, http.StatusForbidden)
+		return
+	case errors.Is(err, data.ErrNoRecord):
+		app.notFound(w)
+		return
+	default:
+		app.serverError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+type webhookForm struct {
+	URL                 string   `form:"url"`
+	Secret              string   `form:"secret"`
+	Events              []string `form:"events"`
+	validator.Validator `form:"-"`
+}
+
+// AllEvents lists the events offered by the form.
+func (f webhookForm) AllEvents() []string {
+	return data.WebhookEvents
+}
+
+// HasEvent reports whether an event is checked.
+func (f webhookForm) HasEvent(event string) bool {
+	for _, e := range f.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the webhook form. Only http and https URLs are accepted,
+// and not the ones aimed at the server or its private network.
+func (f *webhookForm) validate() {
+	err := webhook.CheckURL(f.URL)
+	f.CheckField(validator.NotBlank(f.URL), "url", "This field cannot be blank")
+	f.CheckField(!errors.Is(err, webhook.ErrForbiddenAddress), "url",
+		"Loopback, link-local and private addresses are not allowed")
+	f.CheckField(err == nil || errors.Is(err, webhook.ErrForbiddenAddress), "url",
+		"Enter an http or https URL")
+	f.CheckField(f.Secret == "" || validator.MinChars(f.Secret, 16), "secret",
+		"The secret must be at least 16 characters long")
+	f.CheckField(len(f.Events) > 0, "events", "Choose at least one event")
+	for _, e := range f.Events {
+		f.CheckField(data.ValidEvent(e), "events", "This event does not exist")
+	}
+}
+
+// renderWebhooks renders the webhooks of a project with the subscription
+// form.
+func (app *application) renderWebhooks(w http.ResponseWriter, r *http.Request, status int, project *data.Project, form webhookForm) {
+	userID := app.authenticatedUserID(r)
+	role, err := app.projects.ProjectRole(project.ProjectID, userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	project.Role = role
+
+	webhooks, err := app.projects.ListWebhooks(project.ProjectID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	user, err := app.userData.Get(userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Project = project
+	data.Webhooks = webhooks
+	data.User = user
+	data.Form = form
+	app.render(w, "project_webhooks.tmpl.html", status, data)
+}
+
+// getProjectWebhooks lists the webhooks of a project. They hold the secrets
+// signing the payloads, so only the users allowed to edit the project see
+// them.
+func (app *application) getProjectWebhooks(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorize(w, r, id, data.ActionEditProject) {
+		return
+	}
+
+	project, err := app.projects.GetProject(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.renderWebhooks(w, r, http.StatusOK, project, webhookForm{Events: data.WebhookEvents})
+}
+
+// postProjectWebhook subscribes a URL to events of a project. A secret is
+// generated when none is given.
+func (app *application) postProjectWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorize(w, r, id, data.ActionEditProject) {
+		return
+	}
+
+	project, err := app.projects.GetProject(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	var form webhookForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.URL = strings.TrimSpace(form.URL)
+	form.Secret = strings.TrimSpace(form.Secret)
+
+	form.validate()
+	if !form.Valid() {
+		app.renderWebhooks(w, r, http.StatusUnprocessableEntity, project, form)
+		return
+	}
+
+	if form.Secret == "" {
+		form.Secret, err = newWebhookSecret()
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	}
+	_, err = app.projects.InsertWebhook(data.Webhook{
+		ProjectID: id,
+		URL:       form.URL,
+		Secret:    form.Secret,
+		Events:    form.Events,
+	}, app.authenticatedUserID(r))
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Webhook added")
+	http.Redirect(w, r, fmt.Sprintf("/projects/webhooks/%d", id), http.StatusSeeOther)
+}
+
+// webhookTarget reads the webhook an action applies to and checks that the
+// logged in user may edit its project. When the webhook cannot be used, it
+// answers the request and returns false.
+func (app *application) webhookTarget(w http.ResponseWriter, r *http.Request) (*data.Webhook, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return nil, false
+	}
+	webhook, err := app.projects.GetWebhook(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return nil, false
+	}
+	if !app.authorize(w, r, webhook.ProjectID, data.ActionEditProject) {
+		return nil, false
+	}
+	return webhook, true
+}
+
+type webhookToggleForm struct {
+	Active bool `form:"active"`
+}
+
+// postWebhookToggle pauses or resumes a webhook.
+func (app *application) postWebhookToggle(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.webhookTarget(w, r)
+	if !ok {
+		return
+	}
+
+	var form webhookToggleForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.projects.SetWebhookActive(webhook.ID, form.Active)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	if form.Active {
+		app.sessionManager.Put(r.Context(), "flash", "Webhook resumed")
+	} else {
+		app.sessionManager.Put(r.Context(), "flash", "Webhook paused")
+	}
+	http.Redirect(w, r, fmt.Sprintf("/projects/webhooks/%d", webhook.ProjectID), http.StatusSeeOther)
+}
+
+func (app *application) postWebhookDelete(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.webhookTarget(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.projects.DeleteWebhook(webhook.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Webhook deleted")
+	http.Redirect(w, r, fmt.Sprintf("/projects/webhooks/%d", webhook.ProjectID), http.StatusSeeOther)
+}
+
+// webhookPageSize is the number of deliveries on a page of the delivery log.
+const webhookPageSize = 25
+
+type webhookDeliveriesForm struct {
+	Page int `form:"page"`
+}
+
+// getWebhookDeliveries shows the delivery log of a webhook, newest first.
+func (app *application) getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.webhookTarget(w, r)
+	if !ok {
+		return
+	}
+
+	var form webhookDeliveriesForm
+	err := app.formDecoder.Decode(&form, r.URL.Query())
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	if form.Page < 1 {
+		form.Page = 1
+	}
+
+	deliveries, total, err := app.projects.WebhookDeliveries(webhook.ID, form.Page, webhookPageSize)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	project, err := app.projects.GetProject(webhook.ProjectID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	user, err := app.userData.Get(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Project = project
+	data.Webhook = webhook
+	data.Deliveries = deliveries
+	data.User = user
+	data.Pagination = &pagination{
+		Page:  form.Page,
+		Pages: (total + webhookPageSize - 1) / webhookPageSize,
+	}
+	app.render(w, "webhook_deliveries.tmpl.html", http.StatusOK, data)
+}
+
+type webhookRedeliverForm struct {
+	DeliveryID int64 `form:"delivery_id"`
+}
+
+// postWebhookRedeliver queues a delivery again, such as one given up while
+// the receiver was down.
+func (app *application) postWebhookRedeliver(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.webhookTarget(w, r)
+	if !ok {
+		return
+	}
+
+	var form webhookRedeliverForm
+	err := app.decodePostForm(r, &form)
+	if err != nil || form.DeliveryID < 1 {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.projects.RedeliverWebhook(webhook.ID, form.DeliveryID)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Delivery %d queued again", form.DeliveryID))
+	http.Redirect(w, r, fmt.Sprintf("/webhooks/deliveries/%d", webhook.ID), http.StatusSeeOther)
+}
+
+// taskForm is also decoded from the JSON body of the API requests.
+type taskForm struct {
+	Title               string `form:"title" json:"title"`
+	Description         string `form:"description" json:"description"`
+	Priority            int    `form:"priority" json:"priority"`
+	DueDate             string `form:"due_date" json:"due_date"`
+	ProjectID           int64  `form:"project_id" json:"project_id"`
+	AssignedTo          []int  `form:"assigned_to" json:"assigned_to"`
+	validator.Validator `form:"-" json:"-"`
+}
+
+// newTaskForm returns a task form filled with the values of a task.
+func newTaskForm(task *data.Task) taskForm {
+	form := taskForm{}
+	if task.Title != nil {
+		form.Title = *task.Title
+	}
+	if task.Description != nil {
+		form.Description = *task.Description
+	}
+	if task.Priority != nil {
+		form.Priority = *task.Priority
+	}
+	if task.DueDate != nil {
+		form.DueDate = *task.DueDate
+	}
+	if task.ProjectID != nil {
+		form.ProjectID = *task.ProjectID
+	}
+	for _, u := range task.AssignedTo {
+		form.AssignedTo = append(form.AssignedTo, u.Id)
+	}
+	return form
+}
+
+// validate checks the task form fields against the constraints of the tasks
+// table.
+func (f *taskForm) validate() {
+	f.CheckField(validator.NotBlank(f.Title), "title", "This field cannot be blank")
+	f.CheckField(validator.MaxChars(f.Title, 100), "title", "This field cannot be more than 100 characters long")
+	f.CheckField(validator.PermittedInt(f.Priority, 0, 1, 2, 3), "priority", "This field must be low, medium or high")
+	f.CheckField(f.DueDate == "" || validator.ValidDate(f.DueDate, "02/01/2006"), "due_date", "The due date must use the dd/mm/yyyy format")
+	f.CheckField(f.ProjectID > 0, "project_id", "Please select a project")
+}
+
+// task builds a data.Task from the submitted form values.
+func (f *taskForm) task() data.Task {
+	t := data.Task{Title: &f.Title, ProjectID: &f.ProjectID, AssignedTo: []*data.User{}}
+	if f.Description != "" {
+		t.Description = &f.Description
+	}
+	if f.Priority != 0 {
+		t.Priority = &f.Priority
+	}
+	if f.DueDate != "" {
+		t.DueDate = &f.DueDate
+	}
+	for _, id := range f.AssignedTo {
+		t.AssignedTo = append(t.AssignedTo, &data.User{Id: id})
+	}
+	return t
+}
+
+// IsAssigned reports whether the user is selected in the assignees field.
+func (f taskForm) IsAssigned(id int) bool {
+	for _, assigned := range f.AssignedTo {
+		if assigned == id {
+			return true
+		}
+	}
+	return false
+}
+
+// renderTaskForm renders the task creation or edition page with the list of
+// projects and users needed by its select fields.
+func (app *application) renderTaskForm(w http.ResponseWriter, r *http.Request, status int, form taskForm, task *data.Task) {
+	userProjects, err := app.projects.ListUserProjects(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	projects := []data.Project{}
+	for _, p := range userProjects {
+		if p.Can(data.ActionEditTasks) {
+			projects = append(projects, p)
+		}
+	}
+	users, _, err := app.userData.ListUsers(data.UserFilter{ActiveOnly: true})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Task = task
+	data.Projects = projects
+	data.ListUsers = users
+	data.Form = form
+	app.render(w, "task_form.tmpl.html", status, data)
+}
+
+func (app *application) getTaskCreate(w http.ResponseWriter, r *http.Request) {
+	form := taskForm{}
+	// Preselect the project when the form is opened from a project of the
+	// dashboard.
+	projectID, err := strconv.ParseInt(r.URL.Query().Get("project"), 10, 64)
+	if err == nil {
+		form.ProjectID = projectID
+	}
+
+	app.renderTaskForm(w, r, http.StatusOK, form, nil)
+}
+
+func (app *application) postTaskCreate(w http.ResponseWriter, r *http.Request) {
+	var form taskForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.validate()
+	if !form.Valid() {
+		app.renderTaskForm(w, r, http.StatusUnprocessableEntity, form, nil)
+		return
+	}
+
+	if !app.authorize(w, r, form.ProjectID, data.ActionEditTasks) {
+		return
+	}
+
+	userID := app.authenticatedUserID(r)
+	t := form.task()
+	t.CreatedBy = &data.User{Id: userID}
+
+	_, err = app.projects.InsertTask(t)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecord):
+			form.AddFiledError("title", "A task with this title already exists")
+			app.renderTaskForm(w, r, http.StatusUnprocessableEntity, form, nil)
+		case errors.Is(err, data.ErrNotMember):
+			form.AddFiledError("assigned_to", "Only members of the project can be assigned")
+			app.renderTaskForm(w, r, http.StatusUnprocessableEntity, form, nil)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Task created successfully!")
+	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", userID), http.StatusSeeOther)
+}
+
+func (app *application) getTaskEdit(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorizeTask(w, r, id, data.ActionEditTasks) {
+		return
+	}
+
+	task, err := app.projects.GetTask(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.renderTaskForm(w, r, http.StatusOK, newTaskForm(task), task)
+}
+
+func (app *application) postTaskEdit(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorizeTask(w, r, id, data.ActionEditTasks) {
+		return
+	}
+
+	task, err := app.projects.GetTask(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	var form taskForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.validate()
+	if !form.Valid() {
+		app.renderTaskForm(w, r, http.StatusUnprocessableEntity, form, task)
+		return
+	}
+
+	if task.ProjectID == nil || *task.ProjectID != form.ProjectID {
+		if !app.authorize(w, r, form.ProjectID, data.ActionEditTasks) {
+			return
+		}
+	}
+
+	t := form.task()
+	t.TaskID = id
+	err = app.projects.UpdateTask(t, app.authenticatedUserID(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecord):
+			form.AddFiledError("title", "A task with this title already exists")
+			app.renderTaskForm(w, r, http.StatusUnprocessableEntity, form, task)
+		case errors.Is(err, data.ErrNotMember):
+			form.AddFiledError("assigned_to", "Only members of the project can be assigned")
+			app.renderTaskForm(w, r, http.StatusUnprocessableEntity, form, task)
+		case errors.Is(err, data.ErrNoRecord):
+			app.notFound(w)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Task updated successfully!")
+	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", app.authenticatedUserID(r)), http.StatusSeeOther)
+}
+
+type taskMoveForm struct {
+	ProjectID int64 `form:"project_id"`
+}
+
+func (app *application) postTaskMove(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorizeTask(w, r, id, data.ActionEditTasks) {
+		return
+	}
+
+	var form taskMoveForm
+	err = app.decodePostForm(r, &form)
+	if err != nil || form.ProjectID < 1 {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	if !app.authorize(w, r, form.ProjectID, data.ActionEditTasks) {
+		return
+	}
+
+	err = app.projects.MoveTask(id, form.ProjectID, app.authenticatedUserID(r))
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Task moved successfully!")
+	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", app.authenticatedUserID(r)), http.StatusSeeOther)
+}
+
+func (app *application) postTaskDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorizeTask(w, r, id, data.ActionEditProject) {
+		return
+	}
+
+	keys, err := app.projects.TaskStorageKeys(id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.projects.DeleteTask(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	app.releaseFiles(r.Context(), keys)
+
+	app.sessionManager.Put(r.Context(), "flash", "Task deleted successfully!")
+	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", app.authenticatedUserID(r)), http.StatusSeeOther)
+}
+
+type taskStatusForm struct {
+	Status string `form:"status"`
+}
+
+func (app *application) postTaskStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorizeTask(w, r, id, data.ActionEditTasks) {
+		return
+	}
+
+	var form taskStatusForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.projects.UpdateTaskStatus(id, data.NormalizeStatus(form.Status), app.authenticatedUserID(r))
+	var transitionErr *data.TransitionError
+	switch {
+	case err == nil:
+		app.sessionManager.Put(r.Context(), "flash", "Task status updated!")
+	case errors.As(err, &transitionErr):
+		app.sessionManager.Put(r.Context(), "flash",
+			fmt.Sprintf("A task cannot move from %s to %s", transitionErr.From, transitionErr.To))
+	case errors.Is(err, data.ErrInvalidStatus):
+		app.clientError(w, http.StatusBadRequest)
+		return
+	case errors.Is(err, data.ErrNoRecord):
+		app.notFound(w)
+		return
+	default:
+		app.serverError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", app.authenticatedUserID(r)), http.StatusSeeOther)
+}
+
+type taskAssignForm struct {
+	UserID int `form:"user_id"`
+}
+
+func (app *application) postTaskAssign(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorizeTask(w, r, id, data.ActionEditTasks) {
+		return
+	}
+
+	var form taskAssignForm
+	err = app.decodePostForm(r, &form)
+	if err != nil || form.UserID < 1 {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.projects.AssignUser(id, form.UserID, app.authenticatedUserID(r))
+	switch {
+	case err == nil:
+		app.sessionManager.Put(r.Context(), "flash", "User assigned to the task!")
+	case errors.Is(err, data.ErrNotMember):
+		app.sessionManager.Put(r.Context(), "flash", "Only members of the project can be assigned to its tasks")
+	case errors.Is(err, data.ErrNoRecord):
+		app.notFound(w)
+		return
+	default:
+		app.serverError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", app.authenticatedUserID(r)), http.StatusSeeOther)
+}
+
+func (app *application) postTaskUnassign(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorizeTask(w, r, id, data.ActionEditTasks) {
+		return
+	}
+
+	var form taskAssignForm
+	err = app.decodePostForm(r, &form)
+	if err != nil || form.UserID < 1 {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.projects.UnassignUser(id, form.UserID, app.authenticatedUserID(r))
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "User removed from the task!")
+	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", app.authenticatedUserID(r)), http.StatusSeeOther)
+}
+
+// postTaskAttach stores a file uploaded from the dashboard and attaches it to
+// a task. The content type is sniffed from the file itself and checked against
+// the allowed types, and the SHA-256 checksum of the content is used as its
+// storage key so that a file uploaded twice is only stored once.
+func (app *application) postTaskAttach(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorizeTask(w, r, id, data.ActionEditTasks) {
+		return
+	}
+	redirectURL := fmt.Sprintf("/tasks/view/%d", app.authenticatedUserID(r))
+
+	// Leave some room for the multipart boundaries and the other fields.
+	r.Body = http.MaxBytesReader(w, r.Body, app.maxUploadSize+1<<20)
+	err = r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			app.sessionManager.Put(r.Context(), "flash", "The file is too large")
+			http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+			return
+		}
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if header.Size > app.maxUploadSize {
+		app.sessionManager.Put(r.Context(), "flash", "The file is too large")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	contentType, err := sniffContentType(file)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			app.sessionManager.Put(r.Context(), "flash", "The file is empty")
+			http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !app.allowedTypes[mediaType] {
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Files of type %s are not allowed", contentType))
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	checksum, stored, err := app.storeFile(r.Context(), file, header.Size, contentType)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	uploadedBy := int64(app.authenticatedUserID(r))
+	_, err = app.projects.AddAttachment(data.Attachment{
+		TaskID:      &id,
+		UploadedBy:  &uploadedBy,
+		FileName:    cleanFileName(header.Filename),
+		ContentType: contentType,
+		Size:        header.Size,
+		Checksum:    checksum,
+		StorageKey:  checksum,
+	})
+	if err != nil {
+		if stored {
+			app.releaseFiles(r.Context(), []string{checksum})
+		}
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecord):
+			app.sessionManager.Put(r.Context(), "flash", "This file is already attached to the task")
+			http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		case errors.Is(err, data.ErrNoRecord):
+			app.notFound(w)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "File attached successfully!")
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+// cleanFileName keeps the base name of an uploaded file, as some browsers send
+// the full client side path, and truncates it to fit the file_name column.
+func cleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" {
+		name = "file"
+	}
+	for utf8.RuneCountInString(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+func (app *application) getAttachmentDownload(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	attachment, err := app.projects.GetAttachment(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	if attachment.TaskID == nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorizeTask(w, r, *attachment.TaskID, data.ActionView) {
+		return
+	}
+
+	content, err := app.files.Get(r.Context(), attachment.StorageKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName}))
+	_, err = io.Copy(w, content)
+	if err != nil {
+		app.errlog.Println(err)
+	}
+}
+
+func (app *application) postAttachmentDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	attachment, err := app.projects.GetAttachment(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	if attachment.TaskID == nil {
+		app.notFound(w)
+		return
+	}
+	if !app.authorizeTask(w, r, *attachment.TaskID, data.ActionEditTasks) {
+		return
+	}
+
+	attachment, err = app.projects.DeleteAttachment(id, app.authenticatedUserID(r))
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	app.releaseFiles(r.Context(), []string{attachment.StorageKey})
+
+	app.sessionManager.Put(r.Context(), "flash", "File removed successfully!")
+	http.Redirect(w, r, fmt.Sprintf("/tasks/view/%d", app.authenticatedUserID(r)), http.StatusSeeOther)
+}
+
+// adminPageSize is the number of users listed per page of the admin console.
+const adminPageSize = 20
+
+type adminUsersForm struct {
+	Search string `form:"q"`
+	Page   int    `form:"page"`
+}
+
+// pagination describes the current page of a listing and the query string
+// to keep when moving between pages.
+type pagination struct {
+	Page  int
+	Pages int
+	Query string
+}
+
+func (p *pagination) HasPrev() bool { return p.Page > 1 }
+func (p *pagination) HasNext() bool { return p.Page < p.Pages }
+func (p *pagination) Prev() int     { return p.Page - 1 }
+func (p *pagination) Next() int     { return p.Page + 1 }
+
+// getAdminUsers lists the registered users, searchable by name or email.
+func (app *application) getAdminUsers(w http.ResponseWriter, r *http.Request) {
+	var form adminUsersForm
+	err := app.formDecoder.Decode(&form, r.URL.Query())
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	if form.Page < 1 {
+		form.Page = 1
+	}
+
+	users, total, err := app.userData.ListUsers(data.UserFilter{
+		Search:   form.Search,
+		Page:     form.Page,
+		PageSize: adminPageSize,
+	})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	user, err := app.userData.Get(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.User = user
+	data.ListUsers = users
+	data.Form = form
+	data.Pagination = &pagination{
+		Page:  form.Page,
+		Pages: (total + adminPageSize - 1) / adminPageSize,
+		Query: form.Search,
+	}
+	app.render(w, "admin_users.tmpl.html", http.StatusOK, data)
+}
+
+// adminTarget reads the user an admin action applies to. Administrators
+// cannot apply these actions to their own account, so that there is always
+// at least one administrator left able to log in.
+func (app *application) adminTarget(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return nil, false
+	}
+	user, err := app.userData.Get(int(id))
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return nil, false
+	}
+	if user.Id == app.authenticatedUserID(r) {
+		app.sessionManager.Put(r.Context(), "flash", "You cannot change your own account from the admin console")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return nil, false
+	}
+	return user, true
+}
+
+func (app *application) postAdminUserDisable(w http.ResponseWriter, r *http.Request) {
+	app.setUserDisabled(w, r, true)
+}
+
+func (app *application) postAdminUserEnable(w http.ResponseWriter, r *http.Request) {
+	app.setUserDisabled(w, r, false)
+}
+
+func (app *application) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user, ok := app.adminTarget(w, r)
+	if !ok {
+		return
+	}
+	err := app.userData.SetDisabled(user.Id, disabled)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if disabled {
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%s is disabled and logged out", user.Name))
+	} else {
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%s is enabled", user.Name))
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+type adminRoleForm struct {
+	Admin bool `form:"admin"`
+}
+
+// postAdminUserRole grants or revokes the administrator role of a user.
+func (app *application) postAdminUserRole(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTarget(w, r)
+	if !ok {
+		return
+	}
+	var form adminRoleForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.userData.SetAdmin(user.Id, form.Admin)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if form.Admin {
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%s is now an administrator", user.Name))
+	} else {
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%s is no longer an administrator", user.Name))
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// postAdminUserReset emails a password reset link to a user.
+func (app *application) postAdminUserReset(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTarget(w, r)
+	if !ok {
+		return
+	}
+	err := app.sendPasswordReset(r.Context(), user)
+	if errors.Is(err, data.ErrResetPending) {
+		app.sessionManager.Put(r.Context(), "flash",
+			fmt.Sprintf("The reset link sent to %s earlier is still valid", user.Email))
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("A password reset link was sent to %s", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// postAdminUserLogout logs out every session of a user.
+func (app *application) postAdminUserLogout(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTarget(w, r)
+	if !ok {
+		return
+	}
+	err := app.userData.ForceLogout(user.Id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%s is logged out of all sessions", user.Name))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// postAdminUserUnlock lifts the login lockout of a user.
+func (app *application) postAdminUserUnlock(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTarget(w, r)
+	if !ok {
+		return
+	}
+	err := app.userData.UnlockLogin(user.Name)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%s can log in again", user.Name))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+type apiTokenForm struct {
+	Name                string   `form:"name"`
+	Scopes              []string `form:"scopes"`
+	Expiry              int      `form:"expiry"`
+	validator.Validator `form:"-"`
+}
+
+// apiTokenExpiries are the lifetimes in days offered for new API tokens, 0
+// meaning no expiry.
+var apiTokenExpiries = []int{30, 90, 365, 0}
+
+// Expiries returns the lifetimes offered for new API tokens.
+func (f apiTokenForm) Expiries() []int { return apiTokenExpiries }
+
+// AllScopes returns the scopes offered for new API tokens.
+func (f apiTokenForm) AllScopes() []string { return data.APIScopes }
+
+// HasScope reports whether the scope is checked.
+func (f apiTokenForm) HasScope(scope string) bool {
+	for _, s := range f.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *apiTokenForm) validate() {
+	f.CheckField(validator.NotBlank(f.Name), "name", "This field cannot be blank")
+	f.CheckField(validator.MaxChars(f.Name, 100), "name", "This field cannot be more than 100 characters long")
+	f.CheckField(len(f.Scopes) > 0, "scopes", "Choose at least one scope")
+	for _, s := range f.Scopes {
+		f.CheckField(data.ValidScope(s), "scopes", "This scope does not exist")
+	}
+	f.CheckField(validator.PermittedInt(f.Expiry, apiTokenExpiries...), "expiry", "This expiry is not offered")
+}
+
+// renderAPITokens renders the API tokens page of the logged in user. token is
+// a token just created, shown this time only.
+func (app *application) renderAPITokens(w http.ResponseWriter, r *http.Request, status int, form apiTokenForm, token string) {
+	id := app.authenticatedUserID(r)
+	user, err := app.userData.Get(id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	tokens, err := app.userData.ListAPITokens(id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.User = user
+	data.APITokens = tokens
+	data.NewAPIToken = token
+	data.Form = form
+	app.render(w, "api_tokens.tmpl.html", status, data)
+}
+
+func (app *application) getAPITokens(w http.ResponseWriter, r *http.Request) {
+	app.renderAPITokens(w, r, http.StatusOK, apiTokenForm{Scopes: []string{data.ScopeRead}, Expiry: 30}, "")
+}
+
+// postAPIToken creates an API token and shows it once.
+func (app *application) postAPIToken(w http.ResponseWriter, r *http.Request) {
+	var form apiTokenForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Name = strings.TrimSpace(form.Name)
+
+	form.validate()
+	if !form.Valid() {
+		app.renderAPITokens(w, r, http.StatusUnprocessableEntity, form, "")
+		return
+	}
+
+	ttl := time.Duration(form.Expiry) * 24 * time.Hour
+	token, err := app.userData.NewAPIToken(app.authenticatedUserID(r), form.Name, form.Scopes, ttl)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.renderAPITokens(w, r, http.StatusOK, apiTokenForm{Scopes: []string{data.ScopeRead}, Expiry: 30}, token)
+}
+
+func (app *application) postAPITokenRevoke(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	err = app.userData.RevokeAPIToken(app.authenticatedUserID(r), id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "The token is revoked")
+	http.Redirect(w, r, "/user/tokens", http.StatusSeeOther)
+}
+
+// apiMe returns the user an API token belongs to, so that scripts can check
+// their token.
+func (app *application) apiMe(w http.ResponseWriter, r *http.Request) {
+	user, err := app.userData.Get(app.authenticatedUserID(r))
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"user": apiMeUser{User: *user, Email: user.Email}, "token": app.apiToken(r)})
+}
+
+// apiMeUser is the user of the token. Unlike the other users shown by the
+// API, it carries the email address.
+type apiMeUser struct {
+	data.User
+	Email string `json:"email"`
+}
+
+const (
+	// apiPageSize is the number of items of a page of the API listings when
+	// the client does not ask for another size.
+	apiPageSize = 20
+	// apiMaxPageSize is the largest page a client may ask for.
+	apiMaxPageSize = 100
+)
+
+// apiPageForm holds the page and page_size query parameters of the API
+// listings.
+type apiPageForm struct {
+	Page                int `form:"page"`
+	PageSize            int `form:"page_size"`
+	validator.Validator `form:"-"`
+}
+
+// validate checks the pagination parameters, defaulting to the first page of
+// apiPageSize items.
+func (f *apiPageForm) validate() {
+	if f.Page == 0 {
+		f.Page = 1
+	}
+	if f.PageSize == 0 {
+		f.PageSize = apiPageSize
+	}
+	f.CheckField(f.Page > 0, "page", "This field must be a positive integer")
+	f.CheckField(f.PageSize > 0 && f.PageSize <= apiMaxPageSize, "page_size",
+		fmt.Sprintf("This field must be between 1 and %d", apiMaxPageSize))
+}
+
+// apiMetadata describes the page returned by an API listing.
+type apiMetadata struct {
+	Page     int `json:"page"`
+	PageSize int `json:"page_size"`
+	Total    int `json:"total"`
+	Pages    int `json:"pages"`
+}
+
+// metadata returns the metadata of the page given the number of items across
+// all pages.
+func (f apiPageForm) metadata(total int) apiMetadata {
+	return apiMetadata{
+		Page:     f.Page,
+		PageSize: f.PageSize,
+		Total:    total,
+		Pages:    (total + f.PageSize - 1) / f.PageSize,
+	}
+}
+
+// readPage reads the pagination parameters of an API listing. When they are
+// invalid, it answers the request and returns false.
+func (app *application) readPage(w http.ResponseWriter, r *http.Request) (apiPageForm, bool) {
+	var form apiPageForm
+	err := app.decodeQuery(r, &form)
+	if err != nil {
+		app.apiError(w, http.StatusBadRequest, "the query string contains invalid values")
+		return form, false
+	}
+	form.validate()
+	if !form.Valid() {
+		app.apiFieldErrors(w, form.FieldErrors)
+		return form, false
+	}
+	return form, true
+}
+
+// apiNotFoundHandler answers the requests matching no route, in JSON for the
+// API paths.
+func (app *application) apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		app.apiNotFound(w)
+		return
+	}
+	app.notFound(w)
+}
+
+// apiMethodNotAllowedHandler answers the requests using a method a route does
+// not support, in JSON for the API paths. The router sets the Allow header.
+func (app *application) apiMethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		app.apiError(w, http.StatusMethodNotAllowed, fmt.Sprintf("the %s method is not supported for this resource", r.Method))
+		return
+	}
+	app.clientError(w, http.StatusMethodNotAllowed)
+}
+
+// writeProject sends a project with the role of the API user in it.
+func (app *application) writeProject(w http.ResponseWriter, r *http.Request, status int, id int64) {
+	project, err := app.projects.GetProject(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.apiNotFound(w)
+		} else {
+			app.apiServerError(w, err)
+		}
+		return
+	}
+	project.Role, err = app.projects.ProjectRole(id, app.authenticatedUserID(r))
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	app.writeJSON(w, status, envelope{"project": project})
+}
+
+// writeTask sends a task with its assignees, comments, attachments and
+// history.
+func (app *application) writeTask(w http.ResponseWriter, status int, id int64) {
+	task, err := app.projects.GetTask(id)
+	if err != nil {
+		if errors.Is(err, data.ErrNoRecord) {
+			app.apiNotFound(w)
+		} else {
+			app.apiServerError(w, err)
+		}
+		return
+	}
+
+	app.writeJSON(w, status, envelope{"task": task})
+}
+
+// apiProjectSearch holds the search parameter of the project listing.
+type apiProjectSearch struct {
+	Query string `form:"q"`
+}
+
+// apiListProjects lists the projects of the API user, optionally searched by
+// name with the q parameter.
+func (app *application) apiListProjects(w http.ResponseWriter, r *http.Request) {
+	page, ok := app.readPage(w, r)
+	if !ok {
+		return
+	}
+	var search apiProjectSearch
+	err := app.decodeQuery(r, &search)
+	if err != nil {
+		app.apiError(w, http.StatusBadRequest, "the query string contains invalid values")
+		return
+	}
+
+	projects, total, err := app.projects.SearchUserProjects(app.authenticatedUserID(r), search.Query,
+		page.Page, page.PageSize)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"projects": projects, "metadata": page.metadata(total)})
+}
+
+func (app *application) apiCreateProject(w http.ResponseWriter, r *http.Request) {
+	var form projectForm
+	err := app.readJSON(w, r, &form)
+	if err != nil {
+		app.apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	form.validate()
+	if !form.Valid() {
+		app.apiFieldErrors(w, form.FieldErrors)
+		return
+	}
+
+	p := form.project()
+	createdBy := int64(app.authenticatedUserID(r))
+	p.CreatedBy = &createdBy
+
+	id, err := app.projects.InsertProject(p)
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateRecord) {
+			form.AddFiledError("name", "A project with this name already exists")
+			app.apiFieldErrors(w, form.FieldErrors)
+			return
+		}
+		app.apiServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/projects/%d", id))
+	app.writeProject(w, r, http.StatusCreated, id)
+}
+
+func (app *application) apiShowProject(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w)
+		return
+	}
+	if !app.apiCheckAccess(w, app.projects.Authorize(app.authenticatedUserID(r), id, data.ActionView)) {
+		return
+	}
+
+	app.writeProject(w, r, http.StatusOK, id)
+}
+
+// apiUpdateProject changes the fields of a project present in the request
+// body and keeps the others.
+func (app *application) apiUpdateProject(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w)
+		return
+	}
+	if !app.apiCheckAccess(w, app.projects.Authorize(app.authenticatedUserID(r), id, data.ActionEditProject)) {
+		return
+	}
+
+	project, err := app.projects.GetProject(id)
+	if err != nil {
+		app.apiCheckAccess(w, err)
+		return
+	}
+
+	form := newProjectForm(project)
+	err = app.readJSON(w, r, &form)
+	if err != nil {
+		app.apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	form.validate()
+	if !form.Valid() {
+		app.apiFieldErrors(w, form.FieldErrors)
+		return
+	}
+
+	p := form.project()
+	p.ProjectID = id
+	err = app.projects.UpdateProject(p)
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateRecord) {
+			form.AddFiledError("name", "A project with this name already exists")
+			app.apiFieldErrors(w, form.FieldErrors)
+			return
+		}
+		app.apiCheckAccess(w, err)
+		return
+	}
+
+	app.writeProject(w, r, http.StatusOK, id)
+}
+
+func (app *application) apiDeleteProject(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w)
+		return
+	}
+	if !app.apiCheckAccess(w, app.projects.Authorize(app.authenticatedUserID(r), id, data.ActionDeleteProject)) {
+		return
+	}
+
+	keys, err := app.projects.ProjectStorageKeys(id)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+	err = app.projects.DeleteProject(id)
+	if err != nil {
+		app.apiCheckAccess(w, err)
+		return
+	}
+	app.releaseFiles(r.Context(), keys)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiListTasks lists the tasks of a project, narrowed by the status, priority,
+// due_from, due_to and assignee parameters of the dashboard filters.
+func (app *application) apiListTasks(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w)
+		return
+	}
+	if !app.apiCheckAccess(w, app.projects.Authorize(app.authenticatedUserID(r), id, data.ActionView)) {
+		return
+	}
+
+	page, ok := app.readPage(w, r)
+	if !ok {
+		return
+	}
+	var form dashboardFilterForm
+	err = app.decodeQuery(r, &form)
+	if err != nil {
+		app.apiError(w, http.StatusBadRequest, "the query string contains invalid values")
+		return
+	}
+	filter := form.filter()
+	if !form.Valid() {
+		app.apiFieldErrors(w, form.FieldErrors)
+		return
+	}
+
+	tasks, total, err := app.projects.ProjectTasks(id, filter, page.Page, page.PageSize)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"tasks": tasks, "metadata": page.metadata(total)})
+}
+
+func (app *application) apiCreateTask(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w)
+		return
+	}
+	userID := app.authenticatedUserID(r)
+	if !app.apiCheckAccess(w, app.projects.Authorize(userID, id, data.ActionEditTasks)) {
+		return
+	}
+
+	form := taskForm{ProjectID: id}
+	err = app.readJSON(w, r, &form)
+	if err != nil {
+		app.apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	form.validate()
+	form.CheckField(form.ProjectID == id, "project_id", "The task must be created in the project of the URL")
+	if !form.Valid() {
+		app.apiFieldErrors(w, form.FieldErrors)
+		return
+	}
+
+	t := form.task()
+	t.CreatedBy = &data.User{Id: userID}
+	taskID, err := app.projects.InsertTask(t)
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateRecord) {
+			form.AddFiledError("title", "A task with this title already exists")
+			app.apiFieldErrors(w, form.FieldErrors)
+			return
+		}
+		if errors.Is(err, data.ErrNotMember) {
+			form.AddFiledError("assigned_to", "Only members of the project can be assigned")
+			app.apiFieldErrors(w, form.FieldErrors)
+			return
+		}
+		app.apiServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/tasks/%d", taskID))
+	app.writeTask(w, http.StatusCreated, taskID)
+}
+
+func (app *application) apiShowTask(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w)
+		return
+	}
+	if !app.apiCheckAccess(w, app.projects.AuthorizeTask(app.authenticatedUserID(r), id, data.ActionView)) {
+		return
+	}
+
+	app.writeTask(w, http.StatusOK, id)
+}
+
+// apiTaskInput is the body of a task update: the task form, plus the status
+// the task moves to.
+type apiTaskInput struct {
+	taskForm
+	Status string `json:"status"`
+}
+
+// apiUpdateTask changes the fields of a task present in the request body and
+// keeps the others. Moving the task to another project requires the right to
+// edit the tasks of both projects.
+func (app *application) apiUpdateTask(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w)
+		return
+	}
+	userID := app.authenticatedUserID(r)
+	if !app.apiCheckAccess(w, app.projects.AuthorizeTask(userID, id, data.ActionEditTasks)) {
+		return
+	}
+
+	task, err := app.projects.GetTask(id)
+	if err != nil {
+		app.apiCheckAccess(w, err)
+		return
+	}
+	var status string
+	if task.Status != nil {
+		status = *task.Status
+	}
+
+	input := apiTaskInput{taskForm: newTaskForm(task), Status: status}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	input.validate()
+	newStatus := data.NormalizeStatus(input.Status)
+	if newStatus != status {
+		input.CheckField(data.ValidStatus(newStatus), "status", "Unknown status")
+		input.CheckField(!data.ValidStatus(newStatus) || data.CanTransition(status, newStatus), "status",
+			fmt.Sprintf("A task cannot move from %s to %s", status, newStatus))
+	}
+	if !input.Valid() {
+		app.apiFieldErrors(w, input.FieldErrors)
+		return
+	}
+
+	if task.ProjectID == nil || *task.ProjectID != input.ProjectID {
+		if !app.apiCheckAccess(w, app.projects.Authorize(userID, input.ProjectID, data.ActionEditTasks)) {
+			return
+		}
+	}
+
+	t := input.task()
+	t.TaskID = id
+	err = app.projects.UpdateTask(t, userID)
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateRecord) {
+			input.AddFiledError("title", "A task with this title already exists")
+			app.apiFieldErrors(w, input.FieldErrors)
+			return
+		}
+		if errors.Is(err, data.ErrNotMember) {
+			input.AddFiledError("assigned_to", "Only members of the project can be assigned")
+			app.apiFieldErrors(w, input.FieldErrors)
+			return
+		}
+		app.apiCheckAccess(w, err)
+		return
+	}
+
+	if newStatus != status {
+		err = app.projects.UpdateTaskStatus(id, newStatus, userID)
+		var transitionErr *data.TransitionError
+		if errors.As(err, &transitionErr) {
+			// The status changed since the task was read.
+			app.apiError(w, http.StatusConflict,
+				fmt.Sprintf("the task cannot move from %s to %s", transitionErr.From, transitionErr.To))
+			return
+		}
+		if err != nil {
+			app.apiCheckAccess(w, err)
+			return
+		}
+	}
+
+	app.writeTask(w, http.StatusOK, id)
+}
+
+func (app *application) apiDeleteTask(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w)
+		return
+	}
+	if !app.apiCheckAccess(w, app.projects.AuthorizeTask(app.authenticatedUserID(r), id, data.ActionEditProject)) {
+		return
+	}
+
+	keys, err := app.projects.TaskStorageKeys(id)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+	err = app.projects.DeleteTask(id)
+	if err != nil {
+		app.apiCheckAccess(w, err)
+		return
+	}
+	app.releaseFiles(r.Context(), keys)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiListComments lists the comments of a task, oldest first.
+func (app *application) apiListComments(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w)
+		return
+	}
+	if !app.apiCheckAccess(w, app.projects.AuthorizeTask(app.authenticatedUserID(r), id, data.ActionView)) {
+		return
+	}
+
+	page, ok := app.readPage(w, r)
+	if !ok {
+		return
+	}
+
+	comments, total, err := app.projects.TaskComments(id, page.Page, page.PageSize)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"comments": comments, "metadata": page.metadata(total)})
+}
+
+type apiCommentForm struct {
+	Text                string `json:"text"`
+	validator.Validator `json:"-"`
+}
+
+func (app *application) apiCreateComment(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.apiNotFound(w)
+		return
+	}
+	userID := app.authenticatedUserID(r)
+	if !app.apiCheckAccess(w, app.projects.AuthorizeTask(userID, id, data.ActionEditTasks)) {
+		return
+	}
+
+	var form apiCommentForm
+	err = app.readJSON(w, r, &form)
+	if err != nil {
+		app.apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Text), "text", "This field cannot be blank")
+	if !form.Valid() {
+		app.apiFieldErrors(w, form.FieldErrors)
+		return
+	}
+
+	commentID, err := app.projects.AddComment(data.Comment{
+		TaskID:      &id,
+		User:        data.User{Id: userID},
+		CommentText: &form.Text,
+	})
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+	comment, err := app.projects.GetComment(commentID)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, envelope{"comment": comment})
+}
+
+// getOpenAPI serves the OpenAPI document of the JSON API.
+func (app *application) getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, newOpenAPIDocument(app.apiOperations()))
+}
+
+// getAPIDocs serves the page browsing the OpenAPI document.
+func (app *application) getAPIDocs(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	app.render(w, "api_docs.tmpl.html", http.StatusOK, data)
+}
+
+// eventsHeartbeat is the interval of the comments keeping the event streams
+// open through proxies, and of the checks that their session is still valid.
+const eventsHeartbeat = 25 * time.Second
+
+// getEvents streams the changes of the projects the user can see as
+// Server-Sent Events, so that the dashboard refreshes them. The stream ends
+// when the user logs out, or if it falls too far behind; the browser then
+// reconnects and the dashboard reloads everything.
+func (app *application) getEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// The stream outlives the write timeout of the server.
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	userID := app.authenticatedUserID(r)
+	sub := app.hub.Subscribe()
+	defer sub.Cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case change, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if !app.changeVisible(userID, change) {
+				continue
+			}
+			payload, err := json.Marshal(change)
+			if err != nil {
+				app.errlog.Println(err)
+				return
+			}
+			fmt.Fprintf(w, "event: change\ndata: %s\n\n", payload)
+		case <-heartbeat.C:
+			if !app.sessionAlive(r) {
+				return
+			}
+			fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// changeVisible reports whether a change is streamed to a user: the changes
+// of the projects they can view and of their own membership. Deleted projects
+// have no members left to check, only their ID is sent.
+func (app *application) changeVisible(userID int, c data.Change) bool {
+	switch {
+	case c.Kind == data.ChangeResync:
+		return true
+	case c.Kind == data.ChangeMember && c.UserID == userID:
+		return true
+	case c.Kind == data.ChangeProject && c.Op == data.OpDeleted:
+		return true
+	}
+	return app.projects.Authorize(userID, c.ProjectID, data.ActionView) == nil
+}
+
+// The chat sockets are pinged every chatPingInterval, and closed when nothing
+// was received from them for chatReadTimeout.
+const (
+	chatPingInterval = 30 * time.Second
+	chatReadTimeout  = 75 * time.Second
+)
+
+// chatSocketMessage is a message of the chat socket, encoded in JSON. The
+// browser sends the messages of the user, of type "message". The server
+// answers each of them with "typing" while the bot works on it, then with
+// "reply", holding the new lines of the chat and the changes of the projects
+// made meanwhile, or "error".
+type chatSocketMessage struct {
+	Type    string         `json:"type"`
+	Text    string         `json:"text,omitempty"`
+	Lines   []*ChatHistory `json:"lines,omitempty"`
+	Changes []data.Change  `json:"changes,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// getChatSocket opens the chat socket of the dashboard. The messages are
+// handled one at a time, and the chat history is saved in the session the way
+// SendchatMessage does, which remains the fallback when sockets cannot be
+// used. The socket is closed once the session is gone.
+func (app *application) getChatSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		// The handshake was answered.
+		return
+	}
+	defer conn.Close(websocket.CloseGoingAway, "")
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(chatPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if conn.Ping() != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	userID := app.authenticatedUserID(r)
+	for {
+		conn.SetReadDeadline(time.Now().Add(chatReadTimeout))
+		message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg chatSocketMessage
+		if json.Unmarshal(message, &msg) != nil || msg.Type != "message" || strings.TrimSpace(msg.Text) == "" {
+			continue
+		}
+		if !app.sessionAlive(r) {
+			conn.Close(websocket.ClosePolicyViolation, "session expired")
+			return
+		}
+
+		if conn.WriteJSON(chatSocketMessage{Type: "typing"}) != nil {
+			return
+		}
+		reply, err := app.chatSocketReply(r, userID, msg.Text)
+		if err != nil {
+			app.errlog.Println(err)
+			reply = chatSocketMessage{Type: "error", Error: "Your message could not be handled, please try again"}
+		}
+		if conn.WriteJSON(reply) != nil {
+			return
+		}
+	}
+}
+
+// chatSocketReply has the bot answer a message sent through the chat socket,
+// saves the new lines of the chat and collects the changes of the projects
+// the user can see made meanwhile.
+func (app *application) chatSocketReply(r *http.Request, userID int, message string) (chatSocketMessage, error) {
+	sub := app.hub.Subscribe()
+	lines, err := app.chatReply(userID, message)
+	sub.Cancel()
+	if err != nil {
+		return chatSocketMessage{}, err
+	}
+
+	var changes []data.Change
+	for change := range sub.C {
+		if app.changeVisible(userID, change) {
+			changes = append(changes, change)
+		}
+	}
+	if sub.Dropped() {
+		changes = []data.Change{{Kind: data.ChangeResync}}
+	}
+
+	err = app.appendChatHistory(r, lines)
+	if err != nil {
+		return chatSocketMessage{}, err
+	}
+	return chatSocketMessage{Type: "reply", Lines: lines, Changes: changes}, nil
+}
+
+// appendChatHistory adds lines to the chat history saved in the session of a
+// long-lived request. The session is loaded again from the store, since other
+// requests may have changed it after the request started.
+func (app *application) appendChatHistory(r *http.Request, lines []*ChatHistory) error {
+	cookie, err := r.Cookie(app.sessionManager.Cookie.Name)
+	if err != nil {
+		return err
+	}
+	ctx, err := app.sessionManager.Load(context.Background(), cookie.Value)
+	if err != nil {
+		return err
+	}
+	if app.sessionManager.GetInt(ctx, "authenticatedUserID") != app.authenticatedUserID(r) {
+		return errors.New("the session of the chat socket is gone")
+	}
+
+	chatHistories, _ := app.sessionManager.Get(ctx, "chatMessage").([]*ChatHistory)
+	app.sessionManager.Put(ctx, "chatMessage", append(chatHistories, lines...))
+	_, _, err = app.sessionManager.Commit(ctx)
+	return err
 }
@@ -2,13 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/burstman/baseRegistry/cmd/web/internal/data"
 	"github.com/go-playground/form/v4"
+	"github.com/julienschmidt/httprouter"
 )
 
 // decodePostForm decodes the form data from the given HTTP request and stores the
@@ -31,15 +43,344 @@ func (app *application) decodePostForm(r *http.Request, dst any) error {
 }
 
 // newTemplateData creates a new templateData struct with the flash message
-// from the session manager.
+// from the session manager and the CSRF token of the session.
 func (app *application) newTemplateData(r *http.Request) *templateData {
 	return &templateData{
 		Flash:           app.sessionManager.PopString(r.Context(), "flash"),
 		IsAuthenticated: app.isAuthenticated(r),
+		IsAdmin:         app.isAdmin(r),
+		CSRFToken:       app.csrfToken(r),
 	}
 }
+
+// csrfToken returns the CSRF token of the session, generating one the first
+// time it is needed. A token that cannot be generated is left empty, which
+// makes verifyCSRF reject the submitted forms.
+func (app *application) csrfToken(r *http.Request) string {
+	token := app.sessionManager.GetString(r.Context(), "csrfToken")
+	if token != "" {
+		return token
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		app.errlog.Println(err)
+		return ""
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	app.sessionManager.Put(r.Context(), "csrfToken", token)
+	return token
+}
+
+// newWebhookSecret returns a random key signing the payloads of a webhook.
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// isAuthenticated reports whether the request comes from a logged in user who
+// still exists, as checked by the authenticated middleware.
 func (app *application) isAuthenticated(r *http.Request) bool {
-	return app.sessionManager.Exists(r.Context(), "authenticatedUserID")
+	isAuthenticated, ok := r.Context().Value(isAuthenticatedContextKey).(bool)
+	if !ok {
+		return false
+	}
+	return isAuthenticated
+}
+
+// sessionAlive reports whether the session of a long-lived request is still
+// valid, since the user may have logged out or been logged out after it
+// started.
+func (app *application) sessionAlive(r *http.Request) bool {
+	cookie, err := r.Cookie(app.sessionManager.Cookie.Name)
+	if err != nil {
+		return false
+	}
+	_, found, err := app.sessionManager.Store.Find(cookie.Value)
+	if err != nil || !found {
+		return false
+	}
+	version := app.sessionManager.GetInt(r.Context(), "sessionVersion")
+	valid, _, err := app.userData.SessionValid(app.authenticatedUserID(r), version)
+	return err == nil && valid
+}
+
+// isAdmin reports whether the authenticated user is an administrator.
+func (app *application) isAdmin(r *http.Request) bool {
+	isAdmin, ok := r.Context().Value(isAdminContextKey).(bool)
+	return ok && isAdmin
+}
+
+// authenticatedUserID returns the ID of the logged in user, taken from the
+// API token of the request or else from the session, or 0 if there is none.
+func (app *application) authenticatedUserID(r *http.Request) int {
+	if id, ok := r.Context().Value(userIDContextKey).(int); ok {
+		return id
+	}
+	return app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+}
+
+// apiToken returns the API token a request was authenticated with, or nil.
+func (app *application) apiToken(r *http.Request) *data.APIToken {
+	token, _ := r.Context().Value(apiTokenContextKey).(*data.APIToken)
+	return token
+}
+
+// writeJSON sends v encoded as JSON with the given status.
+func (app *application) writeJSON(w http.ResponseWriter, status int, v any) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(js, '\n'))
+}
+
+// envelope wraps the responses of the JSON API, so that every response is an
+// object keyed by what it holds.
+type envelope map[string]any
+
+// apiErrorBody is the body of every error of the JSON API.
+type apiErrorBody struct {
+	Error string `json:"error"`
+	// Fields holds the validation errors keyed by field name.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// apiError sends an error of the JSON API.
+func (app *application) apiError(w http.ResponseWriter, status int, message string) {
+	app.writeJSON(w, status, apiErrorBody{Error: message})
+}
+
+// apiFieldErrors sends the validation errors of a JSON API request.
+func (app *application) apiFieldErrors(w http.ResponseWriter, fields map[string]string) {
+	app.writeJSON(w, http.StatusUnprocessableEntity, apiErrorBody{
+		Error:  "the request contains invalid fields",
+		Fields: fields,
+	})
+}
+
+// apiServerError logs an unexpected error and sends a 500 error of the JSON
+// API, without leaking the details to the client.
+func (app *application) apiServerError(w http.ResponseWriter, err error) {
+	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
+	app.errlog.Println(trace)
+	app.apiError(w, http.StatusInternalServerError, "the server encountered a problem")
+}
+
+// apiNotFound sends a 404 error of the JSON API.
+func (app *application) apiNotFound(w http.ResponseWriter) {
+	app.apiError(w, http.StatusNotFound, "the requested resource could not be found")
+}
+
+// apiCheckAccess is the JSON API counterpart of checkAccess.
+func (app *application) apiCheckAccess(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, data.ErrNoRecord):
+		app.apiNotFound(w)
+	case errors.Is(err, data.ErrForbidden):
+		app.apiError(w, http.StatusForbidden, "you are not allowed to do this")
+	default:
+		app.apiServerError(w, err)
+	}
+	return false
+}
+
+// maxJSONBytes limits the size of the JSON API request bodies.
+const maxJSONBytes = 1 << 20
+
+// readJSON decodes the JSON body of a request into dst. The body must hold a
+// single JSON object without unknown fields. The errors returned are meant to
+// be shown to the client.
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err != nil {
+		var (
+			syntaxError        *json.SyntaxError
+			unmarshalTypeError *json.UnmarshalTypeError
+			invalidUnmarshal   *json.InvalidUnmarshalError
+			maxBytesError      *http.MaxBytesError
+		)
+		switch {
+		case errors.As(err, &syntaxError):
+			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return errors.New("body contains badly-formed JSON")
+		case errors.As(err, &unmarshalTypeError):
+			if unmarshalTypeError.Field != "" {
+				return fmt.Errorf("body contains an incorrect JSON type for field %q", unmarshalTypeError.Field)
+			}
+			return fmt.Errorf("body contains an incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+		case errors.Is(err, io.EOF):
+			return errors.New("body must not be empty")
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			return fmt.Errorf("body contains unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+		case errors.As(err, &maxBytesError):
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+		case errors.As(err, &invalidUnmarshal):
+			panic(err)
+		default:
+			return err
+		}
+	}
+
+	if err = dec.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return errors.New("body must only contain a single JSON value")
+	}
+	return nil
+}
+
+// decodeQuery decodes the query string of a request into dst, the way
+// decodePostForm decodes a form.
+func (app *application) decodeQuery(r *http.Request, dst any) error {
+	err := app.formDecoder.Decode(dst, r.URL.Query())
+	if err != nil {
+		var invalidDecoderError *form.InvalidDecoderError
+		if errors.As(err, &invalidDecoderError) {
+			panic(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// readIDParam reads the ":id" URL parameter of the current request. It returns
+// an error if the parameter is missing or is not a positive integer.
+func (app *application) readIDParam(r *http.Request) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid id parameter")
+	}
+	return id, nil
+}
+
+// releaseFiles deletes from the attachment storage the given keys that are no
+// longer referenced by any attachment. Failures are only logged: an orphan
+// file wastes space but does not break the application.
+func (app *application) releaseFiles(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		inUse, err := app.projects.StorageKeyInUse(key)
+		if err != nil {
+			app.errlog.Println(err)
+			continue
+		}
+		if inUse {
+			continue
+		}
+		if err = app.files.Delete(ctx, key); err != nil {
+			app.errlog.Println(err)
+		}
+	}
+}
+
+// authorize checks that the logged in user may perform action on a project.
+// When they may not, it answers the request and returns false.
+func (app *application) authorize(w http.ResponseWriter, r *http.Request, idProject int64, action data.Action) bool {
+	return app.checkAccess(w, app.projects.Authorize(app.authenticatedUserID(r), idProject, action))
+}
+
+// authorizeTask checks that the logged in user may perform action on the
+// project of a task. When they may not, it answers the request and returns
+// false.
+func (app *application) authorizeTask(w http.ResponseWriter, r *http.Request, idTask int64, action data.Action) bool {
+	return app.checkAccess(w, app.projects.AuthorizeTask(app.authenticatedUserID(r), idTask, action))
+}
+
+// checkAccess turns the result of an authorization check into a response:
+// 404 for unknown records, 403 for forbidden actions and 500 otherwise. It
+// returns true if access is granted.
+func (app *application) checkAccess(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, data.ErrNoRecord):
+		app.notFound(w)
+	case errors.Is(err, data.ErrForbidden):
+		app.clientError(w, http.StatusForbidden)
+	default:
+		app.serverError(w, err)
+	}
+	return false
+}
+
+// sniffContentType detects the content type of an uploaded file from its
+// first bytes rather than trusting the one sent by the browser, and rewinds
+// the file. It returns io.EOF if the file is empty.
+func sniffContentType(file io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// storeFile stores an uploaded file under its SHA-256 checksum, unless an
+// identical file is already stored. It returns the storage key and whether
+// the file was stored by this call, in which case the caller should release
+// it if it fails to reference it.
+func (app *application) storeFile(ctx context.Context, file io.ReadSeeker, size int64, contentType string) (string, bool, error) {
+	hash := sha256.New()
+	_, err := io.Copy(hash, file)
+	if err != nil {
+		return "", false, err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	exists, err := app.files.Exists(ctx, checksum)
+	if err != nil || exists {
+		return checksum, false, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", false, err
+	}
+	err = app.files.Put(ctx, checksum, file, size, contentType)
+	if err != nil {
+		return "", false, err
+	}
+	return checksum, true, nil
+}
+
+// clientIP returns the address of the client, without its port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tooManyAttempts sets the Retry-After header of a refused login and returns
+// the message telling the user how long to wait.
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) string {
+	wait = wait.Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())))
+	return fmt.Sprintf("Too many failed login attempts. Please try again in %s", wait)
+}
+
+// badRequest renders the bad request page, used when a form comes back without
+// a valid CSRF token, typically because the session expired meanwhile.
+func (app *application) badRequest(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	app.render(w, "bad_request.tmpl.html", http.StatusBadRequest, data)
 }
 
 func (app *application) notFound(w http.ResponseWriter) {
@@ -85,7 +426,7 @@ func (app *application) InsertProject(p data.Project) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	fmt.Println("Project inserted with ID:", idProject)
+	app.infolog.Printf("chat: project %d created", idProject)
 	return idProject, nil
 }
 
@@ -95,7 +436,7 @@ func (app *application) InsertTask(t data.Task) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	fmt.Println("Task inserted with ID:", taskID)
+	app.infolog.Printf("chat: task %d created", taskID)
 	return taskID, nil
 }
 
@@ -105,19 +446,9 @@ func (app *application) AddComment(c data.Comment) error {
 	if err != nil {
 		return err
 	}
-	fmt.Println("Comment added")
 	return nil
 }
 
-// AddAttachment adds a new attachment to a task.
-func (app *application) AddAttachment(a data.Attachment) error {
-	_, err := app.projects.AddAttach(a)
-	if err != nil {
-		return err
-	}
-	fmt.Println("Attachment added")
-	return nil
-}
 func (app *application) GetUserID(username string) (int64, error) {
 	id, err := app.projects.GetIDFromUserName(username)
 	return id, err
@@ -132,3 +463,10 @@ func (app *application) GetTaskID(title string) (int64, error) {
 	id, err := app.projects.GetIDFromTaskName(title)
 	return id, err
 }
+
+// GetProjectTaskID returns the ID of the task of a project with the given
+// title, or 0 if there is none.
+func (app *application) GetProjectTaskID(idProject int64, title string) (int64, error) {
+	id, err := app.projects.GetIDFromProjectTaskName(idProject, title)
+	return id, err
+}
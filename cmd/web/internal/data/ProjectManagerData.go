@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,29 +13,44 @@ import (
 
 type ProjectManager struct {
 	DB *sql.DB
+	// Changes, if set, is told about every change of the projects and of
+	// their tasks.
+	Changes Notifier
 }
 
 type Project struct {
-	ProjectID   int64
-	Name        *string
-	Description *string
-	CreatedBy   *int64
-	CreatedAt   *time.Time
-	Deadline    *string
-	Tasks       []Task
+	ProjectID   int64      `json:"id"`
+	Name        *string    `json:"name"`
+	Description *string    `json:"description"`
+	CreatedBy   *int64     `json:"created_by"`
+	CreatedAt   *time.Time `json:"created_at"`
+	Deadline    *string    `json:"deadline"`       // dd/mm/yyyy
+	Role        string     `json:"role,omitempty"` // role of the user the project was loaded for
+	Tasks       []Task     `json:"tasks,omitempty"`
 }
 
 func (pm *ProjectManager) InsertProject(p Project) (int64, error) {
-	stmt := `INSERT INTO projects (name,description, created_by)
-	 VALUES ($1, $2, $3)  RETURNING project_id`
+	stmt := `INSERT INTO projects (name,description, deadline, created_by)
+	 VALUES ($1, $2, $3, $4)  RETURNING project_id`
 	if p.CreatedBy != nil {
+		deadline, err := parseDate(p.Deadline)
+		if err != nil {
+			return 0, err
+		}
 		args := []any{
 			p.Name,
 			p.Description,
+			deadline,
 			*p.CreatedBy,
 		}
 
-		err := pm.DB.QueryRow(stmt, args...).Scan(&p.ProjectID)
+		tx, err := pm.DB.Begin()
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+
+		err = tx.QueryRow(stmt, args...).Scan(&p.ProjectID)
 		if err != nil {
 			if pqErr, ok := err.(*pq.Error); ok {
 				// Unique violation error code
@@ -45,236 +61,746 @@ func (pm *ProjectManager) InsertProject(p Project) (int64, error) {
 			}
 			return 0, err
 		}
+		// The creator owns the project.
+		err = addMember(tx, p.ProjectID, int(*p.CreatedBy), RoleOwner)
+		if err != nil {
+			return 0, err
+		}
+		if err = tx.Commit(); err != nil {
+			return 0, err
+		}
+		pm.notify(Change{Kind: ChangeProject, Op: OpCreated, ProjectID: p.ProjectID, ActorID: int(*p.CreatedBy)})
 		return p.ProjectID, nil
 	}
 	return 0, nil
 }
 
+// GetProject retrieves a single project by its ID. If no project matches the
+// ID, it returns ErrNoRecord.
+func (pm *ProjectManager) GetProject(id int64) (*Project, error) {
+	stmt := `SELECT project_id, name, description, created_at, deadline, created_by
+	FROM projects WHERE project_id = $1`
+
+	var (
+		name, description sql.NullString
+		createdAt         sql.NullTime
+		deadline          sql.NullTime
+		createdBy         sql.NullInt64
+	)
+	p := &Project{}
+	err := pm.DB.QueryRow(stmt, id).Scan(&p.ProjectID, &name, &description, &createdAt, &deadline, &createdBy)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	p.Name = StringPointer(name)
+	p.Description = StringPointer(description)
+	p.CreatedAt = TimePointer(createdAt)
+	p.Deadline = formatDate(deadline)
+	p.CreatedBy = IntPointer(createdBy)
+
+	return p, nil
+}
+
+// ListProjects returns the ID and name of every project ordered by name,
+// without loading their tasks. It is meant to fill selection lists.
+func (pm *ProjectManager) ListProjects() ([]Project, error) {
+	stmt := `SELECT project_id, name FROM projects ORDER BY name`
+
+	rows, err := pm.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := []Project{}
+	for rows.Next() {
+		var p Project
+		var name string
+		err := rows.Scan(&p.ProjectID, &name)
+		if err != nil {
+			return nil, err
+		}
+		p.Name = &name
+		projects = append(projects, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return projects, nil
+}
+
+// UpdateProject overwrites the name, description and deadline of an existing
+// project. The deadline is expected in the dd/mm/yyyy format, an empty or nil
+// deadline clears it. It returns ErrNoRecord if the project does not exist and
+// ErrDuplicateRecord if another project already uses the same name.
+func (pm *ProjectManager) UpdateProject(p Project) error {
+	deadline, err := parseDate(p.Deadline)
+	if err != nil {
+		return err
+	}
+	stmt := `UPDATE projects SET name = $1, description = $2, deadline = $3
+	WHERE project_id = $4`
+
+	result, err := pm.DB.Exec(stmt, p.Name, p.Description, deadline, p.ProjectID)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrDuplicateRecord
+		}
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+	pm.notify(Change{Kind: ChangeProject, Op: OpUpdated, ProjectID: p.ProjectID})
+	return nil
+}
+
+// DeleteProject removes a project together with its tasks. Since the foreign
+// keys of the tasks table and its dependants have no ON DELETE CASCADE, the
+// comments, attachments and history rows of every task are deleted first, all
+// inside a single transaction. It returns ErrNoRecord if the project does not
+// exist.
+func (pm *ProjectManager) DeleteProject(id int64) error {
+	tx, err := pm.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`DELETE FROM comments WHERE task_id IN (SELECT task_id FROM tasks WHERE project_id = $1)`,
+		`DELETE FROM attachments WHERE task_id IN (SELECT task_id FROM tasks WHERE project_id = $1)`,
+		`DELETE FROM task_history WHERE task_id IN (SELECT task_id FROM tasks WHERE project_id = $1)`,
+		`DELETE FROM tasks WHERE project_id = $1`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec(`DELETE FROM projects WHERE project_id = $1`, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	pm.notify(Change{Kind: ChangeProject, Op: OpDeleted, ProjectID: id})
+	return nil
+}
+
 type Task struct {
-	TaskID      int64
-	Title       *string
-	Description *string
-	Status      *string
-	DueDate     *string
-	CreatedBy   *User
-	ProjectID   *int64
-	AssignedTo  []*User
-	CreatedAt   *time.Time
-	Comments    []Comment
+	TaskID      int64          `json:"id"`
+	Title       *string        `json:"title"`
+	Description *string        `json:"description"`
+	Status      *string        `json:"status"`
+	Priority    *int           `json:"priority"`
+	DueDate     *string        `json:"due_date"` // dd/mm/yyyy
+	CreatedBy   *User          `json:"created_by"`
+	ProjectID   *int64         `json:"project_id"`
+	AssignedTo  []*User        `json:"assigned_to"`
+	CreatedAt   *time.Time     `json:"created_at"`
+	Comments    []Comment      `json:"comments,omitempty"`
+	Attachments []Attachment   `json:"attachments,omitempty"`
+	History     []HistoryEntry `json:"history,omitempty"`
 }
 
+// InsertTask adds a new task to a project and returns its ID. Every column of
+// the tasks table can be set from the Task; the due date is expected in the
+// dd/mm/yyyy format and the users of AssignedTo become its assignees. The
+// creation is recorded in the task history. It returns ErrDuplicateRecord if
+// a task with the same title already exists, and ErrNotMember if an assignee
+// is not a member of the project.
 func (pm *ProjectManager) InsertTask(t Task) (int64, error) {
-	fmt.Println("title", *t.Title)
-	stmt := `INSERT INTO tasks (title, project_id,created_by)
-	 VALUES ($1, $2, $3)  RETURNING task_id`
+	stmt := `INSERT INTO tasks (title, description, priority, due_date, project_id, created_by)
+	 VALUES ($1, $2, $3, $4, $5, $6)  RETURNING task_id`
 	if t.CreatedBy != nil {
-		fmt.Println("created by Id", t.CreatedBy.Id)
+		dueDate, err := parseDate(t.DueDate)
+		if err != nil {
+			return 0, err
+		}
 		args := []any{
 			*t.Title,
+			t.Description,
+			t.Priority,
+			dueDate,
 			*t.ProjectID,
 			t.CreatedBy.Id,
 		}
-		err := pm.DB.QueryRow(stmt, args...).Scan(&t.TaskID)
 
+		tx, err := pm.DB.Begin()
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+
+		err = tx.QueryRow(stmt, args...).Scan(&t.TaskID)
+		if err != nil {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+				return 0, ErrDuplicateRecord
+			}
+			return 0, err
+		}
+
+		changes, err := assignUsers(tx, t.TaskID, userIDs(t.AssignedTo), t.CreatedBy.Id)
+		if err != nil {
+			return 0, err
+		}
+		changes = append([]HistoryChange{{Field: "title", New: t.Title}}, changes...)
+		err = recordHistory(tx, t.TaskID, t.CreatedBy.Id, "task created", changes...)
+		if err != nil {
+			return 0, err
+		}
+		err = queueEvent(tx, EventTaskCreated, t.TaskID, t.CreatedBy.Id, changes...)
 		if err != nil {
 			return 0, err
 		}
+		if err = tx.Commit(); err != nil {
+			return 0, err
+		}
+		pm.notify(Change{Kind: ChangeTask, Op: OpCreated, ProjectID: *t.ProjectID, TaskID: t.TaskID,
+			ActorID: t.CreatedBy.Id})
 		return t.TaskID, nil
 	}
 	return 0, nil
 }
 
-type Attachment struct {
-	AttachmentID int64
-	TaskID       *int64
-	UploadedAt   *time.Time
-	UploadedBy   *int64
+// GetTask retrieves a single task by its ID, including its creator,
+// assignees, comments, attachments and history. If no task matches the ID, it
+// returns ErrNoRecord.
+func (pm *ProjectManager) GetTask(id int64) (*Task, error) {
+	tasks, err := pm.queryTasks(taskColumns+` WHERE t.task_id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, ErrNoRecord
+	}
+	err = pm.loadTaskDetails(tasks)
+	if err != nil {
+		return nil, err
+	}
+	return &tasks[0], nil
 }
 
-func (pm *ProjectManager) AddAttach(a Attachment) (int64, error) {
-	stmt := `INSERT INTO attachments (task_id, uploaded_by)
-	 VALUES ($1, $2)  RETURNING attachment_id`
+// UpdateTask overwrites the editable fields of an existing task: title,
+// description, priority, due date, project and assignees. The fields that
+// actually changed are recorded in the task history on behalf of changedBy.
+// It returns ErrNoRecord if the task does not exist, ErrDuplicateRecord if
+// another task already uses the same title and ErrNotMember if a new assignee
+// is not a member of the project.
+func (pm *ProjectManager) UpdateTask(t Task, changedBy int) error {
+	dueDate, err := parseDate(t.DueDate)
+	if err != nil {
+		return err
+	}
+
+	tx, err := pm.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var (
+		oldTitle, oldDescription  sql.NullString
+		oldPriority, oldProjectID sql.NullInt64
+		oldDueDate                sql.NullTime
+	)
+	stmt := `SELECT title, description, priority, due_date, project_id
+	FROM tasks WHERE task_id = $1 FOR UPDATE`
+	err = tx.QueryRow(stmt, t.TaskID).Scan(&oldTitle, &oldDescription, &oldPriority, &oldDueDate,
+		&oldProjectID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+
+	stmt = `UPDATE tasks SET title = $1, description = $2, priority = $3, due_date = $4,
+		project_id = $5
+	WHERE task_id = $6`
 	args := []any{
-		*a.TaskID,
-		*a.UploadedBy,
+		t.Title,
+		t.Description,
+		t.Priority,
+		dueDate,
+		t.ProjectID,
+		t.TaskID,
 	}
-	err := pm.DB.QueryRow(stmt, args...).Scan(&a.AttachmentID)
+	_, err = tx.Exec(stmt, args...)
 	if err != nil {
-		return 0, err
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrDuplicateRecord
+		}
+		return err
+	}
+
+	var changes []HistoryChange
+	if c, ok := change("title", StringPointer(oldTitle), t.Title); ok {
+		changes = append(changes, c)
+	}
+	if c, ok := change("description", StringPointer(oldDescription), t.Description); ok {
+		changes = append(changes, c)
+	}
+	if c, ok := change("priority", formatInt(intPointer(oldPriority)), formatInt(t.Priority)); ok {
+		changes = append(changes, c)
+	}
+	if c, ok := change("due_date", formatDate(oldDueDate), formatDateValue(dueDate)); ok {
+		changes = append(changes, c)
+	}
+	if t.ProjectID != nil && (!oldProjectID.Valid || oldProjectID.Int64 != *t.ProjectID) {
+		c, err := projectChange(tx, oldProjectID, *t.ProjectID)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, c)
+	}
+	assigneeChanges, err := setAssignees(tx, t.TaskID, userIDs(t.AssignedTo), changedBy)
+	if err != nil {
+		return err
+	}
+	changes = append(changes, assigneeChanges...)
+
+	if len(changes) > 0 {
+		err = recordHistory(tx, t.TaskID, changedBy, "task updated", changes...)
+		if err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	if t.ProjectID != nil && (!oldProjectID.Valid || oldProjectID.Int64 != *t.ProjectID) {
+		pm.notifyMove(t.TaskID, oldProjectID, *t.ProjectID, changedBy)
+	} else if oldProjectID.Valid {
+		pm.notify(Change{Kind: ChangeTask, Op: OpUpdated, ProjectID: oldProjectID.Int64, TaskID: t.TaskID,
+			ActorID: changedBy})
 	}
-	return a.AttachmentID, nil
+	return nil
+}
+
+// MoveTask attaches an existing task to another project and records the move
+// in the task history on behalf of changedBy. It returns ErrNoRecord if either
+// the task or the target project does not exist.
+func (pm *ProjectManager) MoveTask(idTask, idProject int64, changedBy int) error {
+	tx, err := pm.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldProjectID sql.NullInt64
+	err = tx.QueryRow(`SELECT project_id FROM tasks WHERE task_id = $1 FOR UPDATE`, idTask).Scan(&oldProjectID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+	if oldProjectID.Valid && oldProjectID.Int64 == idProject {
+		return nil
+	}
+
+	stmt := `UPDATE tasks SET project_id = $1
+	WHERE task_id = $2 AND EXISTS(SELECT 1 FROM projects WHERE project_id = $1)`
+	result, err := tx.Exec(stmt, idProject, idTask)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+
+	c, err := projectChange(tx, oldProjectID, idProject)
+	if err != nil {
+		return err
+	}
+	err = recordHistory(tx, idTask, changedBy, "task moved", c)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	pm.notifyMove(idTask, oldProjectID, idProject, changedBy)
+	return nil
+}
+
+// projectChange describes a task moving between two projects by their names.
+func projectChange(tx *sql.Tx, oldProjectID sql.NullInt64, newProjectID int64) (HistoryChange, error) {
+	var oldID any
+	if oldProjectID.Valid {
+		oldID = oldProjectID.Int64
+	}
+	before, err := lookupName(tx, `SELECT name FROM projects WHERE project_id = $1`, oldID)
+	if err != nil {
+		return HistoryChange{}, err
+	}
+	after, err := lookupName(tx, `SELECT name FROM projects WHERE project_id = $1`, newProjectID)
+	if err != nil {
+		return HistoryChange{}, err
+	}
+	return HistoryChange{Field: "project", Old: before, New: after}, nil
+}
+
+// DeleteTask removes a task together with its comments, attachments and
+// history rows inside a single transaction. It returns ErrNoRecord if the
+// task does not exist.
+func (pm *ProjectManager) DeleteTask(id int64) error {
+	tx, err := pm.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`DELETE FROM comments WHERE task_id = $1`,
+		`DELETE FROM attachments WHERE task_id = $1`,
+		`DELETE FROM task_history WHERE task_id = $1`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return err
+		}
+	}
+
+	var idProject sql.NullInt64
+	err = tx.QueryRow(`DELETE FROM tasks WHERE task_id = $1 RETURNING project_id`, id).Scan(&idProject)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	if idProject.Valid {
+		pm.notify(Change{Kind: ChangeTask, Op: OpDeleted, ProjectID: idProject.Int64, TaskID: id})
+	}
+	return nil
+}
+
+// userIDs returns the IDs of the given users.
+func userIDs(users []*User) []int {
+	ids := make([]int, 0, len(users))
+	for _, u := range users {
+		if u != nil && u.Id != 0 {
+			ids = append(ids, u.Id)
+		}
+	}
+	return ids
 }
 
 type Comment struct {
-	CommentID   int64
-	TaskID      *int64
-	User        User
-	UploadedBy  *int64
-	CommentText *string
-	CreatedAt   *time.Time
+	CommentID   int64      `json:"id"`
+	TaskID      *int64     `json:"task_id"`
+	User        User       `json:"user"`
+	UploadedBy  *int64     `json:"-"`
+	CommentText *string    `json:"text"`
+	CreatedAt   *time.Time `json:"created_at"`
 }
 
+// AddComment adds a comment to a task and records it in the task history, in
+// the same transaction.
 func (pm *ProjectManager) AddComment(c Comment) (int64, error) {
 	stmt := `INSERT INTO comments (task_id, user_id, comment_text, created_at) 
 	VALUES ($1, $2, $3, CURRENT_TIMESTAMP) 
 	RETURNING comment_id`
-	fmt.Println("TEXTComment", *c.CommentText)
 
 	args := []any{
 		*c.TaskID,
 		c.User.Id,
 		*c.CommentText,
 	}
-	err := pm.DB.QueryRow(stmt, args...).Scan(&c.CommentID)
+
+	tx, err := pm.DB.Begin()
 	if err != nil {
 		return 0, err
 	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(stmt, args...).Scan(&c.CommentID)
+	if err != nil {
+		return 0, err
+	}
+
+	commentChange := HistoryChange{Field: "comment", New: c.CommentText}
+	err = recordHistory(tx, *c.TaskID, c.User.Id, "comment added", commentChange)
+	if err != nil {
+		return 0, err
+	}
+	err = queueEvent(tx, EventTaskCommented, *c.TaskID, c.User.Id, commentChange)
+	if err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	pm.notifyTask(ChangeComment, OpCreated, *c.TaskID, c.User.Id)
 	return c.CommentID, nil
 
 }
 
+// GetComment retrieves a single comment by its ID. If no comment matches the
+// ID, it returns ErrNoRecord.
+func (pm *ProjectManager) GetComment(id int64) (*Comment, error) {
+	comments, err := pm.queryComments(commentColumns+` WHERE c.comment_id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(comments) == 0 {
+		return nil, ErrNoRecord
+	}
+	return &comments[0], nil
+}
+
 // GetAllProjects retrieves all projects, tasks, and related data from the database.
-// It returns a slice of pointers to Project structs, which contain the project details
+// It returns a slice of Project structs, which contain the project details
 // and a slice of Task structs for each project.
+//
+// Projects, tasks, assignees, comments, attachments and history are loaded
+// with one query each and grouped in memory by ID, so that every row is read
+// exactly once whatever the number of comments or assignees of a task.
 func (pm *ProjectManager) GetAllProjects() ([]Project, error) {
-	query := `
-		SELECT
-			p.project_id, p.name, p.description, p.created_at, p.deadline, p.created_by, pc.username, pc.email,
-			t.task_id, t.title, t.description, t.status, t.due_date, t.created_at, t.created_by, tc.username, tc.email,
-			tua.user_id AS assigned_user_id, tua.username AS assigned_username, tua.email AS assigned_email,
-			c.comment_id, c.user_id, cu.username, cu.email, c.comment_text, c.created_at
-		FROM
-			projects p
-		LEFT JOIN
-			users pc ON p.created_by = pc.user_id
-		LEFT JOIN
-			tasks t ON p.project_id = t.project_id
-		LEFT JOIN
-			users tc ON t.created_by = tc.user_id
-		LEFT JOIN
-			attachments a ON t.task_id = a.task_id
-		LEFT JOIN
-			users tua ON a.uploaded_by = tua.user_id
-		LEFT JOIN
-			comments c ON t.task_id = c.task_id
-		LEFT JOIN
-			users cu ON c.user_id = cu.user_id
-	`
+	projects, err := pm.queryProjects(`SELECT project_id, name, description, created_at, deadline, created_by
+	FROM projects ORDER BY project_id`)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := pm.queryTasks(taskColumns + ` ORDER BY t.task_id`)
+	if err != nil {
+		return nil, err
+	}
+	return pm.assembleProjects(projects, tasks)
+}
 
-	rows, err := pm.DB.Query(query)
+// taskColumns selects the columns read by queryTasks. Callers append their
+// own WHERE and ORDER BY clauses.
+const taskColumns = `SELECT t.task_id, t.project_id, t.title, t.description, t.status, t.priority,
+		t.due_date, t.created_at, t.created_by, tc.username, tc.email
+	FROM tasks t
+	LEFT JOIN users tc ON t.created_by = tc.user_id`
+
+// queryProjects runs a query selecting the columns of GetProject and returns
+// the projects without their tasks.
+func (pm *ProjectManager) queryProjects(query string, args ...any) ([]Project, error) {
+	rows, err := pm.DB.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var projects []Project
-
+	projects := []Project{}
 	for rows.Next() {
 		var (
-			pID, tID, cID, assignedUserID                        sql.NullInt64
-			pName, pDescription, tTitle, tDescription            sql.NullString
-			cText, tStatus                                       sql.NullString
-			pCreatedAt, tCreatedAt, cCreatedAt                   sql.NullTime
-			pCreatedBy, tCreatedBy, cUserID                      sql.NullInt64
-			pcUsername, tcUsername, assignedUsername, cuUsername sql.NullString
-			pcEmail, tcEmail, assignedEmail, cuEmail             sql.NullString
-			tDueDate, pDeadline                                  sql.NullTime
+			name, description   sql.NullString
+			createdAt, deadline sql.NullTime
+			createdBy           sql.NullInt64
 		)
+		p := Project{Tasks: []Task{}}
+		err := rows.Scan(&p.ProjectID, &name, &description, &createdAt, &deadline, &createdBy)
+		if err != nil {
+			return nil, err
+		}
+		p.Name = StringPointer(name)
+		p.Description = StringPointer(description)
+		p.CreatedAt = TimePointer(createdAt)
+		p.Deadline = formatDate(deadline)
+		p.CreatedBy = IntPointer(createdBy)
+		projects = append(projects, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return projects, nil
+}
+
+// queryTasks runs a query built on taskColumns and returns the tasks without
+// their assignees, comments, attachments or history.
+func (pm *ProjectManager) queryTasks(query string, args ...any) ([]Task, error) {
+	rows, err := pm.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		err := rows.Scan(
-			&pID, &pName, &pDescription, &pCreatedAt, &pDeadline, &pCreatedBy, &pcUsername, &pcEmail,
-			&tID, &tTitle, &tDescription, &tStatus, &tDueDate, &tCreatedAt, &tCreatedBy, &tcUsername, &tcEmail,
-			&assignedUserID, &assignedUsername, &assignedEmail,
-			&cID, &cUserID, &cuUsername, &cuEmail, &cText, &cCreatedAt,
+	tasks := []Task{}
+	for rows.Next() {
+		var (
+			projectID, priority, createdBy sql.NullInt64
+			title, description, status     sql.NullString
+			dueDate, createdAt             sql.NullTime
+			tcUsername, tcEmail            sql.NullString
 		)
+		t := Task{AssignedTo: []*User{}, Comments: []Comment{}}
+		err := rows.Scan(&t.TaskID, &projectID, &title, &description, &status, &priority,
+			&dueDate, &createdAt, &createdBy, &tcUsername, &tcEmail)
 		if err != nil {
 			return nil, err
 		}
-
-		// Find or create the project
-		var project *Project
-		for i := range projects {
-			if projects[i].ProjectID == pID.Int64 {
-				project = &projects[i]
-				break
-			}
+		t.ProjectID = IntPointer(projectID)
+		t.Title = StringPointer(title)
+		t.Description = StringPointer(description)
+		t.Status = StringPointer(status)
+		t.Priority = intPointer(priority)
+		t.DueDate = formatDate(dueDate)
+		t.CreatedAt = TimePointer(createdAt)
+		t.CreatedBy = &User{
+			Id:    int(createdBy.Int64),
+			Name:  tcUsername.String,
+			Email: tcEmail.String,
 		}
-		if project == nil {
-			project = &Project{
-				ProjectID:   pID.Int64,
-				Name:        StringPointer(pName),
-				Description: StringPointer(pDescription),
-				CreatedAt:   TimePointer(pCreatedAt),
-				CreatedBy:   IntPointer(pCreatedBy),
-				Deadline:    formatDate(pDeadline),
+		tasks = append(tasks, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
 
-				Tasks: []Task{},
-			}
-			projects = append(projects, *project)
-			project = &projects[len(projects)-1]
+// assembleProjects loads the details of the tasks and files each task under
+// its project, keeping the order of both slices. Tasks whose project is not in
+// the list are dropped.
+func (pm *ProjectManager) assembleProjects(projects []Project, tasks []Task) ([]Project, error) {
+	err := pm.loadTaskDetails(tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[int64]int, len(projects))
+	for i := range projects {
+		index[projects[i].ProjectID] = i
+	}
+	for _, t := range tasks {
+		if t.ProjectID == nil {
+			continue
 		}
+		if i, ok := index[*t.ProjectID]; ok {
+			projects[i].Tasks = append(projects[i].Tasks, t)
+		}
+	}
+	return projects, nil
+}
 
-		// Find or create the task
-		var task *Task
-		for i := range project.Tasks {
-			if project.Tasks[i].TaskID == tID.Int64 {
-				task = &project.Tasks[i]
-				break
-			}
+// loadTaskDetails fills the assignees, comments, attachments and history of
+// the given tasks with one query per kind.
+func (pm *ProjectManager) loadTaskDetails(tasks []Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	taskIDs := make([]int64, len(tasks))
+	for i, t := range tasks {
+		taskIDs[i] = t.TaskID
+	}
+
+	assignees, err := pm.getAssignees(taskIDs)
+	if err != nil {
+		return err
+	}
+	comments, err := pm.getComments(taskIDs)
+	if err != nil {
+		return err
+	}
+	attachments, err := pm.getAttachments(taskIDs)
+	if err != nil {
+		return err
+	}
+	history, err := pm.getHistory(taskIDs)
+	if err != nil {
+		return err
+	}
+
+	for i := range tasks {
+		id := tasks[i].TaskID
+		if users, ok := assignees[id]; ok {
+			tasks[i].AssignedTo = users
 		}
-		if task == nil {
-			task = &Task{
-				TaskID:      tID.Int64,
-				ProjectID:   &pID.Int64,
-				Title:       StringPointer(tTitle),
-				Description: StringPointer(tDescription),
-				Status:      StringPointer(tStatus),
-				DueDate:     formatDate(tDueDate),
-				CreatedAt:   TimePointer(tCreatedAt),
-				CreatedBy: &User{
-					Id:    int(tCreatedBy.Int64),
-					Name:  tcUsername.String,
-					Email: tcEmail.String,
-				},
-				AssignedTo: []*User{},
-				Comments:   []Comment{},
-			}
-			project.Tasks = append(project.Tasks, *task)
-			task = &project.Tasks[len(project.Tasks)-1]
+		if c, ok := comments[id]; ok {
+			tasks[i].Comments = c
 		}
+		tasks[i].Attachments = attachments[id]
+		tasks[i].History = history[id]
+	}
+	return nil
+}
 
-		// Collect assignees for the task
-		if assignedUserID.Valid {
-			assignedUser := &User{
-				Id:    int(assignedUserID.Int64),
-				Name:  assignedUsername.String,
-				Email: assignedEmail.String,
-			}
-			task.AssignedTo = append(task.AssignedTo, assignedUser)
-		}
-
-		// Add comments to the task
-		if cID.Valid {
-			comment := Comment{
-				CommentID: cID.Int64,
-				User: User{
-					Id:    int(cUserID.Int64),
-					Name:  cuUsername.String,
-					Email: cuEmail.String,
-				},
-				CommentText: StringPointer(cText),
-				CreatedAt:   TimePointer(cCreatedAt),
-			}
+// getComments loads the comments of several tasks in one query and groups
+// them by task ID, oldest first.
+func (pm *ProjectManager) getComments(taskIDs []int64) (map[int64][]Comment, error) {
+	list, err := pm.queryComments(commentColumns+` WHERE c.task_id = ANY($1)
+	ORDER BY c.created_at, c.comment_id`, pq.Array(taskIDs))
+	if err != nil {
+		return nil, err
+	}
+	comments := map[int64][]Comment{}
+	for _, c := range list {
+		comments[*c.TaskID] = append(comments[*c.TaskID], c)
+	}
+	return comments, nil
+}
+
+// commentColumns selects the columns read by queryComments.
+const commentColumns = `SELECT c.comment_id, c.task_id, c.user_id, u.username, u.email, c.comment_text, c.created_at
+	FROM comments c
+	LEFT JOIN users u ON c.user_id = u.user_id`
 
-			task.Comments = append(task.Comments, comment)
+// queryComments runs a query selecting commentColumns and returns the
+// comments in the order of the query.
+func (pm *ProjectManager) queryComments(query string, args ...any) ([]Comment, error) {
+	rows, err := pm.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-			// Debug print to verify comment text
-			//fmt.Printf("TaskID: %d, Comment added: %+v\n", task.TaskID, comment)
+	comments := []Comment{}
+	for rows.Next() {
+		var (
+			c               Comment
+			taskID          int64
+			userID          sql.NullInt64
+			username, email sql.NullString
+			text            sql.NullString
+			createdAt       sql.NullTime
+		)
+		err := rows.Scan(&c.CommentID, &taskID, &userID, &username, &email, &text, &createdAt)
+		if err != nil {
+			return nil, err
 		}
+		c.TaskID = &taskID
+		c.User = User{Id: int(userID.Int64), Name: username.String, Email: email.String}
+		c.CommentText = StringPointer(text)
+		c.CreatedAt = TimePointer(createdAt)
+		comments = append(comments, c)
 	}
-	// Final debug print
-	//fmt.Printf("Projects after processing: %+v\n", projects)
-	return projects, nil
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return comments, nil
 }
 
 func formatDate(t sql.NullTime) *string {
@@ -285,6 +811,38 @@ func formatDate(t sql.NullTime) *string {
 	return nil
 }
 
+// formatDateValue formats a value returned by parseDate like formatDate does.
+func formatDateValue(v any) *string {
+	date, ok := v.(time.Time)
+	if !ok {
+		return nil
+	}
+	formatted := date.Format("02/01/2006")
+	return &formatted
+}
+
+// formatInt converts an optional int to its decimal representation.
+func formatInt(n *int) *string {
+	if n == nil {
+		return nil
+	}
+	formatted := strconv.Itoa(*n)
+	return &formatted
+}
+
+// parseDate converts an optional dd/mm/yyyy string into a value suitable for a
+// DATE column. A nil or blank string is stored as NULL.
+func parseDate(s *string) (any, error) {
+	if s == nil || strings.TrimSpace(*s) == "" {
+		return nil, nil
+	}
+	date, err := time.Parse("02/01/2006", strings.TrimSpace(*s))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing date: %v", err)
+	}
+	return date, nil
+}
+
 // StringPointer converts sql.NullString to *string
 func StringPointer(s sql.NullString) *string {
 	if s.Valid {
@@ -301,6 +859,15 @@ func IntPointer(n sql.NullInt64) *int64 {
 	return nil
 }
 
+// intPointer converts sql.NullInt64 to *int
+func intPointer(n sql.NullInt64) *int {
+	if n.Valid {
+		i := int(n.Int64)
+		return &i
+	}
+	return nil
+}
+
 // TimePointer converts sql.NullTime to *time.Time
 func TimePointer(t sql.NullTime) *time.Time {
 	if t.Valid {
@@ -317,6 +884,8 @@ func BoolPointer(b sql.NullBool) *bool {
 	return nil
 }
 
+// GetIDFromUserName returns the ID of the user with the given name, compared
+// without case. It returns ErrNoRecord if there is no such user.
 func (pm *ProjectManager) GetIDFromUserName(name string) (int64, error) {
 	query := `SELECT user_id, LOWER(username) FROM users`
 	rows, err := pm.DB.Query(query)
@@ -342,34 +911,61 @@ func (pm *ProjectManager) GetIDFromUserName(name string) (int64, error) {
 		return 0, err
 	}
 
-	return 0, errors.New("user not found")
+	return 0, ErrNoRecord
 }
 
 func (pm *ProjectManager) UpdateProjectDescription(idProject int64, text string) error {
-	fmt.Printf("Updating project description: %d  %s\n", idProject, text)
 	query := "UPDATE projects SET description = $1 WHERE project_id = $2"
 	result, err := pm.DB.Exec(query, text, idProject)
 	if err != nil {
 		return fmt.Errorf("failed to update project description: %w", err)
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		fmt.Println("row affacted:", rowsAffected)
-	}
+	_, err = result.RowsAffected()
 	if err != nil {
 		return fmt.Errorf("could not retrieve affected rows count: %v", err)
 	}
+	pm.notify(Change{Kind: ChangeProject, Op: OpUpdated, ProjectID: idProject})
 
 	return nil
 }
 
-func (pm *ProjectManager) UpdateTaskDescription(idTask, idProject int64, text string) error {
-	query := "UPDATE tasks SET description = $1 WHERE task_id = $2 AND project_id = $3"
-	_, err := pm.DB.Exec(query, text, idTask, idProject)
+// UpdateTaskDescription changes the description of a task belonging to the
+// given project and records the change in the task history on behalf of
+// changedBy. It returns ErrNoRecord if the task is not part of the project.
+func (pm *ProjectManager) UpdateTaskDescription(idTask, idProject int64, text string, changedBy int) error {
+	tx, err := pm.DB.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to update project description: %w", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var old sql.NullString
+	query := "SELECT description FROM tasks WHERE task_id = $1 AND project_id = $2 FOR UPDATE"
+	err = tx.QueryRow(query, idTask, idProject).Scan(&old)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+
+	query = "UPDATE tasks SET description = $1 WHERE task_id = $2"
+	_, err = tx.Exec(query, text, idTask)
+	if err != nil {
+		return fmt.Errorf("failed to update task description: %w", err)
+	}
+
+	if c, ok := change("description", StringPointer(old), &text); ok {
+		err = recordHistory(tx, idTask, changedBy, "description updated", c)
+		if err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
 	}
+	pm.notify(Change{Kind: ChangeTask, Op: OpUpdated, ProjectID: idProject, TaskID: idTask, ActorID: changedBy})
 	return nil
 }
 
@@ -384,20 +980,51 @@ func (pm *ProjectManager) UpdateprojectDeadline(idProject int64, date string) er
 	if err != nil {
 		return fmt.Errorf("failed to update project description: %w", err)
 	}
+	pm.notify(Change{Kind: ChangeProject, Op: OpUpdated, ProjectID: idProject})
 	return nil
 }
 
-func (pm *ProjectManager) UpdateTaskDeadline(idTask, idProject int64, date string) error {
+// UpdateTaskDeadline changes the due date of a task belonging to the given
+// project and records the change in the task history on behalf of changedBy.
+// It returns ErrNoRecord if the task is not part of the project.
+func (pm *ProjectManager) UpdateTaskDeadline(idTask, idProject int64, date string, changedBy int) error {
 	dueDate, err := time.Parse("02/01/2006", date)
 	if err != nil {
 		return fmt.Errorf("error parsing date: %v", err)
 	}
 
-	query := "UPDATE tasks SET due_date = $1 WHERE task_id = $2 AND project_id = $3"
-	_, err = pm.DB.Exec(query, dueDate, idTask, idProject)
+	tx, err := pm.DB.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to update project description: %w", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var old sql.NullTime
+	query := "SELECT due_date FROM tasks WHERE task_id = $1 AND project_id = $2 FOR UPDATE"
+	err = tx.QueryRow(query, idTask, idProject).Scan(&old)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+
+	query = "UPDATE tasks SET due_date = $1 WHERE task_id = $2"
+	_, err = tx.Exec(query, dueDate, idTask)
+	if err != nil {
+		return fmt.Errorf("failed to update task deadline: %w", err)
 	}
+
+	if c, ok := change("due_date", formatDate(old), formatDateValue(dueDate)); ok {
+		err = recordHistory(tx, idTask, changedBy, "deadline updated", c)
+		if err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	pm.notify(Change{Kind: ChangeTask, Op: OpUpdated, ProjectID: idProject, TaskID: idTask, ActorID: changedBy})
 	return nil
 }
 
@@ -466,3 +1093,16 @@ func (pm *ProjectManager) GetIDFromTaskName(name string) (int64, error) {
 
 	return 0, nil
 }
+
+// GetIDFromProjectTaskName returns the ID of the task of a project with the
+// given title, compared without case, or 0 if the project has no such task.
+func (pm *ProjectManager) GetIDFromProjectTaskName(idProject int64, name string) (int64, error) {
+	stmt := `SELECT task_id FROM tasks WHERE project_id = $1 AND LOWER(title) = LOWER($2)`
+
+	var id int64
+	err := pm.DB.QueryRow(stmt, idProject, name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
@@ -0,0 +1,156 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Scopes an API token can be granted.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// APIScopes lists the scopes in the order they are offered to users.
+var APIScopes = []string{ScopeRead, ScopeWrite}
+
+// apiTokenPrefix starts every API token, so that a leaked token is easy to
+// recognize.
+const apiTokenPrefix = "tm_"
+
+type APIToken struct {
+	ID         int64      `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// Expired reports whether the token can no longer be used, only filled
+	// by ListAPITokens.
+	Expired bool `json:"-"`
+}
+
+// HasScope reports whether the token was granted a scope.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidScope reports whether scope is a known API scope.
+func ValidScope(scope string) bool {
+	for _, s := range APIScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NewAPIToken creates a named token for a user with the given scopes, valid
+// for ttl or without expiry if ttl is 0. Only the hash of the token is
+// stored; the token itself is returned to be shown to the user once.
+func (r *UserDB) NewAPIToken(userID int, name string, scopes []string, ttl time.Duration) (string, error) {
+	for _, s := range scopes {
+		if !ValidScope(s) {
+			return "", ErrInvalidScope
+		}
+	}
+	token, _, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	token = apiTokenPrefix + token
+
+	var expires *int
+	if ttl > 0 {
+		seconds := int(ttl.Seconds())
+		expires = &seconds
+	}
+	stmt := `INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at)
+	VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + $5 * INTERVAL '1 second')`
+	_, err = r.DB.Exec(stmt, userID, name, hashToken(token), pq.Array(scopes), expires)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ListAPITokens returns the tokens of a user, newest first.
+func (r *UserDB) ListAPITokens(userID int) ([]APIToken, error) {
+	stmt := `SELECT token_id, user_id, name, scopes, expires_at, last_used_at, created_at,
+	COALESCE(expires_at <= CURRENT_TIMESTAMP, FALSE)
+	FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC, token_id DESC`
+	rows, err := r.DB.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		var t APIToken
+		var expiresAt, lastUsedAt sql.NullTime
+		err := rows.Scan(&t.ID, &t.UserID, &t.Name, pq.Array(&t.Scopes), &expiresAt, &lastUsedAt, &t.CreatedAt,
+			&t.Expired)
+		if err != nil {
+			return nil, err
+		}
+		t.ExpiresAt = TimePointer(expiresAt)
+		t.LastUsedAt = TimePointer(lastUsedAt)
+		tokens = append(tokens, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RevokeAPIToken deletes a token of a user. It returns ErrNoRecord if the
+// user has no such token.
+func (r *UserDB) RevokeAPIToken(userID int, id int64) error {
+	return r.updateUser(`DELETE FROM api_tokens WHERE token_id = $1 AND user_id = $2`, id, userID)
+}
+
+// AuthenticateAPIToken returns the token matching a bearer token and records
+// its use. It returns ErrInvalidToken if the token is unknown or expired, or
+// if its owner is disabled.
+func (r *UserDB) AuthenticateAPIToken(token string) (*APIToken, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, ErrInvalidToken
+	}
+
+	t := &APIToken{}
+	var expiresAt, lastUsedAt sql.NullTime
+	stmt := `SELECT t.token_id, t.user_id, t.name, t.scopes, t.expires_at, t.last_used_at, t.created_at
+	FROM api_tokens t JOIN users u ON u.user_id = t.user_id
+	WHERE t.token_hash = $1 AND (t.expires_at IS NULL OR t.expires_at > CURRENT_TIMESTAMP) AND NOT u.disabled`
+	err := r.DB.QueryRow(stmt, hashToken(token)).Scan(&t.ID, &t.UserID, &t.Name, pq.Array(&t.Scopes),
+		&expiresAt, &lastUsedAt, &t.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	t.ExpiresAt = TimePointer(expiresAt)
+	t.LastUsedAt = TimePointer(lastUsedAt)
+
+	// Scripts can call the API in bursts, only write the last use once a
+	// minute.
+	stmt = `UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP
+	WHERE token_id = $1 AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute')`
+	_, err = r.DB.Exec(stmt, t.ID)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
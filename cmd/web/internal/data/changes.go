@@ -0,0 +1,71 @@
+package data
+
+import "database/sql"
+
+// The kinds of Change.
+const (
+	ChangeProject = "project"
+	ChangeTask    = "task"
+	ChangeComment = "comment"
+	ChangeMember  = "member"
+	// ChangeResync tells that changes may have been missed, such as while
+	// the connection to the database was lost.
+	ChangeResync = "resync"
+)
+
+// The operations of Change.
+const (
+	OpCreated = "created"
+	OpUpdated = "updated"
+	OpDeleted = "deleted"
+)
+
+// Change describes a committed change of a project or of its tasks, members
+// or comments. The dashboards showing the project are told about it so that
+// they refresh.
+type Change struct {
+	Kind      string `json:"kind"`
+	Op        string `json:"op"`
+	ProjectID int64  `json:"project_id,omitempty"`
+	TaskID    int64  `json:"task_id,omitempty"`
+	// UserID is the user added to or removed from the project by a member
+	// change.
+	UserID  int `json:"user_id,omitempty"`
+	ActorID int `json:"actor_id,omitempty"`
+}
+
+// Notifier is told about the changes made through a ProjectManager.
+type Notifier interface {
+	Notify(Change)
+}
+
+// notify tells the notifier of the manager, if any, about a change. It is
+// called once the change is committed.
+func (pm *ProjectManager) notify(c Change) {
+	if pm.Changes != nil {
+		pm.Changes.Notify(c)
+	}
+}
+
+// notifyTask tells about a change of a task, looking up its project. Nothing
+// is told about tasks outside of any project.
+func (pm *ProjectManager) notifyTask(kind, op string, idTask int64, actor int) {
+	if pm.Changes == nil {
+		return
+	}
+	var idProject sql.NullInt64
+	err := pm.DB.QueryRow(`SELECT project_id FROM tasks WHERE task_id = $1`, idTask).Scan(&idProject)
+	if err != nil || !idProject.Valid {
+		return
+	}
+	pm.Changes.Notify(Change{Kind: kind, Op: op, ProjectID: idProject.Int64, TaskID: idTask, ActorID: actor})
+}
+
+// notifyMove tells about a task moving to another project: it is deleted from
+// the project it was part of and created in the other one.
+func (pm *ProjectManager) notifyMove(idTask int64, from sql.NullInt64, to int64, actor int) {
+	if from.Valid {
+		pm.notify(Change{Kind: ChangeTask, Op: OpDeleted, ProjectID: from.Int64, TaskID: idTask, ActorID: actor})
+	}
+	pm.notify(Change{Kind: ChangeTask, Op: OpCreated, ProjectID: to, TaskID: idTask, ActorID: actor})
+}
@@ -14,6 +14,7 @@ type ChatOrder struct {
 	Projects    []string `json:"projects"`
 	Deadline    []string `json:"deadline"`
 	Description []string `json:"description"`
+	Status      []string `json:"status"`
 }
 type Record struct {
 	ID   int
@@ -1,11 +1,37 @@
 package data
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
-	ErrNoRecord        = errors.New("data: no matching data found")
-	ErrDuplicateRecord = errors.New("data: duplicate data found")
-	ErrDuplicateEmail  = errors.New("data: duplicate email found")
-	ErrDuplicateName   = errors.New("data: duplicate name found")
+	ErrNoRecord           = errors.New("data: no matching data found")
+	ErrDuplicateRecord    = errors.New("data: duplicate data found")
+	ErrDuplicateEmail     = errors.New("data: duplicate email found")
+	ErrDuplicateName      = errors.New("data: duplicate name found")
 	ErrInvalidCredentials = errors.New("data: invalid credentials")
+	ErrInvalidStatus      = errors.New("data: invalid task status")
+	ErrInvalidRole        = errors.New("data: invalid project role")
+	ErrForbidden          = errors.New("data: action not allowed")
+	ErrLastOwner          = errors.New("data: a project needs at least one owner")
+	ErrInvalidToken       = errors.New("data: invalid or expired token")
+	ErrNotActivated       = errors.New("data: account not activated")
+	ErrNoSecretKey        = errors.New("data: no secret key configured")
+	ErrDisabled           = errors.New("data: account disabled")
+	ErrInvalidScope       = errors.New("data: invalid API token scope")
+	ErrInvalidEvent       = errors.New("data: invalid webhook event")
+	ErrNotMember          = errors.New("data: user is not a member of the project")
+	ErrResetPending       = errors.New("data: a password reset is already pending")
 )
+
+// TransitionError is returned when the task workflow does not allow a task to
+// move from its current status to the requested one.
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("data: a task cannot move from %q to %q", e.From, e.To)
+}
@@ -0,0 +1,181 @@
+package data
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Events written to the login audit.
+const (
+	LoginFailed        = "login_failed"
+	SecondFactorFailed = "second_factor_failed"
+	LoginLocked        = "locked"
+	LoginUnlocked      = "unlocked"
+)
+
+const (
+	throttleUser = "user"
+	throttleIP   = "ip"
+)
+
+// loginThrottle is how many failures are allowed for a subject before it is
+// locked, each further failure doubling the lockout.
+type loginThrottle struct {
+	scope   string
+	allowed int
+}
+
+var (
+	userThrottle = loginThrottle{scope: throttleUser, allowed: 5}
+	// An IP can be shared by many users, so it gets more attempts.
+	ipThrottle = loginThrottle{scope: throttleIP, allowed: 20}
+)
+
+const (
+	// lockoutBase is the lockout after the first failure over the allowance.
+	lockoutBase = 30 * time.Second
+	// lockoutMax caps the exponential lockout.
+	lockoutMax = time.Hour
+	// failureWindow is how long a failure counts: the counter of a subject
+	// without failures for that long starts over.
+	failureWindow = 24 * time.Hour
+)
+
+// lockout returns how long a subject is locked after its nth failure.
+func (t loginThrottle) lockout(failures int) time.Duration {
+	over := failures - t.allowed
+	if over <= 0 {
+		return 0
+	}
+	if over > 7 {
+		return lockoutMax
+	}
+	d := lockoutBase << (over - 1)
+	if d > lockoutMax {
+		return lockoutMax
+	}
+	return d
+}
+
+// LoginLockedFor returns how long logins are still refused for the username
+// or the IP, or 0 if they are not locked.
+func (r *UserDB) LoginLockedFor(username, ip string) (time.Duration, error) {
+	var seconds float64
+	stmt := `SELECT COALESCE(MAX(EXTRACT(EPOCH FROM locked_until - CURRENT_TIMESTAMP)), 0)
+	FROM login_throttles
+	WHERE ((scope = $1 AND subject = $2) OR (scope = $3 AND subject = $4))
+	AND locked_until > CURRENT_TIMESTAMP`
+	err := r.DB.QueryRow(stmt, throttleUser, throttleSubject(username), throttleIP, ip).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// RecordLoginFailure counts a failed attempt against the username and the IP,
+// locks them once they exceed their allowance and writes the event to the
+// login audit. It returns how long logins are now refused, if at all.
+func (r *UserDB) RecordLoginFailure(username, ip, event string) (time.Duration, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var locked time.Duration
+	for _, t := range []struct {
+		throttle loginThrottle
+		subject  string
+	}{{userThrottle, throttleSubject(username)}, {ipThrottle, ip}} {
+		d, err := t.throttle.record(tx, t.subject)
+		if err != nil {
+			return 0, err
+		}
+		if d > locked {
+			locked = d
+		}
+	}
+
+	err = audit(tx, username, ip, event)
+	if err != nil {
+		return 0, err
+	}
+	if locked > 0 {
+		err = audit(tx, username, ip, LoginLocked)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return locked, tx.Commit()
+}
+
+// record increments the failures of a subject and locks it if needed.
+func (t loginThrottle) record(tx *sql.Tx, subject string) (time.Duration, error) {
+	var failures int
+	stmt := `INSERT INTO login_throttles (scope, subject, failures, last_failure_at)
+	VALUES ($1, $2, 1, CURRENT_TIMESTAMP)
+	ON CONFLICT (scope, subject) DO UPDATE SET
+		failures = CASE
+			WHEN login_throttles.last_failure_at < CURRENT_TIMESTAMP - $3 * INTERVAL '1 second' THEN 1
+			ELSE login_throttles.failures + 1
+		END,
+		last_failure_at = CURRENT_TIMESTAMP
+	RETURNING failures`
+	err := tx.QueryRow(stmt, t.scope, subject, int(failureWindow.Seconds())).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+
+	d := t.lockout(failures)
+	if d == 0 {
+		return 0, nil
+	}
+	stmt = `UPDATE login_throttles SET locked_until = CURRENT_TIMESTAMP + $3 * INTERVAL '1 second'
+	WHERE scope = $1 AND subject = $2`
+	_, err = tx.Exec(stmt, t.scope, subject, int(d.Seconds()))
+	return d, err
+}
+
+// ResetLoginFailures clears the failures of a username after a successful
+// login. The counter of the IP is left alone, so that an attacker cannot
+// reset it by logging in to their own account.
+func (r *UserDB) ResetLoginFailures(username string) error {
+	stmt := `DELETE FROM login_throttles WHERE scope = $1 AND subject = $2`
+	_, err := r.DB.Exec(stmt, throttleUser, throttleSubject(username))
+	return err
+}
+
+// UnlockLogin lifts the lockout of a username and clears its failures on
+// behalf of an administrator.
+func (r *UserDB) UnlockLogin(username string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `DELETE FROM login_throttles WHERE scope = $1 AND subject = $2`
+	_, err = tx.Exec(stmt, throttleUser, throttleSubject(username))
+	if err != nil {
+		return err
+	}
+	err = audit(tx, username, "", LoginUnlocked)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func audit(tx *sql.Tx, username, ip, event string) error {
+	stmt := `INSERT INTO login_audit (username, ip, event) VALUES ($1, $2, $3)`
+	_, err := tx.Exec(stmt, username, ip, event)
+	return err
+}
+
+// throttleSubject normalizes a username so that changing its case does not
+// give more attempts.
+func throttleSubject(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
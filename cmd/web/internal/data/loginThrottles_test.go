@@ -0,0 +1,145 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/burstman/baseRegistry/cmd/web/internal/dbtest"
+)
+
+func TestLoginThrottleLockout(t *testing.T) {
+	tests := []struct {
+		name     string
+		throttle loginThrottle
+		failures int
+		want     time.Duration
+	}{
+		{name: "No failure", throttle: userThrottle, failures: 0, want: 0},
+		{name: "Within the allowance", throttle: userThrottle, failures: 5, want: 0},
+		{name: "First failure over", throttle: userThrottle, failures: 6, want: 30 * time.Second},
+		{name: "Second failure over", throttle: userThrottle, failures: 7, want: time.Minute},
+		{name: "Third failure over", throttle: userThrottle, failures: 8, want: 2 * time.Minute},
+		{name: "Last doubling", throttle: userThrottle, failures: 12, want: 32 * time.Minute},
+		{name: "Capped", throttle: userThrottle, failures: 13, want: lockoutMax},
+		{name: "Far over", throttle: userThrottle, failures: 1000, want: lockoutMax},
+		{name: "IP within the allowance", throttle: ipThrottle, failures: 20, want: 0},
+		{name: "IP first failure over", throttle: ipThrottle, failures: 21, want: 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.throttle.lockout(tt.failures); got != tt.want {
+				t.Errorf("lockout(%d) = %v; want %v", tt.failures, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserDBLoginThrottle(t *testing.T) {
+	db := dbtest.New(t)
+	users := &UserDB{DB: db}
+
+	// fail records failures against alice until one locks her out.
+	fail := func(t *testing.T, ip string) {
+		t.Helper()
+		for i := 1; i <= userThrottle.allowed; i++ {
+			locked, err := users.RecordLoginFailure("alice", ip, LoginFailed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if locked != 0 {
+				t.Fatalf("locked for %v after %d failures; want 0", locked, i)
+			}
+		}
+		// The case of the username does not give more attempts.
+		locked, err := users.RecordLoginFailure("Alice", ip, LoginFailed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked != lockoutBase {
+			t.Fatalf("locked for %v; want %v", locked, lockoutBase)
+		}
+	}
+	lockedFor := func(t *testing.T, username, ip string) time.Duration {
+		t.Helper()
+		d, err := users.LoginLockedFor(username, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	t.Run("Lock", func(t *testing.T) {
+		fail(t, "192.0.2.1")
+		if d := lockedFor(t, "alice", "192.0.2.99"); d <= 0 || d > lockoutBase {
+			t.Errorf("username locked for %v; want at most %v", d, lockoutBase)
+		}
+		// The IP is below its allowance, so other users may still log in.
+		if d := lockedFor(t, "bob", "192.0.2.1"); d != 0 {
+			t.Errorf("IP locked for %v; want 0", d)
+		}
+	})
+
+	t.Run("Window reset", func(t *testing.T) {
+		_, err := db.Exec(`UPDATE login_throttles SET locked_until = NULL,
+			last_failure_at = CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'`,
+			int((failureWindow + time.Hour).Seconds()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		locked, err := users.RecordLoginFailure("alice", "192.0.2.1", LoginFailed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked != 0 {
+			t.Errorf("locked for %v after the window; want 0", locked)
+		}
+		var failures int
+		err = db.QueryRow(`SELECT failures FROM login_throttles WHERE scope = $1 AND subject = $2`,
+			throttleUser, "alice").Scan(&failures)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures != 1 {
+			t.Errorf("%d failures counted; want 1", failures)
+		}
+	})
+
+	t.Run("ResetLoginFailures", func(t *testing.T) {
+		fail(t, "192.0.2.2")
+		if err := users.ResetLoginFailures("ALICE"); err != nil {
+			t.Fatal(err)
+		}
+		if d := lockedFor(t, "alice", "192.0.2.99"); d != 0 {
+			t.Errorf("username locked for %v after the reset; want 0", d)
+		}
+		// The failures of the IP are kept.
+		var failures int
+		err := db.QueryRow(`SELECT failures FROM login_throttles WHERE scope = $1 AND subject = $2`,
+			throttleIP, "192.0.2.2").Scan(&failures)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures != userThrottle.allowed+1 {
+			t.Errorf("%d failures counted for the IP; want %d", failures, userThrottle.allowed+1)
+		}
+	})
+
+	t.Run("UnlockLogin", func(t *testing.T) {
+		fail(t, "192.0.2.3")
+		if err := users.UnlockLogin("alice"); err != nil {
+			t.Fatal(err)
+		}
+		if d := lockedFor(t, "alice", "192.0.2.99"); d != 0 {
+			t.Errorf("username locked for %v after the unlock; want 0", d)
+		}
+		var count int
+		err := db.QueryRow(`SELECT COUNT(*) FROM login_audit WHERE username = $1 AND event = $2`,
+			"alice", LoginUnlocked).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("%d unlock events audited; want 1", count)
+		}
+	})
+}
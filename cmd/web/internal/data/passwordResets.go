@@ -0,0 +1,185 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newToken returns a random token to send to a user and the hash stored in
+// the database in its place, so that a leaked table cannot be used to take
+// over accounts.
+func newToken() (string, []byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken returns the SHA-256 hash of a token.
+func hashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// GetByEmail retrieves a user by their email address, ignoring case. If no
+// user matches, it returns ErrNoRecord.
+func (r *UserDB) GetByEmail(email string) (*User, error) {
+	stmt := `SELECT user_id, username, email, activated FROM users WHERE LOWER(email) = LOWER($1)`
+	user := &User{}
+
+	err := r.DB.QueryRow(stmt, strings.TrimSpace(email)).Scan(&user.Id, &user.Name, &user.Email, &user.Activated)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// NewPasswordReset creates a password reset token for a user, valid for ttl.
+// Only the hash of the token is stored; the token itself is returned to be
+// sent to the user. It returns ErrResetPending if the user still has an
+// unused token that has not expired, so that the form cannot be used to flood
+// their mailbox.
+func (r *UserDB) NewPasswordReset(userID int, ttl time.Duration) (string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	stmt := `INSERT INTO password_resets (token_hash, user_id, expires_at)
+	SELECT $1, $2, CURRENT_TIMESTAMP + $3 * INTERVAL '1 second'
+	WHERE NOT EXISTS (SELECT 1 FROM password_resets
+		WHERE user_id = $2 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP)`
+	result, err := r.DB.Exec(stmt, hash, userID, int(ttl.Seconds()))
+	if err != nil {
+		return "", err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if rowsAffected == 0 {
+		return "", ErrResetPending
+	}
+	return token, nil
+}
+
+// PasswordResetValid reports whether a password reset token exists, has not
+// been used and has not expired.
+func (r *UserDB) PasswordResetValid(token string) (bool, error) {
+	var valid bool
+	stmt := `SELECT EXISTS(SELECT 1 FROM password_resets
+	WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP)`
+	err := r.DB.QueryRow(stmt, hashToken(token)).Scan(&valid)
+	return valid, err
+}
+
+// ResetPassword sets a new password for the user a reset token was issued to
+// and consumes the token. It returns ErrInvalidToken if the token is unknown,
+// already used or expired.
+func (r *UserDB) ResetPassword(token, password string) (int, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	stmt := `UPDATE password_resets SET used_at = CURRENT_TIMESTAMP
+	WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	RETURNING user_id`
+	err = tx.QueryRow(stmt, hashToken(token)).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrInvalidToken
+		}
+		return 0, err
+	}
+
+	if err = updatePassword(tx, userID, password); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+// UpdatePassword re-hashes and stores a new password for a user. It also
+// invalidates the sessions opened with the previous password and the pending
+// reset tokens. It returns ErrNoRecord if the user does not exist.
+func (r *UserDB) UpdatePassword(id int, password string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = updatePassword(tx, id, password); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updatePassword stores a new password hash, bumps the session version of the
+// user and deletes their unused reset tokens.
+func updatePassword(tx *sql.Tx, id int, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE users SET password_hash = $1, session_version = session_version + 1
+	WHERE user_id = $2`
+	result, err := tx.Exec(stmt, string(hashedPassword), id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+
+	_, err = tx.Exec(`DELETE FROM password_resets WHERE user_id = $1 AND used_at IS NULL`, id)
+	return err
+}
+
+// SessionVersion returns the current session version of a user, to be stored
+// in their session at login.
+func (r *UserDB) SessionVersion(id int) (int, error) {
+	var version int
+	err := r.DB.QueryRow(`SELECT session_version FROM users WHERE user_id = $1`, id).Scan(&version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecord
+		}
+		return 0, err
+	}
+	return version, nil
+}
+
+// SessionValid reports whether a user exists and a session opened with the
+// given session version is still valid, that is their password did not
+// change, they were not logged out by an administrator and their account is
+// not disabled. It also reports whether the user is an administrator.
+func (r *UserDB) SessionValid(id, version int) (valid, admin bool, err error) {
+	stmt := `SELECT is_admin FROM users WHERE user_id = $1 AND session_version = $2 AND NOT disabled`
+	err = r.DB.QueryRow(stmt, id, version).Scan(&admin)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	return true, admin, nil
+}
@@ -0,0 +1,44 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/burstman/baseRegistry/cmd/web/internal/dbtest"
+)
+
+func TestUserDBNewPasswordResetPending(t *testing.T) {
+	db := dbtest.New(t)
+	users := &UserDB{DB: db}
+
+	id, err := users.Register(User{Name: "alice", Email: "alice@example.com", Password: "pa55word"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := users.NewPasswordReset(id, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.NewPasswordReset(id, time.Hour); !errors.Is(err, ErrResetPending) {
+		t.Fatalf("with a pending token: got error %v; want %v", err, ErrResetPending)
+	}
+
+	// Using the token lets the user ask for a new one.
+	if _, err := users.ResetPassword(token, "n3w-pa55word"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.NewPasswordReset(id, time.Hour); err != nil {
+		t.Fatalf("after using the token: %v", err)
+	}
+
+	// So does its expiry.
+	_, err = db.Exec(`UPDATE password_resets SET expires_at = CURRENT_TIMESTAMP - INTERVAL '1 minute'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.NewPasswordReset(id, time.Hour); err != nil {
+		t.Fatalf("after the token expired: %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TaskFilter narrows the tasks returned by GetUserProjects. Zero values
+// disable the corresponding filter.
+type TaskFilter struct {
+	Status     string
+	Priority   int
+	DueAfter   *time.Time
+	DueBefore  *time.Time
+	AssigneeID int
+	ProjectID  int64
+}
+
+// active reports whether at least one filter applies to the tasks themselves.
+func (f TaskFilter) active() bool {
+	return f.Status != "" || f.Priority != 0 || f.DueAfter != nil || f.DueBefore != nil || f.AssigneeID != 0
+}
+
+// conditions appends the SQL conditions of the task filters to the given
+// ones, numbering their placeholders after args, and returns both.
+func (f TaskFilter) conditions(conditions []string, args []any) ([]string, []any) {
+	if f.Status != "" {
+		args = append(args, f.Status)
+		conditions = append(conditions, fmt.Sprintf("t.status = $%d", len(args)))
+	}
+	if f.Priority != 0 {
+		args = append(args, f.Priority)
+		conditions = append(conditions, fmt.Sprintf("t.priority = $%d", len(args)))
+	}
+	if f.DueAfter != nil {
+		args = append(args, *f.DueAfter)
+		conditions = append(conditions, fmt.Sprintf("t.due_date >= $%d", len(args)))
+	}
+	if f.DueBefore != nil {
+		args = append(args, *f.DueBefore)
+		conditions = append(conditions, fmt.Sprintf("t.due_date <= $%d", len(args)))
+	}
+	if f.AssigneeID != 0 {
+		args = append(args, f.AssigneeID)
+		conditions = append(conditions, fmt.Sprintf(
+			"EXISTS (SELECT 1 FROM task_assignees fa WHERE fa.task_id = t.task_id AND fa.user_id = $%d)", len(args)))
+	}
+	return conditions, args
+}
+
+// userProjectsClause restricts projects to the ones a user is a member of.
+// The user ID is expected as the first query argument.
+const userProjectsClause = `EXISTS (SELECT 1 FROM project_members um
+	WHERE um.project_id = p.project_id AND um.user_id = $1)`
+
+// ListUserProjects returns the projects visible to a user, ordered by name,
+// without loading their tasks. It is meant to fill selection lists.
+func (pm *ProjectManager) ListUserProjects(userID int) ([]Project, error) {
+	projects, err := pm.queryProjects(`SELECT p.project_id, p.name, p.description, p.created_at, p.deadline, p.created_by
+	FROM projects p WHERE `+userProjectsClause+` ORDER BY p.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return projects, pm.fillRoles(userID, projects)
+}
+
+// GetUserProjects returns the projects visible to a user with their tasks
+// narrowed by the filter. When a task filter is active, projects without any
+// matching task are left out.
+func (pm *ProjectManager) GetUserProjects(userID int, f TaskFilter) ([]Project, error) {
+	query := `SELECT p.project_id, p.name, p.description, p.created_at, p.deadline, p.created_by
+	FROM projects p WHERE ` + userProjectsClause
+	args := []any{userID}
+	if f.ProjectID != 0 {
+		args = append(args, f.ProjectID)
+		query += fmt.Sprintf(" AND p.project_id = $%d", len(args))
+	}
+	query += " ORDER BY p.project_id"
+
+	projects, err := pm.queryProjects(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(projects) == 0 {
+		return projects, nil
+	}
+	if err = pm.fillRoles(userID, projects); err != nil {
+		return nil, err
+	}
+
+	projectIDs := make([]int64, len(projects))
+	for i, p := range projects {
+		projectIDs[i] = p.ProjectID
+	}
+	conditions, args := f.conditions([]string{"t.project_id = ANY($1)"}, []any{pq.Array(projectIDs)})
+
+	tasks, err := pm.queryTasks(taskColumns+" WHERE "+strings.Join(conditions, " AND ")+" ORDER BY t.task_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	projects, err = pm.assembleProjects(projects, tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.active() {
+		matching := projects[:0]
+		for _, p := range projects {
+			if len(p.Tasks) > 0 {
+				matching = append(matching, p)
+			}
+		}
+		projects = matching
+	}
+	return projects, nil
+}
+
+// fillRoles sets the role of the user in each project.
+func (pm *ProjectManager) fillRoles(userID int, projects []Project) error {
+	if len(projects) == 0 {
+		return nil
+	}
+	projectIDs := make([]int64, len(projects))
+	for i, p := range projects {
+		projectIDs[i] = p.ProjectID
+	}
+	roles, err := pm.userRoles(userID, projectIDs)
+	if err != nil {
+		return err
+	}
+	for i := range projects {
+		projects[i].Role = roles[projects[i].ProjectID]
+	}
+	return nil
+}
+
+// limitClause returns the LIMIT and OFFSET clause selecting a page of
+// pageSize rows, numbering its placeholders after args, or an empty clause if
+// pageSize is 0.
+func limitClause(args []any, page, pageSize int) (string, []any) {
+	if pageSize <= 0 {
+		return "", args
+	}
+	if page < 1 {
+		page = 1
+	}
+	args = append(args, pageSize, (page-1)*pageSize)
+	return fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args)), args
+}
+
+// SearchUserProjects returns a page of the projects visible to a user whose
+// name contains search, ordered by name and without their tasks, along with
+// the number of matching projects across all pages.
+func (pm *ProjectManager) SearchUserProjects(userID int, search string, page, pageSize int) ([]Project, int, error) {
+	where := " FROM projects p WHERE " + userProjectsClause
+	args := []any{userID}
+	if search = strings.TrimSpace(search); search != "" {
+		args = append(args, "%"+likeEscaper.Replace(search)+"%")
+		where += fmt.Sprintf(" AND p.name ILIKE $%d", len(args))
+	}
+
+	var total int
+	err := pm.DB.QueryRow("SELECT COUNT(*)"+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	limit, args := limitClause(args, page, pageSize)
+	projects, err := pm.queryProjects(`SELECT p.project_id, p.name, p.description, p.created_at, p.deadline, p.created_by`+
+		where+" ORDER BY p.name, p.project_id"+limit, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return projects, total, pm.fillRoles(userID, projects)
+}
+
+// ProjectTasks returns a page of the tasks of a project narrowed by the
+// filter, with their details, along with the number of matching tasks across
+// all pages. The ProjectID of the filter is ignored.
+func (pm *ProjectManager) ProjectTasks(idProject int64, f TaskFilter, page, pageSize int) ([]Task, int, error) {
+	conditions, args := f.conditions([]string{"t.project_id = $1"}, []any{idProject})
+	where := " WHERE " + strings.Join(conditions, " AND ")
+
+	var total int
+	err := pm.DB.QueryRow("SELECT COUNT(*) FROM tasks t"+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	limit, args := limitClause(args, page, pageSize)
+	tasks, err := pm.queryTasks(taskColumns+where+" ORDER BY t.task_id"+limit, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tasks, total, pm.loadTaskDetails(tasks)
+}
+
+// TaskComments returns a page of the comments of a task, oldest first, along
+// with the number of comments of the task.
+func (pm *ProjectManager) TaskComments(idTask int64, page, pageSize int) ([]Comment, int, error) {
+	var total int
+	err := pm.DB.QueryRow(`SELECT COUNT(*) FROM comments WHERE task_id = $1`, idTask).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	limit, args := limitClause([]any{idTask}, page, pageSize)
+	comments, err := pm.queryComments(commentColumns+` WHERE c.task_id = $1
+	ORDER BY c.created_at, c.comment_id`+limit, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return comments, total, nil
+}
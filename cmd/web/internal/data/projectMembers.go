@@ -0,0 +1,361 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Roles a user can hold in a project, from the most to the least privileged.
+const (
+	RoleOwner      = "owner"
+	RoleMaintainer = "maintainer"
+	RoleMember     = "member"
+	RoleViewer     = "viewer"
+)
+
+// ProjectRoles lists every project role, most privileged first.
+var ProjectRoles = []string{RoleOwner, RoleMaintainer, RoleMember, RoleViewer}
+
+// Action is something a user may want to do on a project.
+type Action string
+
+const (
+	// ActionView allows reading the project, its tasks and their files.
+	ActionView Action = "view"
+	// ActionEditTasks allows creating, editing, moving and commenting tasks,
+	// changing their status, assignees and files.
+	ActionEditTasks Action = "edit_tasks"
+	// ActionEditProject allows editing the project itself and deleting tasks.
+	ActionEditProject Action = "edit_project"
+	// ActionManageMembers allows inviting and removing members.
+	ActionManageMembers Action = "manage_members"
+	// ActionDeleteProject allows deleting the whole project.
+	ActionDeleteProject Action = "delete_project"
+)
+
+// roleRank orders the roles; a higher rank includes the rights of the lower
+// ones.
+var roleRank = map[string]int{
+	RoleViewer:     1,
+	RoleMember:     2,
+	RoleMaintainer: 3,
+	RoleOwner:      4,
+}
+
+// actionRank is the minimum role rank needed for each action.
+var actionRank = map[Action]int{
+	ActionView:          roleRank[RoleViewer],
+	ActionEditTasks:     roleRank[RoleMember],
+	ActionEditProject:   roleRank[RoleMaintainer],
+	ActionManageMembers: roleRank[RoleMaintainer],
+	ActionDeleteProject: roleRank[RoleOwner],
+}
+
+// ValidRole returns true if role is one of the project roles.
+func ValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// RoleAllows reports whether a user holding role may perform action. An empty
+// role, meaning the user is not a member, allows nothing.
+func RoleAllows(role string, action Action) bool {
+	rank, ok := roleRank[role]
+	if !ok {
+		return false
+	}
+	required, ok := actionRank[action]
+	return ok && rank >= required
+}
+
+// Can reports whether the user the project was loaded for may perform action.
+// It relies on Role, which is only filled by the per-user queries.
+func (p Project) Can(action Action) bool {
+	return RoleAllows(p.Role, action)
+}
+
+// ProjectMember is a user taking part in a project with a given role.
+type ProjectMember struct {
+	ProjectID int64      `json:"project_id"`
+	User      User       `json:"user"`
+	Role      string     `json:"role"`
+	AddedAt   *time.Time `json:"added_at"`
+}
+
+// ProjectRole returns the role of a user in a project, or an empty string if
+// the user is not a member.
+func (pm *ProjectManager) ProjectRole(idProject int64, userID int) (string, error) {
+	var role string
+	stmt := `SELECT role FROM project_members WHERE project_id = $1 AND user_id = $2`
+	err := pm.DB.QueryRow(stmt, idProject, userID).Scan(&role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return role, nil
+}
+
+// Authorize checks that a user may perform action on a project. It returns
+// ErrNoRecord if the project does not exist and ErrForbidden if the role of
+// the user does not allow the action.
+func (pm *ProjectManager) Authorize(userID int, idProject int64, action Action) error {
+	var role sql.NullString
+	stmt := `SELECT m.role FROM projects p
+	LEFT JOIN project_members m ON m.project_id = p.project_id AND m.user_id = $2
+	WHERE p.project_id = $1`
+	err := pm.DB.QueryRow(stmt, idProject, userID).Scan(&role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+	if !RoleAllows(role.String, action) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// AuthorizeTask checks that a user may perform action on the project of a
+// task. It returns ErrNoRecord if the task does not exist and ErrForbidden if
+// the role of the user does not allow the action.
+func (pm *ProjectManager) AuthorizeTask(userID int, idTask int64, action Action) error {
+	var (
+		projectID sql.NullInt64
+		role      sql.NullString
+	)
+	stmt := `SELECT t.project_id, m.role FROM tasks t
+	LEFT JOIN project_members m ON m.project_id = t.project_id AND m.user_id = $2
+	WHERE t.task_id = $1`
+	err := pm.DB.QueryRow(stmt, idTask, userID).Scan(&projectID, &role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+	if !RoleAllows(role.String, action) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// ListMembers returns the members of a project, most privileged first.
+func (pm *ProjectManager) ListMembers(idProject int64) ([]ProjectMember, error) {
+	stmt := `SELECT m.project_id, u.user_id, u.username, u.email, m.role, m.added_at
+	FROM project_members m
+	JOIN users u ON m.user_id = u.user_id
+	WHERE m.project_id = $1
+	ORDER BY CASE m.role WHEN 'owner' THEN 1 WHEN 'maintainer' THEN 2 WHEN 'member' THEN 3 ELSE 4 END,
+		u.username`
+
+	rows, err := pm.DB.Query(stmt, idProject)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []ProjectMember{}
+	for rows.Next() {
+		var (
+			m       ProjectMember
+			addedAt sql.NullTime
+		)
+		err := rows.Scan(&m.ProjectID, &m.User.Id, &m.User.Name, &m.User.Email, &m.Role, &addedAt)
+		if err != nil {
+			return nil, err
+		}
+		m.AddedAt = TimePointer(addedAt)
+		members = append(members, m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// SetMember adds a user to a project with the given role, or changes the role
+// of an existing member. Only owners may grant the owner role or change the
+// role of another owner, and a project always keeps at least one owner. It
+// returns ErrForbidden if the role of actingUser does not allow the change,
+// ErrLastOwner if it would leave the project without owner and ErrNoRecord if
+// the project or the user does not exist.
+func (pm *ProjectManager) SetMember(idProject int64, userID int, role string, actingUser int) error {
+	if !ValidRole(role) {
+		return ErrInvalidRole
+	}
+
+	tx, err := pm.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	actingRole, current, err := memberRoles(tx, idProject, actingUser, userID)
+	if err != nil {
+		return err
+	}
+	if !RoleAllows(actingRole, ActionManageMembers) {
+		return ErrForbidden
+	}
+	if (role == RoleOwner || current == RoleOwner) && actingRole != RoleOwner {
+		return ErrForbidden
+	}
+	if current == RoleOwner && role != RoleOwner {
+		if err := ensureAnotherOwner(tx, idProject, userID); err != nil {
+			return err
+		}
+	}
+
+	stmt := `INSERT INTO project_members (project_id, user_id, role)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (project_id, user_id) DO UPDATE SET role = EXCLUDED.role`
+	_, err = tx.Exec(stmt, idProject, userID, role)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return ErrNoRecord
+		}
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	op := OpUpdated
+	if current == "" {
+		op = OpCreated
+	}
+	pm.notify(Change{Kind: ChangeMember, Op: op, ProjectID: idProject, UserID: userID, ActorID: actingUser})
+	return nil
+}
+
+// RemoveMember removes a user from a project. The same rules as SetMember
+// apply; in addition it returns ErrNoRecord if the user is not a member.
+func (pm *ProjectManager) RemoveMember(idProject int64, userID int, actingUser int) error {
+	tx, err := pm.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	actingRole, current, err := memberRoles(tx, idProject, actingUser, userID)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		return ErrNoRecord
+	}
+	// Members may always leave a project on their own.
+	if actingUser != userID && !RoleAllows(actingRole, ActionManageMembers) {
+		return ErrForbidden
+	}
+	if current == RoleOwner {
+		if actingRole != RoleOwner {
+			return ErrForbidden
+		}
+		if err := ensureAnotherOwner(tx, idProject, userID); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM project_members WHERE project_id = $1 AND user_id = $2`, idProject, userID)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	pm.notify(Change{Kind: ChangeMember, Op: OpDeleted, ProjectID: idProject, UserID: userID, ActorID: actingUser})
+	return nil
+}
+
+// memberRoles locks the members of a project and returns the roles of the
+// acting user and of the target user, empty for non members. It returns
+// ErrNoRecord if the project does not exist.
+func memberRoles(tx *sql.Tx, idProject int64, actingUser, userID int) (string, string, error) {
+	var exists bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM projects WHERE project_id = $1)`, idProject).Scan(&exists)
+	if err != nil {
+		return "", "", err
+	}
+	if !exists {
+		return "", "", ErrNoRecord
+	}
+
+	rows, err := tx.Query(`SELECT user_id, role FROM project_members WHERE project_id = $1 FOR UPDATE`, idProject)
+	if err != nil {
+		return "", "", err
+	}
+	defer rows.Close()
+
+	var actingRole, current string
+	for rows.Next() {
+		var (
+			id   int
+			role string
+		)
+		if err := rows.Scan(&id, &role); err != nil {
+			return "", "", err
+		}
+		if id == actingUser {
+			actingRole = role
+		}
+		if id == userID {
+			current = role
+		}
+	}
+	return actingRole, current, rows.Err()
+}
+
+// ensureAnotherOwner returns ErrLastOwner if userID is the only owner of the
+// project.
+func ensureAnotherOwner(tx *sql.Tx, idProject int64, userID int) error {
+	var others int
+	stmt := `SELECT COUNT(*) FROM project_members WHERE project_id = $1 AND role = 'owner' AND user_id <> $2`
+	err := tx.QueryRow(stmt, idProject, userID).Scan(&others)
+	if err != nil {
+		return err
+	}
+	if others == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// addMember makes a user a member of a project with the given role, keeping
+// the current role if they already are one.
+func addMember(tx *sql.Tx, idProject int64, userID int, role string) error {
+	stmt := `INSERT INTO project_members (project_id, user_id, role)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (project_id, user_id) DO NOTHING`
+	_, err := tx.Exec(stmt, idProject, userID, role)
+	return err
+}
+
+// userRoles returns the role of a user in each of the given projects.
+func (pm *ProjectManager) userRoles(userID int, projectIDs []int64) (map[int64]string, error) {
+	stmt := `SELECT project_id, role FROM project_members WHERE user_id = $1 AND project_id = ANY($2)`
+	rows, err := pm.DB.Query(stmt, userID, pq.Array(projectIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := map[int64]string{}
+	for rows.Next() {
+		var (
+			id   int64
+			role string
+		)
+		if err := rows.Scan(&id, &role); err != nil {
+			return nil, err
+		}
+		roles[id] = role
+	}
+	return roles, rows.Err()
+}
@@ -0,0 +1,249 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// AssignUser adds a user to the assignees of a task and records the
+// assignment in the task history on behalf of changedBy. Assigning a user
+// twice is a no-op. It returns ErrNoRecord if the task or the user does not
+// exist, and ErrNotMember if the user is not a member of the project of the
+// task.
+func (pm *ProjectManager) AssignUser(idTask int64, idUser int, changedBy int) error {
+	tx, err := pm.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	changes, err := assignUsers(tx, idTask, []int{idUser}, changedBy)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	err = recordHistory(tx, idTask, changedBy, "user assigned", changes...)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	pm.notifyTask(ChangeTask, OpUpdated, idTask, changedBy)
+	return nil
+}
+
+// UnassignUser removes a user from the assignees of a task and records it in
+// the task history on behalf of changedBy. It returns ErrNoRecord if the user
+// was not assigned to the task.
+func (pm *ProjectManager) UnassignUser(idTask int64, idUser int, changedBy int) error {
+	tx, err := pm.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	changes, err := unassignUsers(tx, idTask, []int{idUser})
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return ErrNoRecord
+	}
+	err = recordHistory(tx, idTask, changedBy, "user unassigned", changes...)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	pm.notifyTask(ChangeTask, OpUpdated, idTask, changedBy)
+	return nil
+}
+
+// setAssignees replaces the assignees of a task by the given users and returns
+// the history changes describing who was added and who was removed.
+func setAssignees(tx *sql.Tx, idTask int64, userIDs []int, changedBy int) ([]HistoryChange, error) {
+	current, err := assigneeIDs(tx, idTask)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := map[int]bool{}
+	for _, id := range userIDs {
+		wanted[id] = true
+	}
+	var removed []int
+	for _, id := range current {
+		if !wanted[id] {
+			removed = append(removed, id)
+		}
+		delete(wanted, id)
+	}
+	var added []int
+	for _, id := range userIDs {
+		if wanted[id] {
+			added = append(added, id)
+			delete(wanted, id)
+		}
+	}
+
+	changes, err := unassignUsers(tx, idTask, removed)
+	if err != nil {
+		return nil, err
+	}
+	addedChanges, err := assignUsers(tx, idTask, added, changedBy)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, addedChanges...), nil
+}
+
+// assignUsers inserts assignee rows and returns one history change per user
+// that was not assigned yet. The new assignments are queued for the webhooks.
+func assignUsers(tx *sql.Tx, idTask int64, userIDs []int, changedBy int) ([]HistoryChange, error) {
+	var by any
+	if changedBy != 0 {
+		by = changedBy
+	}
+	stmt := `INSERT INTO task_assignees (task_id, user_id, assigned_by)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (task_id, user_id) DO NOTHING`
+
+	var changes []HistoryChange
+	for _, idUser := range userIDs {
+		// Assignees have to be able to work on the task: members are added
+		// by those allowed to manage them, not through the assignments.
+		member, err := assignable(tx, idTask, idUser)
+		if err != nil {
+			return nil, err
+		}
+		if !member {
+			return nil, ErrNotMember
+		}
+		result, err := tx.Exec(stmt, idTask, idUser, by)
+		if err != nil {
+			var pqErr *pq.Error
+			// Foreign key violation: unknown task or user.
+			if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+				return nil, ErrNoRecord
+			}
+			return nil, err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if rowsAffected == 0 {
+			continue
+		}
+		username, err := lookupName(tx, `SELECT username FROM users WHERE user_id = $1`, idUser)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, HistoryChange{Field: "assignees", New: username})
+	}
+	if len(changes) > 0 {
+		err := queueEvent(tx, EventTaskAssigned, idTask, changedBy, changes...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// assignable reports whether a user is a member of the project of a task. It
+// returns ErrNoRecord if the task does not exist.
+func assignable(tx *sql.Tx, idTask int64, idUser int) (bool, error) {
+	stmt := `SELECT EXISTS (SELECT 1 FROM project_members pm
+		WHERE pm.project_id = t.project_id AND pm.user_id = $2)
+	FROM tasks t WHERE t.task_id = $1`
+
+	var member bool
+	err := tx.QueryRow(stmt, idTask, idUser).Scan(&member)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrNoRecord
+	}
+	return member, err
+}
+
+// unassignUsers deletes assignee rows and returns one history change per user
+// that was actually removed.
+func unassignUsers(tx *sql.Tx, idTask int64, userIDs []int) ([]HistoryChange, error) {
+	stmt := `DELETE FROM task_assignees WHERE task_id = $1 AND user_id = $2`
+
+	var changes []HistoryChange
+	for _, idUser := range userIDs {
+		result, err := tx.Exec(stmt, idTask, idUser)
+		if err != nil {
+			return nil, err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if rowsAffected == 0 {
+			continue
+		}
+		username, err := lookupName(tx, `SELECT username FROM users WHERE user_id = $1`, idUser)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, HistoryChange{Field: "assignees", Old: username})
+	}
+	return changes, nil
+}
+
+// assigneeIDs returns the IDs of the users assigned to a task.
+func assigneeIDs(tx *sql.Tx, idTask int64) ([]int, error) {
+	rows, err := tx.Query(`SELECT user_id FROM task_assignees WHERE task_id = $1 ORDER BY user_id`, idTask)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// getAssignees loads the assignees of several tasks in one query and groups
+// them by task ID.
+func (pm *ProjectManager) getAssignees(taskIDs []int64) (map[int64][]*User, error) {
+	stmt := `SELECT ta.task_id, u.user_id, u.username, u.email
+	FROM task_assignees ta
+	JOIN users u ON ta.user_id = u.user_id
+	WHERE ta.task_id = ANY($1)
+	ORDER BY ta.assigned_at, u.username`
+
+	rows, err := pm.DB.Query(stmt, pq.Array(taskIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assignees := map[int64][]*User{}
+	for rows.Next() {
+		var idTask int64
+		u := &User{}
+		err := rows.Scan(&idTask, &u.Id, &u.Name, &u.Email)
+		if err != nil {
+			return nil, err
+		}
+		assignees[idTask] = append(assignees[idTask], u)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return assignees, nil
+}
@@ -0,0 +1,238 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Attachment describes a file attached to a task. The content itself lives in
+// the attachment storage under StorageKey; several attachments with the same
+// content share the same key.
+type Attachment struct {
+	AttachmentID int64      `json:"id"`
+	TaskID       *int64     `json:"task_id"`
+	UploadedAt   *time.Time `json:"uploaded_at"`
+	UploadedBy   *int64     `json:"uploaded_by"`
+	FileName     string     `json:"file_name"`
+	ContentType  string     `json:"content_type"`
+	Size         int64      `json:"size"`
+	Checksum     string     `json:"checksum"`
+	StorageKey   string     `json:"-"`
+}
+
+// HumanSize returns the size of the attachment in a readable unit.
+func (a Attachment) HumanSize() string {
+	const unit = 1024
+	if a.Size < unit {
+		return fmt.Sprintf("%d B", a.Size)
+	}
+	div, exp := int64(unit), 0
+	for n := a.Size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(a.Size)/float64(div), "KMGTPE"[exp])
+}
+
+// AddAttachment stores the metadata of a file attached to a task and records
+// it in the task history on behalf of the uploader. It returns
+// ErrDuplicateRecord if the same content is already attached to the task and
+// ErrNoRecord if the task does not exist.
+func (pm *ProjectManager) AddAttachment(a Attachment) (int64, error) {
+	stmt := `INSERT INTO attachments (task_id, uploaded_by, file_name, content_type, size, checksum, storage_key)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING attachment_id`
+	args := []any{
+		*a.TaskID,
+		a.UploadedBy,
+		a.FileName,
+		a.ContentType,
+		a.Size,
+		a.Checksum,
+		a.StorageKey,
+	}
+
+	tx, err := pm.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(stmt, args...).Scan(&a.AttachmentID)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) {
+			switch pqErr.Code {
+			case "23505":
+				return 0, ErrDuplicateRecord
+			case "23503":
+				return 0, ErrNoRecord
+			}
+		}
+		return 0, err
+	}
+
+	var uploadedBy int
+	if a.UploadedBy != nil {
+		uploadedBy = int(*a.UploadedBy)
+	}
+	err = recordHistory(tx, *a.TaskID, uploadedBy, "file attached",
+		HistoryChange{Field: "attachments", New: &a.FileName})
+	if err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	pm.notifyTask(ChangeTask, OpUpdated, *a.TaskID, uploadedBy)
+	return a.AttachmentID, nil
+}
+
+// GetAttachment retrieves the metadata of an attachment by its ID. If no
+// attachment matches the ID, it returns ErrNoRecord.
+func (pm *ProjectManager) GetAttachment(id int64) (*Attachment, error) {
+	stmt := `SELECT attachment_id, task_id, uploaded_at, uploaded_by, file_name, content_type, size,
+		checksum, storage_key
+	FROM attachments WHERE attachment_id = $1`
+
+	a, err := scanAttachment(pm.DB.QueryRow(stmt, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// DeleteAttachment removes an attachment and records it in the task history
+// on behalf of changedBy. It returns the deleted attachment so that the caller
+// can release its content, or ErrNoRecord if it does not exist.
+func (pm *ProjectManager) DeleteAttachment(id int64, changedBy int) (*Attachment, error) {
+	tx, err := pm.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt := `DELETE FROM attachments WHERE attachment_id = $1
+	RETURNING attachment_id, task_id, uploaded_at, uploaded_by, file_name, content_type, size,
+		checksum, storage_key`
+	a, err := scanAttachment(tx.QueryRow(stmt, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+
+	if a.TaskID != nil {
+		err = recordHistory(tx, *a.TaskID, changedBy, "file removed",
+			HistoryChange{Field: "attachments", Old: &a.FileName})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	if a.TaskID != nil {
+		pm.notifyTask(ChangeTask, OpUpdated, *a.TaskID, changedBy)
+	}
+	return a, nil
+}
+
+// StorageKeyInUse reports whether any attachment or avatar still references
+// the given storage key.
+func (pm *ProjectManager) StorageKeyInUse(key string) (bool, error) {
+	var exists bool
+	stmt := `SELECT EXISTS(SELECT 1 FROM attachments WHERE storage_key = $1)
+	OR EXISTS(SELECT 1 FROM users WHERE avatar_key = $1)`
+	err := pm.DB.QueryRow(stmt, key).Scan(&exists)
+	return exists, err
+}
+
+// TaskStorageKeys returns the storage keys of the files attached to a task.
+func (pm *ProjectManager) TaskStorageKeys(idTask int64) ([]string, error) {
+	return pm.storageKeys(`SELECT DISTINCT storage_key FROM attachments WHERE task_id = $1`, idTask)
+}
+
+// ProjectStorageKeys returns the storage keys of the files attached to the
+// tasks of a project.
+func (pm *ProjectManager) ProjectStorageKeys(idProject int64) ([]string, error) {
+	return pm.storageKeys(`SELECT DISTINCT a.storage_key FROM attachments a
+	JOIN tasks t ON a.task_id = t.task_id
+	WHERE t.project_id = $1`, idProject)
+}
+
+func (pm *ProjectManager) storageKeys(query string, id int64) ([]string, error) {
+	rows, err := pm.DB.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// getAttachments loads the attachments of several tasks in one query and
+// groups them by task ID.
+func (pm *ProjectManager) getAttachments(taskIDs []int64) (map[int64][]Attachment, error) {
+	stmt := `SELECT attachment_id, task_id, uploaded_at, uploaded_by, file_name, content_type, size,
+		checksum, storage_key
+	FROM attachments
+	WHERE task_id = ANY($1)
+	ORDER BY uploaded_at, attachment_id`
+
+	rows, err := pm.DB.Query(stmt, pq.Array(taskIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := map[int64][]Attachment{}
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		if a.TaskID != nil {
+			attachments[*a.TaskID] = append(attachments[*a.TaskID], *a)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// scanAttachment reads an attachment from a row holding the columns selected
+// by GetAttachment.
+func scanAttachment(row interface{ Scan(...any) error }) (*Attachment, error) {
+	var (
+		taskID, uploadedBy sql.NullInt64
+		uploadedAt         sql.NullTime
+	)
+	a := &Attachment{}
+	err := row.Scan(&a.AttachmentID, &taskID, &uploadedAt, &uploadedBy, &a.FileName, &a.ContentType,
+		&a.Size, &a.Checksum, &a.StorageKey)
+	if err != nil {
+		return nil, err
+	}
+	a.TaskID = IntPointer(taskID)
+	a.UploadedAt = TimePointer(uploadedAt)
+	a.UploadedBy = IntPointer(uploadedBy)
+	return a, nil
+}
@@ -0,0 +1,135 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// HistoryChange is the before/after value of a single task field. A nil value
+// means the field was empty.
+type HistoryChange struct {
+	Field string  `json:"field"`
+	Old   *string `json:"old"`
+	New   *string `json:"new"`
+}
+
+// HistoryEntry is one row of the task_history table: a change applied to a
+// task by a user.
+type HistoryEntry struct {
+	HistoryID   int64           `json:"id"`
+	TaskID      int64           `json:"task_id"`
+	Description string          `json:"description"`
+	Changes     []HistoryChange `json:"changes"`
+	ChangedAt   *time.Time      `json:"changed_at"`
+	ChangedBy   *User           `json:"changed_by"`
+}
+
+// recordHistory appends a row to the task_history table. It runs on the
+// transaction of the change it describes so that a task is never modified
+// without leaving a trace. A changedBy of 0 is stored as NULL.
+func recordHistory(tx *sql.Tx, idTask int64, changedBy int, description string, changes ...HistoryChange) error {
+	if changes == nil {
+		changes = []HistoryChange{}
+	}
+	js, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	var user any
+	if changedBy != 0 {
+		user = changedBy
+	}
+	stmt := `INSERT INTO task_history (task_id, change_description, changes, changed_by)
+	VALUES ($1, $2, $3, $4)`
+	_, err = tx.Exec(stmt, idTask, description, string(js), user)
+	return err
+}
+
+// change builds a HistoryChange, or returns false if the value did not change.
+func change(field string, before, after *string) (HistoryChange, bool) {
+	if before == nil && after == nil {
+		return HistoryChange{}, false
+	}
+	if before != nil && after != nil && *before == *after {
+		return HistoryChange{}, false
+	}
+	return HistoryChange{Field: field, Old: before, New: after}, true
+}
+
+// lookupName returns the name selected by query for the given ID, or nil if
+// id is nil or no row matches. It is used to store readable names rather than
+// raw IDs in the history.
+func lookupName(tx *sql.Tx, query string, id any) (*string, error) {
+	if id == nil {
+		return nil, nil
+	}
+	var name string
+	err := tx.QueryRow(query, id).Scan(&name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &name, nil
+}
+
+// GetTaskHistory returns the history of a task, oldest change first.
+func (pm *ProjectManager) GetTaskHistory(idTask int64) ([]HistoryEntry, error) {
+	history, err := pm.getHistory([]int64{idTask})
+	if err != nil {
+		return nil, err
+	}
+	return history[idTask], nil
+}
+
+// getHistory loads the history of several tasks in one query and groups the
+// entries by task ID, oldest change first.
+func (pm *ProjectManager) getHistory(taskIDs []int64) (map[int64][]HistoryEntry, error) {
+	stmt := `SELECT h.history_id, h.task_id, h.change_description, h.changes, h.changed_at,
+		h.changed_by, u.username, u.email
+	FROM task_history h
+	LEFT JOIN users u ON h.changed_by = u.user_id
+	WHERE h.task_id = ANY($1)
+	ORDER BY h.changed_at, h.history_id`
+
+	rows, err := pm.DB.Query(stmt, pq.Array(taskIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := map[int64][]HistoryEntry{}
+	for rows.Next() {
+		var (
+			h               HistoryEntry
+			changes         []byte
+			changedAt       sql.NullTime
+			changedBy       sql.NullInt64
+			username, email sql.NullString
+		)
+		err := rows.Scan(&h.HistoryID, &h.TaskID, &h.Description, &changes, &changedAt,
+			&changedBy, &username, &email)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(changes, &h.Changes)
+		if err != nil {
+			return nil, err
+		}
+		h.ChangedAt = TimePointer(changedAt)
+		if changedBy.Valid {
+			h.ChangedBy = &User{Id: int(changedBy.Int64), Name: username.String, Email: email.String}
+		}
+		history[h.TaskID] = append(history[h.TaskID], h)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
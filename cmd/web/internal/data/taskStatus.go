@@ -0,0 +1,119 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// Task statuses stored in the status column of the tasks table.
+const (
+	StatusOpen       = "open"
+	StatusInProgress = "in_progress"
+	StatusReview     = "review"
+	StatusDone       = "done"
+	StatusBlocked    = "blocked"
+	StatusCancelled  = "cancelled"
+)
+
+// TaskStatuses lists every task status in workflow order.
+var TaskStatuses = []string{StatusOpen, StatusInProgress, StatusReview, StatusDone, StatusBlocked, StatusCancelled}
+
+// taskTransitions describes the task workflow: for each status, the statuses
+// a task is allowed to move to. The main path is open -> in_progress ->
+// review -> done, a task can be blocked or cancelled on the way and finished
+// tasks can be reopened.
+var taskTransitions = map[string][]string{
+	StatusOpen:       {StatusInProgress, StatusBlocked, StatusCancelled},
+	StatusInProgress: {StatusReview, StatusBlocked, StatusOpen, StatusCancelled},
+	StatusReview:     {StatusDone, StatusInProgress, StatusCancelled},
+	StatusBlocked:    {StatusOpen, StatusInProgress, StatusCancelled},
+	StatusDone:       {StatusOpen},
+	StatusCancelled:  {StatusOpen},
+}
+
+// NormalizeStatus converts a status typed by a user, such as "In progress",
+// into its stored form ("in_progress").
+func NormalizeStatus(status string) string {
+	status = strings.ToLower(strings.TrimSpace(status))
+	return strings.Join(strings.FieldsFunc(status, func(r rune) bool {
+		return r == ' ' || r == '-' || r == '_'
+	}), "_")
+}
+
+// ValidStatus returns true if status is one of the known task statuses.
+func ValidStatus(status string) bool {
+	_, ok := taskTransitions[status]
+	return ok
+}
+
+// CanTransition returns true if the workflow allows a task to move from one
+// status to another.
+func CanTransition(from, to string) bool {
+	for _, next := range taskTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// NextStatuses returns the statuses the task can move to from its current
+// status.
+func (t Task) NextStatuses() []string {
+	if t.Status == nil {
+		return nil
+	}
+	return taskTransitions[*t.Status]
+}
+
+// UpdateTaskStatus moves a task to a new status. The current status is read
+// and locked in the same transaction as the update so that two concurrent
+// changes cannot bypass the workflow, and the change is recorded in the task
+// history on behalf of changedBy. It returns ErrInvalidStatus for an
+// unknown status, a *TransitionError if the workflow does not allow the change
+// and ErrNoRecord if the task does not exist.
+func (pm *ProjectManager) UpdateTaskStatus(idTask int64, status string, changedBy int) error {
+	if !ValidStatus(status) {
+		return ErrInvalidStatus
+	}
+
+	tx, err := pm.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow(`SELECT status FROM tasks WHERE task_id = $1 FOR UPDATE`, idTask).Scan(&current)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+
+	if !CanTransition(current, status) {
+		return &TransitionError{From: current, To: status}
+	}
+
+	_, err = tx.Exec(`UPDATE tasks SET status = $1 WHERE task_id = $2`, status, idTask)
+	if err != nil {
+		return err
+	}
+
+	statusChange := HistoryChange{Field: "status", Old: &current, New: &status}
+	err = recordHistory(tx, idTask, changedBy, "status changed", statusChange)
+	if err != nil {
+		return err
+	}
+	err = queueEvent(tx, EventTaskStatusChanged, idTask, changedBy, statusChange)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	pm.notifyTask(ChangeTask, OpUpdated, idTask, changedBy)
+	return nil
+}
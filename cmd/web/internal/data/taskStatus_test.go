@@ -0,0 +1,117 @@
+package data
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/burstman/baseRegistry/cmd/web/internal/dbtest"
+)
+
+func TestCanTransition(t *testing.T) {
+	// allowed lists every move of the workflow; all the other pairs of
+	// statuses must be refused.
+	allowed := map[[2]string]bool{
+		{StatusOpen, StatusInProgress}:      true,
+		{StatusOpen, StatusBlocked}:         true,
+		{StatusOpen, StatusCancelled}:       true,
+		{StatusInProgress, StatusReview}:    true,
+		{StatusInProgress, StatusBlocked}:   true,
+		{StatusInProgress, StatusOpen}:      true,
+		{StatusInProgress, StatusCancelled}: true,
+		{StatusReview, StatusDone}:          true,
+		{StatusReview, StatusInProgress}:    true,
+		{StatusReview, StatusCancelled}:     true,
+		{StatusBlocked, StatusOpen}:         true,
+		{StatusBlocked, StatusInProgress}:   true,
+		{StatusBlocked, StatusCancelled}:    true,
+		{StatusDone, StatusOpen}:            true,
+		{StatusCancelled, StatusOpen}:       true,
+	}
+
+	statuses := append([]string{"", "archived"}, TaskStatuses...)
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := allowed[[2]string{from, to}]
+			if got := CanTransition(from, to); got != want {
+				t.Errorf("CanTransition(%q, %q) = %t; want %t", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestNormalizeStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{status: "open", want: StatusOpen},
+		{status: "In progress", want: StatusInProgress},
+		{status: "in-progress", want: StatusInProgress},
+		{status: "  IN_PROGRESS ", want: StatusInProgress},
+		{status: "in  -  progress", want: StatusInProgress},
+		{status: "Review", want: StatusReview},
+		{status: "DONE", want: StatusDone},
+		{status: "", want: ""},
+		{status: "archived", want: "archived"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeStatus(tt.status); got != tt.want {
+			t.Errorf("NormalizeStatus(%q) = %q; want %q", tt.status, got, tt.want)
+		}
+	}
+	for _, status := range TaskStatuses {
+		if !ValidStatus(status) {
+			t.Errorf("ValidStatus(%q) = false; want true", status)
+		}
+	}
+}
+
+func TestProjectManagerUpdateTaskStatus(t *testing.T) {
+	db := dbtest.New(t)
+	users := &UserDB{DB: db}
+	pm := &ProjectManager{DB: db}
+
+	userID, err := users.Register(User{Name: "alice", Email: "alice@example.com", Password: "pa55word"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := int64(userID)
+	name := "Website"
+	projectID, err := pm.InsertProject(Project{Name: &name, CreatedBy: &owner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	title := "Write the home page"
+	taskID, err := pm.InsertTask(Task{Title: &title, ProjectID: &projectID, CreatedBy: &User{Id: userID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pm.UpdateTaskStatus(taskID, StatusDone, userID)
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) {
+		t.Fatalf("moving an open task to done: got error %v; want a *TransitionError", err)
+	}
+	if transitionErr.From != StatusOpen || transitionErr.To != StatusDone {
+		t.Errorf("got a transition from %q to %q; want from %q to %q",
+			transitionErr.From, transitionErr.To, StatusOpen, StatusDone)
+	}
+
+	if err := pm.UpdateTaskStatus(taskID, StatusInProgress, userID); err != nil {
+		t.Fatal(err)
+	}
+	var status string
+	if err := db.QueryRow(`SELECT status FROM tasks WHERE task_id = $1`, taskID).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status != StatusInProgress {
+		t.Errorf("status = %q; want %q", status, StatusInProgress)
+	}
+
+	if err := pm.UpdateTaskStatus(taskID, "archived", userID); !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("unknown status: got error %v; want %v", err, ErrInvalidStatus)
+	}
+	if err := pm.UpdateTaskStatus(taskID+1, StatusInProgress, userID); !errors.Is(err, ErrNoRecord) {
+		t.Errorf("unknown task: got error %v; want %v", err, ErrNoRecord)
+	}
+}
@@ -0,0 +1,262 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// totpOpts are the parameters of the codes shown by authenticator apps.
+var totpOpts = totp.ValidateOpts{
+	Period:    30,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// recoveryCodeCount is the number of recovery codes generated when two-factor
+// authentication is enabled.
+const recoveryCodeCount = 10
+
+// seal encrypts a TOTP secret with AES-GCM using the secret key of the
+// UserDB. The random nonce is prepended to the ciphertext.
+func (r *UserDB) seal(plain string) ([]byte, error) {
+	gcm, err := r.gcm()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, []byte(plain), nil), nil
+}
+
+// open decrypts a secret encrypted by seal.
+func (r *UserDB) open(sealed []byte) (string, error) {
+	gcm, err := r.gcm()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("data: sealed secret too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func (r *UserDB) gcm() (cipher.AEAD, error) {
+	if len(r.SecretKey) == 0 {
+		return nil, ErrNoSecretKey
+	}
+	block, err := aes.NewCipher(r.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SetPendingTOTP stores a new TOTP secret for a user without enabling
+// two-factor authentication: EnableTOTP does it once the user proved their
+// authenticator app produces valid codes. It fails if two-factor
+// authentication is already enabled.
+func (r *UserDB) SetPendingTOTP(id int, secret string) error {
+	sealed, err := r.seal(secret)
+	if err != nil {
+		return err
+	}
+	stmt := `UPDATE users SET totp_secret = $1, totp_last_step = NULL
+	WHERE user_id = $2 AND NOT totp_enabled`
+	result, err := r.DB.Exec(stmt, sealed, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// PendingTOTP returns the secret stored by SetPendingTOTP while two-factor
+// authentication is not enabled yet, or an empty string if there is none.
+func (r *UserDB) PendingTOTP(id int) (string, error) {
+	var sealed []byte
+	stmt := `SELECT totp_secret FROM users WHERE user_id = $1 AND NOT totp_enabled`
+	err := r.DB.QueryRow(stmt, id).Scan(&sealed)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	if sealed == nil {
+		return "", nil
+	}
+	return r.open(sealed)
+}
+
+// TOTPEnabled reports whether a user has two-factor authentication enabled.
+func (r *UserDB) TOTPEnabled(id int) (bool, error) {
+	var enabled bool
+	err := r.DB.QueryRow(`SELECT totp_enabled FROM users WHERE user_id = $1`, id).Scan(&enabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, ErrNoRecord
+		}
+		return false, err
+	}
+	return enabled, nil
+}
+
+// VerifyTOTP checks a code produced by the authenticator app of a user,
+// allowing one period of clock drift each way. A code is only accepted once.
+// It returns ErrInvalidCredentials if the code does not match.
+func (r *UserDB) VerifyTOTP(id int, code string, now time.Time) error {
+	var sealed []byte
+	err := r.DB.QueryRow(`SELECT totp_secret FROM users WHERE user_id = $1`, id).Scan(&sealed)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+	if sealed == nil {
+		return ErrInvalidCredentials
+	}
+	secret, err := r.open(sealed)
+	if err != nil {
+		return err
+	}
+
+	code = strings.TrimSpace(code)
+	period := int64(totpOpts.Period)
+	for skew := int64(-1); skew <= 1; skew++ {
+		t := now.Add(time.Duration(skew*period) * time.Second)
+		ok, err := totp.ValidateCustom(code, secret, t, totpOpts)
+		if err != nil || !ok {
+			continue
+		}
+		// Remember the time step so that the same code cannot be used twice.
+		stmt := `UPDATE users SET totp_last_step = $1
+		WHERE user_id = $2 AND (totp_last_step IS NULL OR totp_last_step < $1)`
+		result, err := r.DB.Exec(stmt, t.Unix()/period, id)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return ErrInvalidCredentials
+		}
+		return nil
+	}
+	return ErrInvalidCredentials
+}
+
+// EnableTOTP turns two-factor authentication on for a user with the pending
+// secret and returns a fresh set of recovery codes. Only their hashes are
+// stored, so they have to be shown to the user right away.
+func (r *UserDB) EnableTOTP(id int) ([]string, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt := `UPDATE users SET totp_enabled = TRUE WHERE user_id = $1 AND totp_secret IS NOT NULL`
+	result, err := tx.Exec(stmt, id)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrNoRecord
+	}
+
+	_, err = tx.Exec(`DELETE FROM user_recovery_codes WHERE user_id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = code[:8] + "-" + code[8:]
+		_, err = tx.Exec(`INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			id, hashToken(codes[i]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// DisableTOTP turns two-factor authentication off for a user and forgets
+// their secret and recovery codes.
+func (r *UserDB) DisableTOTP(id int) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, totp_last_step = NULL
+	WHERE user_id = $1`
+	_, err = tx.Exec(stmt, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM user_recovery_codes WHERE user_id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode consumes one of the recovery codes of a user. It returns
+// ErrInvalidCredentials if the code is unknown or was already used.
+func (r *UserDB) UseRecoveryCode(id int, code string) error {
+	// Accept codes typed in upper case or without their dash.
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) == 16 {
+		code = code[:8] + "-" + code[8:]
+	}
+	stmt := `UPDATE user_recovery_codes SET used_at = CURRENT_TIMESTAMP
+	WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+	result, err := r.DB.Exec(stmt, id, hashToken(code))
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
@@ -10,26 +10,64 @@ import (
 
 // User is a struct that holds the necessary information for registering a new authentication record.
 // It contains the name, email, and password of the user being registered.
+//
+// Only the public fields of a user are encoded to JSON, which leaves the email
+// address out: the users are shown to everyone sharing a project with them.
 type User struct {
-	Id       int
-	Name     string
-	Email    string
-	Password string
+	Id        int    `json:"id"`
+	Name      string `json:"username"`
+	Email     string `json:"-"`
+	Password  string `json:"-"`
+	Activated bool   `json:"-"`
+	IsAdmin   bool   `json:"-"`
+	Disabled  bool   `json:"-"`
+	// Locked reports whether logins are refused after too many failures,
+	// only filled by ListUsers.
+	Locked bool `json:"-"`
+
+	// Profile settings, only filled by Get.
+	DisplayName    string `json:"display_name,omitempty"`
+	AvatarKey      string `json:"-"`
+	AvatarType     string `json:"-"`
+	Timezone       string `json:"-"`
+	NotifyAssigned bool   `json:"-"`
+	NotifyComments bool   `json:"-"`
 }
 
 type UserDB struct {
 	DB *sql.DB
+	// SecretKey is the AES-256 key encrypting the TOTP secrets. Two-factor
+	// authentication is unavailable when it is empty.
+	SecretKey []byte
 }
 
+// Unique constraints created on the users table by migration 000001. Postgres
+// names them <table>_<column>_key.
+const (
+	usersUsernameKey = "users_username_key"
+	usersEmailKey    = "users_email_key"
+)
+
 // Get retrieves a user record from the database by their ID. If no record is found,
 // it returns ErrNoRecord.
 func (r *UserDB) Get(id int) (*User, error) {
-	stmt := `SELECT username, email FROM users WHERE user_id=$1`
+	stmt := `SELECT username, email, activated, is_admin, disabled, display_name,
+	COALESCE(avatar_key, ''), COALESCE(avatar_type, ''), timezone, notify_assigned, notify_comments
+	FROM users WHERE user_id=$1`
 	user := &User{Id: id}
 
 	err := r.DB.QueryRow(stmt, id).Scan(
 		&user.Name,
 		&user.Email,
+		&user.Activated,
+		&user.IsAdmin,
+		&user.Disabled,
+		&user.DisplayName,
+		&user.AvatarKey,
+		&user.AvatarType,
+		&user.Timezone,
+		&user.NotifyAssigned,
+		&user.NotifyComments,
 	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -42,30 +80,6 @@ func (r *UserDB) Get(id int) (*User, error) {
 	return user, nil
 }
 
-func (r *UserDB) GetAllUserNames() ([]*User, error) {
-	stmt := `SELECT username FROM users`
-	users := []*User{}
-
-	row, err := r.DB.Query(stmt)
-	for row.Next() {
-		var u User
-		err := row.Scan(&u.Name)
-		if err != nil {
-			return nil, err
-		}
-		users = append(users, &u)
-	}
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, ErrNoRecord
-		} else {
-			return nil, err
-		}
-	}
-
-	return users, nil
-}
-
 // Register adds a new authentication record to the database. If a record with the
 // same name or email already exists, it returns ErrDuplicateName or ErrDuplicateEmail.
 func (r *UserDB) Register(u User) (int, error) {
@@ -87,10 +101,11 @@ func (r *UserDB) Register(u User) (int, error) {
 	err = r.DB.QueryRow(query, args...).Scan(&id)
 	var pqSQLError *pq.Error
 	if err != nil {
-		if errors.As(err, &pqSQLError) {
-			if pqSQLError.Code == "23505" && pqSQLError.Constraint == "authentification_name_key" {
+		if errors.As(err, &pqSQLError) && pqSQLError.Code == "23505" {
+			switch pqSQLError.Constraint {
+			case usersUsernameKey:
 				return 0, ErrDuplicateName
-			} else if pqSQLError.Code == "23505" && pqSQLError.Constraint == "authentification_email_key" {
+			case usersEmailKey:
 				return 0, ErrDuplicateEmail
 			}
 		}
@@ -100,11 +115,16 @@ func (r *UserDB) Register(u User) (int, error) {
 	return id, nil
 }
 
+// Athentificate checks the credentials of a user and returns their ID. It
+// returns ErrInvalidCredentials if they do not match. If they do, it returns
+// ErrDisabled if an administrator disabled the account and ErrNotActivated if
+// the user has not confirmed their email address yet.
 func (r *UserDB) Athentificate(username, password string) (int, error) {
 	var id int
 	var hashedPassword []byte
-	query := `SELECT user_id, password_hash from users where username=$1`
-	err := r.DB.QueryRow(query, username).Scan(&id, &hashedPassword)
+	var activated, disabled bool
+	query := `SELECT user_id, password_hash, activated, disabled from users where username=$1`
+	err := r.DB.QueryRow(query, username).Scan(&id, &hashedPassword, &activated, &disabled)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return 0, ErrInvalidCredentials
@@ -119,6 +139,12 @@ func (r *UserDB) Athentificate(username, password string) (int, error) {
 		}
 		return 0, err
 	}
+	if disabled {
+		return 0, ErrDisabled
+	}
+	if !activated {
+		return 0, ErrNotActivated
+	}
 	return id, nil
 }
 
@@ -0,0 +1,57 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// NewActivation creates an email verification token for a user, valid for
+// ttl. Only the hash of the token is stored; the token itself is returned to
+// be sent to the user.
+func (r *UserDB) NewActivation(userID int, ttl time.Duration) (string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	stmt := `INSERT INTO user_activations (token_hash, user_id, expires_at)
+	VALUES ($1, $2, CURRENT_TIMESTAMP + $3 * INTERVAL '1 second')`
+	_, err = r.DB.Exec(stmt, hash, userID, int(ttl.Seconds()))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Activate marks the account a verification token was issued to as activated
+// and deletes its pending tokens. It returns ErrInvalidToken if the token is
+// unknown or expired.
+func (r *UserDB) Activate(token string) (int, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	stmt := `DELETE FROM user_activations
+	WHERE token_hash = $1 AND expires_at > CURRENT_TIMESTAMP
+	RETURNING user_id`
+	err = tx.QueryRow(stmt, hashToken(token)).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrInvalidToken
+		}
+		return 0, err
+	}
+
+	_, err = tx.Exec(`UPDATE users SET activated = TRUE WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`DELETE FROM user_activations WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
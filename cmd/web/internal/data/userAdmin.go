@@ -0,0 +1,111 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UserFilter narrows and pages the users returned by ListUsers. Zero values
+// disable the corresponding filter; a zero PageSize returns every user.
+type UserFilter struct {
+	// Search matches part of the username, display name or email.
+	Search string
+	// ActiveOnly leaves out disabled accounts.
+	ActiveOnly bool
+	Page       int
+	PageSize   int
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// ListUsers returns the users matching the filter ordered by username, along
+// with the number of matching users across all pages.
+func (r *UserDB) ListUsers(f UserFilter) ([]*User, int, error) {
+	query := `SELECT u.user_id, u.username, u.email, u.display_name, u.activated, u.is_admin, u.disabled,
+	EXISTS(SELECT 1 FROM login_throttles lt WHERE lt.scope = 'user' AND lt.subject = LOWER(u.username)
+		AND lt.locked_until > CURRENT_TIMESTAMP),
+	COUNT(*) OVER()
+	FROM users u`
+	conditions := []string{}
+	args := []any{}
+	if search := strings.TrimSpace(f.Search); search != "" {
+		args = append(args, "%"+likeEscaper.Replace(search)+"%")
+		conditions = append(conditions, fmt.Sprintf(
+			"(u.username ILIKE $%[1]d OR u.display_name ILIKE $%[1]d OR u.email ILIKE $%[1]d)", len(args)))
+	}
+	if f.ActiveOnly {
+		conditions = append(conditions, "NOT u.disabled")
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	limit, args := limitClause(args, f.Page, f.PageSize)
+	query += " ORDER BY u.username" + limit
+
+	rows, err := r.DB.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	total := 0
+	for rows.Next() {
+		var u User
+		err := rows.Scan(&u.Id, &u.Name, &u.Email, &u.DisplayName, &u.Activated, &u.IsAdmin, &u.Disabled,
+			&u.Locked, &total)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, &u)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+// SetAdmin grants or revokes the administrator role of a user.
+func (r *UserDB) SetAdmin(id int, admin bool) error {
+	return r.updateUser(`UPDATE users SET is_admin = $1 WHERE user_id = $2`, admin, id)
+}
+
+// PromoteAdmin makes the user with the given username an administrator. It is
+// meant to create the first administrator.
+func (r *UserDB) PromoteAdmin(username string) error {
+	return r.updateUser(`UPDATE users SET is_admin = TRUE WHERE username = $1`, username)
+}
+
+// SetDisabled disables or enables the account of a user. Disabling it also
+// logs out all their sessions.
+func (r *UserDB) SetDisabled(id int, disabled bool) error {
+	stmt := `UPDATE users SET disabled = $1,
+	session_version = session_version + CASE WHEN $1 THEN 1 ELSE 0 END
+	WHERE user_id = $2`
+	return r.updateUser(stmt, disabled, id)
+}
+
+// ForceLogout logs out all the sessions of a user by bumping their session
+// version.
+func (r *UserDB) ForceLogout(id int) error {
+	return r.updateUser(`UPDATE users SET session_version = session_version + 1 WHERE user_id = $1`, id)
+}
+
+// updateUser runs an update on a single user and returns ErrNoRecord if it
+// did not match any.
+func (r *UserDB) updateUser(stmt string, args ...any) error {
+	result, err := r.DB.Exec(stmt, args...)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Shown returns the name shown to other users: the display name if the user
+// chose one, their username otherwise.
+func (u *User) Shown() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Name
+}
+
+// Location returns the time zone of the user, UTC if it is unknown.
+func (u *User) Location() *time.Location {
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil || u.Timezone == "" {
+		return time.UTC
+	}
+	return loc
+}
+
+// Local converts t to the time zone of the user.
+func (u *User) Local(t time.Time) time.Time {
+	return t.In(u.Location())
+}
+
+// UpdateProfile stores the display name, time zone and notification
+// preferences of a user.
+func (r *UserDB) UpdateProfile(u *User) error {
+	stmt := `UPDATE users SET display_name = $1, timezone = $2, notify_assigned = $3, notify_comments = $4
+	WHERE user_id = $5`
+	result, err := r.DB.Exec(stmt, u.DisplayName, u.Timezone, u.NotifyAssigned, u.NotifyComments, u.Id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// SetAvatar stores the storage key and content type of the new avatar of a
+// user and returns the key of the previous one, empty if there was none. An
+// empty key removes the avatar.
+func (r *UserDB) SetAvatar(id int, key, contentType string) (string, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var old sql.NullString
+	err = tx.QueryRow(`SELECT avatar_key FROM users WHERE user_id = $1 FOR UPDATE`, id).Scan(&old)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNoRecord
+		}
+		return "", err
+	}
+
+	stmt := `UPDATE users SET avatar_key = NULLIF($1, ''), avatar_type = NULLIF($2, '') WHERE user_id = $3`
+	_, err = tx.Exec(stmt, key, contentType, id)
+	if err != nil {
+		return "", err
+	}
+	return old.String, tx.Commit()
+}
+
+// ChangePassword replaces the password of a user after checking their
+// current one. Like a reset, it bumps the session version of the user.
+func (r *UserDB) ChangePassword(id int, current, password string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var hashedPassword []byte
+	err = tx.QueryRow(`SELECT password_hash FROM users WHERE user_id = $1 FOR UPDATE`, id).Scan(&hashedPassword)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(current))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrInvalidCredentials
+		}
+		return err
+	}
+
+	if err = updatePassword(tx, id, password); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// NewEmailChange creates a token confirming a new email address for a user,
+// valid for ttl. It returns ErrDuplicateEmail if another account already uses
+// the address.
+func (r *UserDB) NewEmailChange(userID int, email string, ttl time.Duration) (string, error) {
+	var taken bool
+	stmt := `SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)`
+	err := r.DB.QueryRow(stmt, email).Scan(&taken)
+	if err != nil {
+		return "", err
+	}
+	if taken {
+		return "", ErrDuplicateEmail
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	stmt = `INSERT INTO email_changes (token_hash, user_id, email, expires_at)
+	VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4 * INTERVAL '1 second')`
+	_, err = r.DB.Exec(stmt, hash, userID, email, int(ttl.Seconds()))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ConfirmEmailChange replaces the email address of the user a token was
+// issued to and deletes their pending changes. It returns ErrInvalidToken if
+// the token is unknown or expired, and ErrDuplicateEmail if the address was
+// taken in the meantime.
+func (r *UserDB) ConfirmEmailChange(token string) (int, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var email string
+	stmt := `DELETE FROM email_changes
+	WHERE token_hash = $1 AND expires_at > CURRENT_TIMESTAMP
+	RETURNING user_id, email`
+	err = tx.QueryRow(stmt, hashToken(token)).Scan(&userID, &email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrInvalidToken
+		}
+		return 0, err
+	}
+
+	_, err = tx.Exec(`UPDATE users SET email = $1 WHERE user_id = $2`, email, userID)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == usersEmailKey {
+			return 0, ErrDuplicateEmail
+		}
+		return 0, err
+	}
+	_, err = tx.Exec(`DELETE FROM email_changes WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
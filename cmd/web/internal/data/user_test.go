@@ -0,0 +1,126 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/burstman/baseRegistry/cmd/web/internal/dbtest"
+)
+
+// TestUsersConstraintNames checks that the unique constraints Register and
+// ConfirmEmailChange look for are the ones of the schema.
+func TestUsersConstraintNames(t *testing.T) {
+	db := dbtest.New(t)
+
+	for _, name := range []string{usersUsernameKey, usersEmailKey} {
+		var exists bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_constraint
+			WHERE conname = $1 AND contype = 'u' AND conrelid = 'users'::regclass)`, name).Scan(&exists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Errorf("the users table has no unique constraint %s", name)
+		}
+	}
+}
+
+func TestUserDBRegister(t *testing.T) {
+	db := dbtest.New(t)
+	users := &UserDB{DB: db}
+
+	_, err := users.Register(User{Name: "alice", Email: "alice@example.com", Password: "pa55word"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		user    User
+		wantErr error
+	}{
+		{
+			name: "New user",
+			user: User{Name: "bob", Email: "bob@example.com", Password: "pa55word"},
+		},
+		{
+			name:    "Duplicate username",
+			user:    User{Name: "alice", Email: "other@example.com", Password: "pa55word"},
+			wantErr: ErrDuplicateName,
+		},
+		{
+			name:    "Duplicate email",
+			user:    User{Name: "carol", Email: "alice@example.com", Password: "pa55word"},
+			wantErr: ErrDuplicateEmail,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := users.Register(tt.user)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			user, err := users.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Name != tt.user.Name || user.Email != tt.user.Email {
+				t.Errorf("got %s <%s>; want %s <%s>", user.Name, user.Email, tt.user.Name, tt.user.Email)
+			}
+		})
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("%d users stored; want 2", count)
+	}
+}
+
+func TestUserDBConfirmEmailChangeDuplicate(t *testing.T) {
+	db := dbtest.New(t)
+	users := &UserDB{DB: db}
+
+	aliceID, err := users.Register(User{Name: "alice", Email: "alice@example.com", Password: "pa55word"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = users.Register(User{Name: "bob", Email: "bob@example.com", Password: "pa55word"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = users.NewEmailChange(aliceID, "bob@example.com", time.Hour)
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Fatalf("asking for a taken address: got error %v; want %v", err, ErrDuplicateEmail)
+	}
+
+	// The address was free when the change was asked for, and was taken
+	// before it was confirmed.
+	token, err := users.NewEmailChange(aliceID, "carol@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = users.Register(User{Name: "carol", Email: "carol@example.com", Password: "pa55word"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = users.ConfirmEmailChange(token)
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Fatalf("got error %v; want %v", err, ErrDuplicateEmail)
+	}
+	alice, err := users.Get(aliceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Email != "alice@example.com" {
+		t.Errorf("email = %s; want alice@example.com", alice.Email)
+	}
+}
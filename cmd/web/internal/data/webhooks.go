@@ -0,0 +1,389 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Events a webhook can subscribe to.
+const (
+	EventTaskCreated       = "task.created"
+	EventTaskAssigned      = "task.assigned"
+	EventTaskCommented     = "task.commented"
+	EventTaskStatusChanged = "task.status_changed"
+)
+
+// WebhookEvents lists the events in the order they are offered to users.
+var WebhookEvents = []string{EventTaskCreated, EventTaskAssigned, EventTaskCommented, EventTaskStatusChanged}
+
+// ValidEvent reports whether event is a known webhook event.
+func ValidEvent(event string) bool {
+	for _, e := range WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Statuses of a webhook delivery.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	// MaxWebhookAttempts is how many times a delivery is posted before it
+	// is given up.
+	MaxWebhookAttempts = 8
+	// webhookRetryBase is the delay before the first retry, each further
+	// retry doubling it.
+	webhookRetryBase = 30 * time.Second
+	// webhookRetryMax caps the exponential delay between retries.
+	webhookRetryMax = 6 * time.Hour
+)
+
+// webhookRetry returns how long to wait before posting a delivery again after
+// its nth failed attempt.
+func webhookRetry(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	if attempts > 16 {
+		return webhookRetryMax
+	}
+	d := webhookRetryBase << (attempts - 1)
+	if d > webhookRetryMax {
+		return webhookRetryMax
+	}
+	return d
+}
+
+// Webhook is a subscription of a URL to events of the tasks of a project.
+type Webhook struct {
+	ID        int64
+	ProjectID int64
+	URL       string
+	Secret    string
+	Events    []string
+	Active    bool
+	CreatedAt time.Time
+}
+
+// Subscribed reports whether the webhook receives an event.
+func (w Webhook) Subscribed(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is an event queued for a webhook, along with the outcome of
+// its last attempt.
+type WebhookDelivery struct {
+	ID        int64
+	WebhookID int64
+	// URL and Secret are the ones of the webhook, only filled by
+	// ClaimWebhookDeliveries.
+	URL            string
+	Secret         string
+	Event          string
+	Payload        []byte
+	Status         string
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastAttemptAt  *time.Time
+	ResponseStatus *int
+	LastError      string
+	CreatedAt      time.Time
+}
+
+// WebhookPayload is the JSON body posted to webhooks. It describes a change
+// of a task the way its history entry does.
+type WebhookPayload struct {
+	Event     string          `json:"event"`
+	ProjectID int64           `json:"project_id"`
+	TaskID    int64           `json:"task_id"`
+	TaskTitle string          `json:"task_title"`
+	ActorID   *int            `json:"actor_id"` // nil for changes without a user
+	Actor     *string         `json:"actor"`
+	Changes   []HistoryChange `json:"changes"`
+}
+
+// queueEvent queues an event of a task for the active webhooks of its project
+// subscribed to it. Like recordHistory, it runs on the transaction of the
+// change, so that an event is delivered if and only if the change is
+// committed. A changedBy of 0 means the change was not made by a user.
+func queueEvent(tx *sql.Tx, event string, idTask int64, changedBy int, changes ...HistoryChange) error {
+	var (
+		projectID  sql.NullInt64
+		title      string
+		subscribed bool
+	)
+	stmt := `SELECT t.project_id, t.title, EXISTS (
+		SELECT 1 FROM webhooks w WHERE w.project_id = t.project_id AND w.active AND $2 = ANY(w.events))
+	FROM tasks t WHERE t.task_id = $1`
+	err := tx.QueryRow(stmt, idTask, event).Scan(&projectID, &title, &subscribed)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+	if !subscribed {
+		return nil
+	}
+
+	payload := WebhookPayload{
+		Event:     event,
+		ProjectID: projectID.Int64,
+		TaskID:    idTask,
+		TaskTitle: title,
+		Changes:   changes,
+	}
+	if payload.Changes == nil {
+		payload.Changes = []HistoryChange{}
+	}
+	if changedBy != 0 {
+		payload.ActorID = &changedBy
+		payload.Actor, err = lookupName(tx, `SELECT username FROM users WHERE user_id = $1`, changedBy)
+		if err != nil {
+			return err
+		}
+	}
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	stmt = `INSERT INTO webhook_deliveries (webhook_id, event, payload)
+	SELECT webhook_id, $2, $3 FROM webhooks
+	WHERE project_id = $1 AND active AND $2 = ANY(events)`
+	_, err = tx.Exec(stmt, projectID.Int64, event, string(js))
+	return err
+}
+
+// InsertWebhook subscribes a URL to events of a project and returns the ID of
+// the webhook. It returns ErrInvalidEvent if an event is unknown and
+// ErrNoRecord if the project does not exist.
+func (pm *ProjectManager) InsertWebhook(w Webhook, createdBy int) (int64, error) {
+	for _, e := range w.Events {
+		if !ValidEvent(e) {
+			return 0, ErrInvalidEvent
+		}
+	}
+	stmt := `INSERT INTO webhooks (project_id, url, secret, events, created_by)
+	VALUES ($1, $2, $3, $4, $5) RETURNING webhook_id`
+	err := pm.DB.QueryRow(stmt, w.ProjectID, w.URL, w.Secret, pq.Array(w.Events), createdBy).Scan(&w.ID)
+	if err != nil {
+		var pqErr *pq.Error
+		// Foreign key violation: unknown project.
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return 0, ErrNoRecord
+		}
+		return 0, err
+	}
+	return w.ID, nil
+}
+
+const webhookColumns = `SELECT webhook_id, project_id, url, secret, events, active, created_at FROM webhooks`
+
+// GetWebhook retrieves a webhook by its ID. If no webhook matches the ID, it
+// returns ErrNoRecord.
+func (pm *ProjectManager) GetWebhook(id int64) (*Webhook, error) {
+	webhooks, err := pm.queryWebhooks(webhookColumns+` WHERE webhook_id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(webhooks) == 0 {
+		return nil, ErrNoRecord
+	}
+	return &webhooks[0], nil
+}
+
+// ListWebhooks returns the webhooks of a project, oldest first.
+func (pm *ProjectManager) ListWebhooks(idProject int64) ([]Webhook, error) {
+	return pm.queryWebhooks(webhookColumns+` WHERE project_id = $1 ORDER BY webhook_id`, idProject)
+}
+
+func (pm *ProjectManager) queryWebhooks(query string, args ...any) ([]Webhook, error) {
+	rows, err := pm.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var w Webhook
+		err := rows.Scan(&w.ID, &w.ProjectID, &w.URL, &w.Secret, pq.Array(&w.Events), &w.Active, &w.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// SetWebhookActive pauses or resumes a webhook. A paused webhook does not
+// receive new events; the deliveries already queued still go out.
+func (pm *ProjectManager) SetWebhookActive(id int64, active bool) error {
+	return pm.execOne(`UPDATE webhooks SET active = $2 WHERE webhook_id = $1`, id, active)
+}
+
+// DeleteWebhook deletes a webhook along with its deliveries.
+func (pm *ProjectManager) DeleteWebhook(id int64) error {
+	return pm.execOne(`DELETE FROM webhooks WHERE webhook_id = $1`, id)
+}
+
+// execOne runs a statement on a single row and returns ErrNoRecord if it did
+// not match any.
+func (pm *ProjectManager) execOne(stmt string, args ...any) error {
+	result, err := pm.DB.Exec(stmt, args...)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// WebhookDeliveries returns a page of the deliveries of a webhook, newest
+// first, along with the number of deliveries of the webhook.
+func (pm *ProjectManager) WebhookDeliveries(idWebhook int64, page, pageSize int) ([]WebhookDelivery, int, error) {
+	var total int
+	err := pm.DB.QueryRow(`SELECT COUNT(*) FROM webhook_deliveries WHERE webhook_id = $1`, idWebhook).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	limit, args := limitClause([]any{idWebhook}, page, pageSize)
+	stmt := `SELECT delivery_id, webhook_id, event, payload, status, attempts, next_attempt_at, last_attempt_at,
+		response_status, COALESCE(last_error, ''), created_at
+	FROM webhook_deliveries WHERE webhook_id = $1
+	ORDER BY delivery_id DESC` + limit
+	rows, err := pm.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var (
+			d              WebhookDelivery
+			payload        string
+			lastAttemptAt  sql.NullTime
+			responseStatus sql.NullInt64
+		)
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+			&lastAttemptAt, &responseStatus, &d.LastError, &d.CreatedAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		d.Payload = []byte(payload)
+		d.LastAttemptAt = TimePointer(lastAttemptAt)
+		d.ResponseStatus = intPointer(responseStatus)
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return deliveries, total, nil
+}
+
+// RedeliverWebhook queues a delivery of a webhook again, with a fresh set of
+// attempts. It returns ErrNoRecord if the webhook has no such delivery.
+func (pm *ProjectManager) RedeliverWebhook(idWebhook, idDelivery int64) error {
+	stmt := `UPDATE webhook_deliveries
+	SET status = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP
+	WHERE delivery_id = $1 AND webhook_id = $2`
+	return pm.execOne(stmt, idDelivery, idWebhook)
+}
+
+// ClaimWebhookDeliveries takes up to limit deliveries due for an attempt and
+// counts the attempt. The claimed deliveries are not handed out again before
+// lease is over, so that several dispatchers, possibly in several instances
+// of the application, can share the queue; a delivery whose dispatcher died
+// is retried once its lease is over.
+func (pm *ProjectManager) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	stmt := `UPDATE webhook_deliveries d
+	SET attempts = d.attempts + 1, next_attempt_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 second'
+	FROM webhooks w
+	WHERE w.webhook_id = d.webhook_id AND d.delivery_id IN (
+		SELECT delivery_id FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP
+		ORDER BY next_attempt_at
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED)
+	RETURNING d.delivery_id, d.webhook_id, w.url, w.secret, d.event, d.payload, d.attempts, d.created_at`
+	rows, err := pm.DB.Query(stmt, limit, int(lease.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var (
+			d       WebhookDelivery
+			payload string
+		)
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.URL, &d.Secret, &d.Event, &payload, &d.Attempts, &d.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		d.Payload = []byte(payload)
+		d.Status = DeliveryPending
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt stores the outcome of an attempt of a claimed
+// delivery: the HTTP status of the response, 0 if there was none, and the
+// error of the attempt, nil if it succeeded. A failed delivery is retried
+// with an exponential backoff until MaxWebhookAttempts is reached.
+func (pm *ProjectManager) RecordWebhookAttempt(d WebhookDelivery, responseStatus int, attemptErr error) error {
+	var status any
+	if responseStatus != 0 {
+		status = responseStatus
+	}
+
+	if attemptErr == nil {
+		stmt := `UPDATE webhook_deliveries
+		SET status = 'delivered', last_attempt_at = CURRENT_TIMESTAMP, response_status = $2, last_error = NULL
+		WHERE delivery_id = $1`
+		_, err := pm.DB.Exec(stmt, d.ID, status)
+		return err
+	}
+
+	next := DeliveryPending
+	if d.Attempts >= MaxWebhookAttempts {
+		next = DeliveryFailed
+	}
+	stmt := `UPDATE webhook_deliveries
+	SET status = $2, last_attempt_at = CURRENT_TIMESTAMP, response_status = $3, last_error = $4,
+		next_attempt_at = CURRENT_TIMESTAMP + $5 * INTERVAL '1 second'
+	WHERE delivery_id = $1`
+	_, err := pm.DB.Exec(stmt, d.ID, next, status, attemptErr.Error(), int(webhookRetry(d.Attempts).Seconds()))
+	return err
+}
@@ -0,0 +1,135 @@
+// Package live fans the changes of the projects out to the dashboards open in
+// the browsers. The changes made through this instance are published by the
+// ProjectManager; with several instances, each one relays its changes to the
+// others through PostgreSQL NOTIFY and receives theirs with LISTEN.
+package live
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/burstman/baseRegistry/cmd/web/internal/data"
+)
+
+// Channel is the PostgreSQL notification channel relaying the changes.
+const Channel = "dashboard_changes"
+
+// subscriptionBuffer is how many changes a subscriber may lag behind before
+// it is dropped.
+const subscriptionBuffer = 64
+
+// Hub is an in-process publish/subscribe hub of the changes. It implements
+// data.Notifier.
+type Hub struct {
+	// DB, if set, relays the changes to the other instances.
+	DB       *sql.DB
+	ErrorLog *log.Logger
+
+	// origin tells the notifications of this instance apart.
+	origin string
+
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// NewHub returns a hub relaying the changes through db, which may be nil for
+// a single instance.
+func NewHub(db *sql.DB, errorLog *log.Logger) *Hub {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &Hub{
+		DB:       db,
+		ErrorLog: errorLog,
+		origin:   hex.EncodeToString(b),
+		subs:     make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscription receives the changes published after it was made.
+type Subscription struct {
+	// C is closed when the subscription is cancelled, including when the
+	// subscriber lagged too far behind and changes were dropped: it should
+	// then reload everything it shows.
+	C   <-chan data.Change
+	c   chan data.Change
+	hub *Hub
+	// dropped tells that changes were dropped, guarded by the lock of the
+	// hub.
+	dropped bool
+}
+
+// Subscribe starts a subscription. It must be cancelled once done with.
+func (h *Hub) Subscribe() *Subscription {
+	c := make(chan data.Change, subscriptionBuffer)
+	s := &Subscription{C: c, c: c, hub: h}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+// Cancel ends the subscription. It is safe to call more than once.
+func (s *Subscription) Cancel() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// Dropped reports whether changes were dropped because the subscriber lagged
+// behind.
+func (s *Subscription) Dropped() bool {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.dropped
+}
+
+// remove closes a subscription. The caller holds the lock.
+func (h *Hub) remove(s *Subscription) {
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.c)
+	}
+}
+
+// Notify publishes a change made through this instance to its subscribers and
+// relays it to the other instances.
+func (h *Hub) Notify(c data.Change) {
+	h.Publish(c)
+	if h.DB == nil {
+		return
+	}
+	payload, err := json.Marshal(notification{Origin: h.origin, Change: c})
+	if err != nil {
+		h.ErrorLog.Println(err)
+		return
+	}
+	_, err = h.DB.Exec(`SELECT pg_notify($1, $2)`, Channel, string(payload))
+	if err != nil {
+		h.ErrorLog.Printf("live: relaying a change: %v", err)
+	}
+}
+
+// Publish hands a change to the subscribers of this instance only. It never
+// blocks: subscribers too slow to keep up are dropped.
+func (h *Hub) Publish(c data.Change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		select {
+		case s.c <- c:
+		default:
+			s.dropped = true
+			h.remove(s)
+		}
+	}
+}
+
+// notification is the payload of the PostgreSQL notifications.
+type notification struct {
+	Origin string      `json:"origin"`
+	Change data.Change `json:"change"`
+}
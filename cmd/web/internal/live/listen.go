@@ -0,0 +1,51 @@
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/burstman/baseRegistry/cmd/web/internal/data"
+	"github.com/lib/pq"
+)
+
+// Listen receives the changes relayed by the other instances and publishes
+// them to the subscribers of this one, until ctx is done. It opens its own
+// connection with dsn, reconnecting as needed; since notifications sent while
+// it was disconnected are lost, the subscribers are then told to resync.
+func (h *Hub) Listen(ctx context.Context, dsn string) error {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			h.ErrorLog.Printf("live: listening for changes: %v", err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(Channel); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-listener.Notify:
+			// A nil notification follows a reconnection.
+			if n == nil {
+				h.Publish(data.Change{Kind: data.ChangeResync})
+				continue
+			}
+			var msg notification
+			if err := json.Unmarshal([]byte(n.Extra), &msg); err != nil {
+				h.ErrorLog.Printf("live: invalid notification: %v", err)
+				continue
+			}
+			if msg.Origin != h.origin {
+				h.Publish(msg.Change)
+			}
+		case <-time.After(90 * time.Second):
+			// Notice dead connections the server did not close.
+			go listener.Ping()
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package mailer
+
+import (
+	"context"
+	"log"
+)
+
+// Log is a stand-in for a real mailer during local development: it writes the
+// emails to a logger instead of sending them.
+type Log struct {
+	Logger *log.Logger
+	From   string
+}
+
+func (m *Log) Send(ctx context.Context, to, subject, body string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	msg, err := buildMessage(m.From, to, subject, body)
+	if err != nil {
+		return err
+	}
+	m.Logger.Printf("email not sent, no SMTP server configured:\n%s", msg)
+	return nil
+}
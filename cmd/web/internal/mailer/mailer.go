@@ -0,0 +1,42 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+)
+
+// ErrInvalidHeader is returned when an address or a subject contains line
+// breaks, which would let it inject extra headers in the message.
+var ErrInvalidHeader = errors.New("mailer: invalid header value")
+
+// Mailer is the interface implemented by the backends sending the emails of the
+// application, such as password reset links.
+type Mailer interface {
+	// Send sends a plain text email to a single recipient.
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// buildMessage formats a plain text email with its headers.
+func buildMessage(from, to, subject, body string) ([]byte, error) {
+	for _, value := range []string{from, to, subject} {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"strconv"
+)
+
+// SMTP sends emails through an SMTP server, authenticating with PLAIN when a
+// username is configured.
+type SMTP struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+}
+
+// NewSMTP returns an SMTP mailer sending from the given address.
+func NewSMTP(host string, port int, username, password, from string) *SMTP {
+	m := &SMTP{
+		Addr: net.JoinHostPort(host, strconv.Itoa(port)),
+		From: from,
+	}
+	if username != "" {
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+func (m *SMTP) Send(ctx context.Context, to, subject, body string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	msg, err := buildMessage(m.From, to, subject, body)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, msg)
+}
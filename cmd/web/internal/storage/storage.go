@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrNotFound = errors.New("storage: object not found")
+
+// Storage is the interface implemented by the backends holding the content of
+// the task attachments. Objects are identified by a key chosen by the caller;
+// the application uses the SHA-256 checksum of the content so that identical
+// files are only stored once.
+type Storage interface {
+	// Put stores the content read from r under key, replacing any existing
+	// object with the same key.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the object stored under key. It returns ErrNotFound if there
+	// is none. The caller must close the returned reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Exists reports whether an object is stored under key.
+	Exists(ctx context.Context, key string) (bool, error)
+	// Delete removes the object stored under key. Deleting a missing object
+	// is not an error.
+	Delete(ctx context.Context, key string) error
+}
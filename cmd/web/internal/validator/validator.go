@@ -1,16 +1,33 @@
 package validator
 
 import (
+	"regexp"
 	"strings"
+	"time"
+	"unicode"
 	"unicode/utf8"
 )
 
+// EmailRX matches the email addresses accepted by the HTML5 email input.
+var EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+
+// UsernameRX matches usernames made of letters, digits, dots, dashes and
+// underscores.
+var UsernameRX = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
 type Validator struct {
-	FieldErrors map[string]string
+	FieldErrors    map[string]string
+	NonFieldErrors []string
 }
 
 func (v *Validator) Valid() bool {
-	return len(v.FieldErrors) == 0
+	return len(v.FieldErrors) == 0 && len(v.NonFieldErrors) == 0
+}
+
+// AddNonFieldError adds an error message that is not related to a specific
+// form field, such as invalid credentials.
+func (v *Validator) AddNonFieldError(message string) {
+	v.NonFieldErrors = append(v.NonFieldErrors, message)
 }
 
 func (v *Validator) AddFiledError(key, message string) {
@@ -39,6 +56,36 @@ func MaxChars(value string, n int) bool {
 	return utf8.RuneCountInString(value) <= n
 }
 
+// MinChars() returns true if a value contains at least n characters.
+func MinChars(value string, n int) bool {
+	return utf8.RuneCountInString(value) >= n
+}
+
+// MaxBytes() returns true if a value is no more than n bytes long.
+func MaxBytes(value string, n int) bool {
+	return len(value) <= n
+}
+
+// Matches() returns true if a value matches a compiled regular expression.
+func Matches(value string, rx *regexp.Regexp) bool {
+	return rx.MatchString(value)
+}
+
+// StrongPassword() returns true if a value contains at least one letter and
+// one digit.
+func StrongPassword(value string) bool {
+	var letter, digit bool
+	for _, r := range value {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	return letter && digit
+}
+
 // PermittedInt() returns true if a value is in a list of permitted integers.
 func PermittedInt(value int, permittedValues ...int) bool {
 	for i := range permittedValues {
@@ -48,3 +95,9 @@ func PermittedInt(value int, permittedValues ...int) bool {
 	}
 	return false
 }
+
+// ValidDate() returns true if a value can be parsed with the given time layout.
+func ValidDate(value, layout string) bool {
+	_, err := time.Parse(layout, value)
+	return err == nil
+}
@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// ErrForbiddenAddress is returned for the URLs and connections aimed at the
+// server itself or at its private network, which the webhooks must not reach.
+var ErrForbiddenAddress = errors.New("webhook: the address is loopback, link-local or private")
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), private in
+// all but name.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// PublicIP reports whether ip is a unicast address of the internet: not
+// loopback, link-local (which includes the metadata services of the cloud
+// providers), private, unspecified nor multicast.
+func PublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsPrivate() ||
+		ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// CheckURL checks that a webhook URL is an http or https URL whose host is
+// not obviously internal: an IP address that is not public or a localhost
+// name. Names are only resolved when connecting, where the dispatcher checks
+// the addresses again.
+func CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("webhook: not an http or https URL")
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrForbiddenAddress
+	}
+	if ip := net.ParseIP(host); ip != nil && !PublicIP(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// dialControl refuses the connections to addresses that are not public. It
+// runs once the name of the host is resolved, for every address tried, so a
+// name resolving to an internal address is caught as well.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !PublicIP(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/burstman/baseRegistry/cmd/web/internal/data"
+)
+
+// Queue is the store of the deliveries, implemented by data.ProjectManager.
+type Queue interface {
+	ClaimWebhookDeliveries(limit int, lease time.Duration) ([]data.WebhookDelivery, error)
+	RecordWebhookAttempt(d data.WebhookDelivery, responseStatus int, attemptErr error) error
+}
+
+// Dispatcher polls the queue and posts the deliveries that are due.
+type Dispatcher struct {
+	Queue    Queue
+	Client   *http.Client
+	ErrorLog *log.Logger
+	// Interval is the delay between two polls of an empty queue.
+	Interval time.Duration
+	// Batch is how many deliveries are claimed at once.
+	Batch int
+}
+
+// NewDispatcher returns a dispatcher polling the queue every few seconds. Its
+// client times out after 10 seconds, does not follow redirects, which count
+// as failures, and only connects to public addresses: the URLs are chosen by
+// the users, who must not reach the services of the private network.
+func NewDispatcher(queue Queue, errorLog *log.Logger) *Dispatcher {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: dialControl,
+	}
+	return &Dispatcher{
+		Queue: queue,
+		Client: &http.Client{
+			// No proxy either, it would connect on behalf of the client.
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 5 * time.Second,
+			},
+			Timeout: 10 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		ErrorLog: errorLog,
+		Interval: 5 * time.Second,
+		Batch:    20,
+	}
+}
+
+// Run delivers the queued events until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		n, err := d.DeliverDue(ctx)
+		if err != nil {
+			d.ErrorLog.Println(err)
+		}
+		// Keep going while the queue is full, rest once it is drained.
+		wait := d.Interval
+		if n == d.Batch {
+			wait = 0
+		}
+		timer.Reset(wait)
+	}
+}
+
+// DeliverDue makes one attempt for a batch of due deliveries and returns how
+// many were attempted.
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	// A claimed delivery is handed out again if it is not recorded before
+	// its lease is over, leave time for the whole batch.
+	lease := time.Duration(d.Batch)*d.Client.Timeout + time.Minute
+	deliveries, err := d.Queue.ClaimWebhookDeliveries(d.Batch, lease)
+	if err != nil {
+		return 0, err
+	}
+	for _, delivery := range deliveries {
+		status, attemptErr := d.post(ctx, delivery)
+		if ctx.Err() != nil {
+			// Shutting down: the lease will hand the rest out again.
+			return 0, nil
+		}
+		err = d.Queue.RecordWebhookAttempt(delivery, status, attemptErr)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(deliveries), nil
+}
+
+// post makes one attempt of a delivery and returns the status of the
+// response, if any. Any status outside of 2xx is a failure.
+func (d *Dispatcher) post(ctx context.Context, delivery data.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "task-manager-webhooks")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		var urlErr interface{ Timeout() bool }
+		if errors.As(err, &urlErr) && urlErr.Timeout() {
+			return 0, errors.New("the request timed out")
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Read a bit of the body so that the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("the receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
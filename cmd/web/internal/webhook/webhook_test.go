@@ -0,0 +1,235 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/burstman/baseRegistry/cmd/web/internal/data"
+)
+
+// memoryQueue hands out its deliveries once and records the attempts.
+type memoryQueue struct {
+	mu         sync.Mutex
+	deliveries []data.WebhookDelivery
+	attempts   []attempt
+}
+
+type attempt struct {
+	delivery data.WebhookDelivery
+	status   int
+	err      error
+}
+
+func (q *memoryQueue) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]data.WebhookDelivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if limit > len(q.deliveries) {
+		limit = len(q.deliveries)
+	}
+	claimed := q.deliveries[:limit]
+	q.deliveries = q.deliveries[limit:]
+	return claimed, nil
+}
+
+func (q *memoryQueue) RecordWebhookAttempt(d data.WebhookDelivery, responseStatus int, attemptErr error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.attempts = append(q.attempts, attempt{delivery: d, status: responseStatus, err: attemptErr})
+	return nil
+}
+
+// receiver is a local webhook receiver checking the signatures.
+type receiver struct {
+	*httptest.Server
+	secret string
+	status int
+
+	mu       sync.Mutex
+	received []*http.Request
+	bodies   [][]byte
+	errs     []error
+}
+
+func newReceiver(t *testing.T, secret string, status int) *receiver {
+	rc := &receiver{secret: secret, status: status}
+	rc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = Verify(rc.secret, r.Header, body, time.Minute, time.Now())
+		}
+		rc.mu.Lock()
+		rc.received = append(rc.received, r)
+		rc.bodies = append(rc.bodies, body)
+		rc.errs = append(rc.errs, err)
+		rc.mu.Unlock()
+		w.WriteHeader(rc.status)
+	}))
+	t.Cleanup(rc.Close)
+	return rc
+}
+
+// newTestDispatcher returns a dispatcher whose client may reach the local
+// receiver, which the client of NewDispatcher refuses.
+func newTestDispatcher(queue Queue, rc *receiver) *Dispatcher {
+	d := NewDispatcher(queue, log.New(io.Discard, "", 0))
+	client := rc.Client()
+	client.Timeout = d.Client.Timeout
+	client.CheckRedirect = d.Client.CheckRedirect
+	d.Client = client
+	return d
+}
+
+func TestDispatcherDeliversSignedPayloads(t *testing.T) {
+	rc := newReceiver(t, "whsec_test", http.StatusNoContent)
+	payload := []byte(`{"event":"task.created","task_id":7}`)
+	queue := &memoryQueue{deliveries: []data.WebhookDelivery{
+		{ID: 42, WebhookID: 1, URL: rc.URL, Secret: "whsec_test", Event: data.EventTaskCreated, Payload: payload},
+	}}
+
+	n, err := newTestDispatcher(queue, rc).DeliverDue(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("attempted %d deliveries; want 1", n)
+	}
+
+	if len(rc.received) != 1 {
+		t.Fatalf("the receiver got %d requests; want 1", len(rc.received))
+	}
+	if rc.errs[0] != nil {
+		t.Errorf("signature check: %v", rc.errs[0])
+	}
+	if string(rc.bodies[0]) != string(payload) {
+		t.Errorf("body = %s; want %s", rc.bodies[0], payload)
+	}
+	r := rc.received[0]
+	if got := r.Header.Get(EventHeader); got != data.EventTaskCreated {
+		t.Errorf("%s = %q; want %q", EventHeader, got, data.EventTaskCreated)
+	}
+	if got := r.Header.Get(DeliveryHeader); got != "42" {
+		t.Errorf("%s = %q; want %q", DeliveryHeader, got, "42")
+	}
+
+	if len(queue.attempts) != 1 {
+		t.Fatalf("recorded %d attempts; want 1", len(queue.attempts))
+	}
+	if a := queue.attempts[0]; a.status != http.StatusNoContent || a.err != nil {
+		t.Errorf("attempt = %d, %v; want %d, nil", a.status, a.err, http.StatusNoContent)
+	}
+}
+
+func TestDispatcherRecordsFailures(t *testing.T) {
+	rc := newReceiver(t, "whsec_test", http.StatusInternalServerError)
+	queue := &memoryQueue{deliveries: []data.WebhookDelivery{
+		{ID: 1, URL: rc.URL, Secret: "whsec_test", Event: data.EventTaskCommented, Payload: []byte(`{}`)},
+	}}
+
+	_, err := newTestDispatcher(queue, rc).DeliverDue(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue.attempts) != 1 {
+		t.Fatalf("recorded %d attempts; want 1", len(queue.attempts))
+	}
+	if a := queue.attempts[0]; a.status != http.StatusInternalServerError || a.err == nil {
+		t.Errorf("attempt = %d, %v; want %d and an error", a.status, a.err, http.StatusInternalServerError)
+	}
+}
+
+func TestDispatcherRefusesPrivateAddresses(t *testing.T) {
+	rc := newReceiver(t, "whsec_test", http.StatusOK)
+	// The name is resolved by the dialer, past the checks of CheckURL.
+	byName := strings.Replace(rc.URL, "127.0.0.1", "localhost", 1)
+	queue := &memoryQueue{deliveries: []data.WebhookDelivery{
+		{ID: 1, URL: rc.URL, Secret: "whsec_test", Event: data.EventTaskCreated, Payload: []byte(`{}`)},
+		{ID: 2, URL: byName, Secret: "whsec_test", Event: data.EventTaskCreated, Payload: []byte(`{}`)},
+	}}
+
+	_, err := NewDispatcher(queue, log.New(io.Discard, "", 0)).DeliverDue(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.received) != 0 {
+		t.Errorf("the receiver on the loopback address got %d requests; want 0", len(rc.received))
+	}
+	if len(queue.attempts) != 2 {
+		t.Fatalf("recorded %d attempts; want 2", len(queue.attempts))
+	}
+	for _, a := range queue.attempts {
+		if !errors.Is(a.err, ErrForbiddenAddress) {
+			t.Errorf("attempt error for %s = %v; want %v", a.delivery.URL, a.err, ErrForbiddenAddress)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url       string
+		forbidden bool
+		invalid   bool
+	}{
+		{url: "https://example.com/hooks"},
+		{url: "http://93.184.216.34:8080/"},
+		{url: "http://[2606:4700::1111]/"},
+		{url: "ftp://example.com/", invalid: true},
+		{url: "https:///path", invalid: true},
+		{url: "http://localhost:8080/", forbidden: true},
+		{url: "http://api.localhost/", forbidden: true},
+		{url: "http://127.0.0.1/", forbidden: true},
+		{url: "http://127.1.2.3/", forbidden: true},
+		{url: "http://[::1]/", forbidden: true},
+		{url: "http://[::ffff:127.0.0.1]/", forbidden: true},
+		{url: "http://0.0.0.0/", forbidden: true},
+		{url: "http://169.254.169.254/latest/meta-data/", forbidden: true},
+		{url: "http://10.0.0.5/", forbidden: true},
+		{url: "http://172.16.3.4/", forbidden: true},
+		{url: "http://192.168.1.1/", forbidden: true},
+		{url: "http://100.64.0.1/", forbidden: true},
+		{url: "http://[fd00::1]/", forbidden: true},
+		{url: "http://[fe80::1]/", forbidden: true},
+	}
+	for _, tt := range tests {
+		err := CheckURL(tt.url)
+		switch {
+		case tt.forbidden && !errors.Is(err, ErrForbiddenAddress):
+			t.Errorf("CheckURL(%q) = %v; want %v", tt.url, err, ErrForbiddenAddress)
+		case tt.invalid && (err == nil || errors.Is(err, ErrForbiddenAddress)):
+			t.Errorf("CheckURL(%q) = %v; want an invalid URL error", tt.url, err)
+		case !tt.forbidden && !tt.invalid && err != nil:
+			t.Errorf("CheckURL(%q) = %v; want nil", tt.url, err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	payload := []byte(`{"event":"task.assigned"}`)
+	now := time.Unix(1700000000, 0)
+	header := http.Header{}
+	header.Set(TimestampHeader, "1700000000")
+	header.Set(SignatureHeader, Sign("secret", now.Unix(), payload))
+
+	if err := Verify("secret", header, payload, time.Minute, now); err != nil {
+		t.Errorf("valid signature: %v", err)
+	}
+	if err := Verify("other", header, payload, time.Minute, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("wrong secret: %v; want %v", err, ErrInvalidSignature)
+	}
+	if err := Verify("secret", header, []byte(`{}`), time.Minute, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("altered payload: %v; want %v", err, ErrInvalidSignature)
+	}
+	if err := Verify("secret", header, payload, time.Minute, now.Add(time.Hour)); !errors.Is(err, ErrTooOld) {
+		t.Errorf("replayed payload: %v; want %v", err, ErrTooOld)
+	}
+	if err := Verify("secret", http.Header{}, payload, time.Minute, now); !errors.Is(err, ErrNoSignature) {
+		t.Errorf("unsigned payload: %v; want %v", err, ErrNoSignature)
+	}
+}
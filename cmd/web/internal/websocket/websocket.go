@@ -0,0 +1,342 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455), as much as the chat needs: text and binary messages, possibly
+// fragmented, pings and the closing handshake. Extensions and subprotocols are
+// not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The opcodes of the frames.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// The status codes of the close frames.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	ClosePolicyViolation = 1008
+	CloseTooBig          = 1009
+	CloseInternalError   = 1011
+)
+
+// acceptGUID is appended to the key of the client to compute the accept key.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// DefaultReadLimit is the default maximum size of a received message.
+const DefaultReadLimit = 64 << 10
+
+var (
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	ErrBadOrigin    = errors.New("websocket: request origin not allowed")
+	ErrTooBig       = errors.New("websocket: message too big")
+	ErrProtocol     = errors.New("websocket: protocol error")
+)
+
+// CloseError is returned by the reads once the peer closed the connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed by the peer: %d %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. Reads must be made from a single goroutine;
+// writes may be made from any number.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// ReadLimit is the maximum size of a received message.
+	ReadLimit int64
+
+	wmu    sync.Mutex
+	bw     *bufio.Writer
+	closed bool
+}
+
+// Upgrade answers the opening handshake of a request and returns the
+// connection. Requests sent by pages of another origin are refused, since
+// browsers let any page open sockets carrying the cookies of the user. On
+// failure it answers the request with an error and returns an error.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if !sameOrigin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, ErrBadOrigin
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, errors.New("websocket: the response cannot be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// The deadlines of the server are meant for requests, not for sockets.
+	conn.SetDeadline(time.Time{})
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, br: brw.Reader, bw: brw.Writer, ReadLimit: DefaultReadLimit}, nil
+}
+
+// acceptKey computes the Sec-WebSocket-Accept header answering a key.
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains reports whether a comma separated header holds a token.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether the Origin header, if any, names the host the
+// request was sent to.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// SetReadDeadline sets the deadline of the next reads.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// ReadMessage returns the next text or binary message. Pings are answered
+// while waiting for it. Once the peer closes the connection, it answers the
+// close frame and returns a *CloseError.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			closeErr := &CloseError{Code: CloseNormal}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+			}
+			c.Close(CloseNormal, "")
+			return nil, closeErr
+		case opText, opBinary:
+			if started {
+				return nil, c.fail(CloseProtocolError, ErrProtocol)
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				return nil, c.fail(CloseProtocolError, ErrProtocol)
+			}
+		default:
+			return nil, c.fail(CloseProtocolError, ErrProtocol)
+		}
+		if int64(len(message)+len(payload)) > c.ReadLimit {
+			return nil, c.fail(CloseTooBig, ErrTooBig)
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// ReadJSON reads the next message and decodes it into v.
+func (c *Conn) ReadJSON(v any) error {
+	message, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(message, v)
+}
+
+// readFrame reads a frame. The frames of the clients must be masked.
+func (c *Conn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.br, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	op = header[0] & 0x0F
+	if header[0]&0x70 != 0 || header[1]&0x80 == 0 {
+		err = c.fail(CloseProtocolError, ErrProtocol)
+		return
+	}
+
+	length := int64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	// Control frames are never fragmented nor larger than 125 bytes.
+	if op >= opClose && (!fin || length > 125) {
+		err = c.fail(CloseProtocolError, ErrProtocol)
+		return
+	}
+	if length < 0 || length > c.ReadLimit {
+		err = c.fail(CloseTooBig, ErrTooBig)
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// WriteMessage sends a text message.
+func (c *Conn) WriteMessage(message []byte) error {
+	return c.writeFrame(opText, message)
+}
+
+// WriteJSON sends v encoded in JSON as a text message.
+func (c *Conn) WriteJSON(v any) error {
+	message, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(message)
+}
+
+// Ping sends a ping, which browsers answer on their own. A connection whose
+// pongs stop arriving is dead.
+func (c *Conn) Ping() error {
+	return c.writeFrame(opPing, nil)
+}
+
+// writeFrame sends an unfragmented frame. The frames of the servers are not
+// masked.
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	c.bw.WriteByte(0x80 | op)
+	switch n := len(payload); {
+	case n <= 125:
+		c.bw.WriteByte(byte(n))
+	case n <= 0xFFFF:
+		c.bw.WriteByte(126)
+		binary.Write(c.bw, binary.BigEndian, uint16(n))
+	default:
+		c.bw.WriteByte(127)
+		binary.Write(c.bw, binary.BigEndian, uint64(n))
+	}
+	c.bw.Write(payload)
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.bw.Flush()
+}
+
+// fail closes the connection after a protocol violation of the peer and
+// returns err.
+func (c *Conn) fail(code int, err error) error {
+	c.Close(code, err.Error())
+	return err
+}
+
+// Close sends a close frame with a status code and closes the connection. It
+// is safe to call more than once.
+func (c *Conn) Close(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	c.writeFrame(opClose, payload)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
@@ -5,18 +5,25 @@ import (
 	"context"
 	"database/sql"
 	"encoding/gob"
+	"encoding/hex"
 	"flag"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
+	_ "time/tzdata" // time zones of the user profiles, whatever the host has
 
 	// add aliases texternao pacakges (internal / external )
 
 	// internal pacakges
 	chatApi "github.com/burstman/baseRegistry/cmd/web/internal/chatApi"
 	"github.com/burstman/baseRegistry/cmd/web/internal/data"
+	"github.com/burstman/baseRegistry/cmd/web/internal/live"
+	"github.com/burstman/baseRegistry/cmd/web/internal/mailer"
+	"github.com/burstman/baseRegistry/cmd/web/internal/storage"
+	"github.com/burstman/baseRegistry/cmd/web/internal/webhook"
 	"github.com/go-playground/form/v4"
 
 	// external packages
@@ -36,6 +43,22 @@ type config struct {
 		maxIdleConns int
 		maxIdleTime  string
 	}
+	upload struct {
+		dir          string
+		maxSize      int64
+		allowedTypes string
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		sender   string
+	}
+	baseURL string
+	totpKey string
+	unlock  string
+	admin   string
 }
 
 var cfg config
@@ -49,6 +72,12 @@ type application struct {
 	sessionManager  *scs.SessionManager
 	formDecoder     *form.Decoder
 	sendRecive      chatApi.SenderReceiver
+	files           storage.Storage
+	maxUploadSize   int64
+	allowedTypes    map[string]bool
+	mailer          mailer.Mailer
+	baseURL         string
+	hub             *live.Hub
 }
 
 func init() {
@@ -70,11 +99,43 @@ func main() {
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	flag.StringVar(&cfg.upload.dir, "upload-dir", envOr("REGISTRY_UPLOAD_DIR", "uploads"), "Directory storing task attachments")
+	flag.Int64Var(&cfg.upload.maxSize, "upload-max-size", 10<<20, "Maximum size of an attachment in bytes")
+	flag.StringVar(&cfg.upload.allowedTypes, "upload-types",
+		"image/png,image/jpeg,image/gif,application/pdf,text/plain,application/zip",
+		"Comma separated list of accepted attachment content types")
+	flag.StringVar(&cfg.smtp.host, "smtp-host", os.Getenv("REGISTRY_SMTP_HOST"), "SMTP host, emails are only logged when empty")
+	flag.IntVar(&cfg.smtp.port, "smtp-port", 587, "SMTP port")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", os.Getenv("REGISTRY_SMTP_USERNAME"), "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", os.Getenv("REGISTRY_SMTP_PASSWORD"), "SMTP password")
+	flag.StringVar(&cfg.smtp.sender, "smtp-sender", envOr("REGISTRY_SMTP_SENDER", "Task manager <no-reply@localhost>"), "SMTP sender")
+	flag.StringVar(&cfg.totpKey, "totp-key", os.Getenv("REGISTRY_TOTP_KEY"),
+		"Hex encoded 32 byte key encrypting the two-factor secrets, two-factor authentication is disabled when empty")
+	flag.StringVar(&cfg.baseURL, "base-url", envOr("REGISTRY_BASE_URL", "http://localhost:4000"), "Public URL of the application, used in emails")
+	flag.StringVar(&cfg.unlock, "unlock", "", "Lift the login lockout of the given username and exit")
+	flag.StringVar(&cfg.admin, "make-admin", "", "Make the given username an administrator and exit")
 	flag.Parse()
 	db, err := openDB(cfg)
 	if err != nil {
 		errlog.Fatal(err)
 	}
+
+	if cfg.unlock != "" {
+		err = (&data.UserDB{DB: db}).UnlockLogin(cfg.unlock)
+		if err != nil {
+			errlog.Fatal(err)
+		}
+		infolog.Printf("login of %s unlocked\n", cfg.unlock)
+		return
+	}
+	if cfg.admin != "" {
+		err = (&data.UserDB{DB: db}).PromoteAdmin(cfg.admin)
+		if err != nil {
+			errlog.Fatal(err)
+		}
+		infolog.Printf("%s is now an administrator\n", cfg.admin)
+		return
+	}
 	//Session Manager
 	sessionManager := scs.New()
 	sessionManager.Store = postgresstore.New(db)
@@ -83,11 +144,37 @@ func main() {
 
 	formDecoder := form.NewDecoder()
 
+	var totpKey []byte
+	if cfg.totpKey != "" {
+		totpKey, err = hex.DecodeString(cfg.totpKey)
+		if err != nil || len(totpKey) != 32 {
+			errlog.Fatal("the TOTP key must be 32 bytes encoded in hexadecimal")
+		}
+	}
+
+	files, err := storage.NewLocal(cfg.upload.dir)
+	if err != nil {
+		errlog.Fatal(err)
+	}
+	allowedTypes := map[string]bool{}
+	for _, t := range strings.Split(cfg.upload.allowedTypes, ",") {
+		allowedTypes[strings.TrimSpace(t)] = true
+	}
+
+	var mail mailer.Mailer
+	if cfg.smtp.host != "" {
+		mail = mailer.NewSMTP(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender)
+	} else {
+		mail = &mailer.Log{Logger: infolog, From: cfg.smtp.sender}
+	}
+
 	chat := chatApi.NewSenderReceive("http://localhost:8000/send_data")
 
+	hub := live.NewHub(db, errlog)
+
 	app := &application{
-		projects:       &data.ProjectManager{DB: db},
-		userData:       &data.UserDB{DB: db},
+		projects:       &data.ProjectManager{DB: db, Changes: hub},
+		userData:       &data.UserDB{DB: db, SecretKey: totpKey},
 		chatData:       &data.ChatData{DB: db},
 		errlog:         errlog,
 		infolog:        infolog,
@@ -95,10 +182,28 @@ func main() {
 		sessionManager: sessionManager,
 		formDecoder:    formDecoder,
 		sendRecive:     chat,
+		files:          files,
+		maxUploadSize:  cfg.upload.maxSize,
+		allowedTypes:   allowedTypes,
+		mailer:         mail,
+		baseURL:        strings.TrimRight(cfg.baseURL, "/"),
+		hub:            hub,
 	}
 
 	defer db.Close()
 	infolog.Printf("dabase connection pool established at %s\n", cfg.db.dsn)
+
+	// The deliveries are queued in the database, any number of instances
+	// can dispatch them.
+	go webhook.NewDispatcher(app.projects, errlog).Run(context.Background())
+
+	// The dashboards are also told about the changes made by the other
+	// instances.
+	go func() {
+		err := hub.Listen(context.Background(), cfg.db.dsn)
+		errlog.Printf("live updates from other instances stopped: %v", err)
+	}()
+
 	srv := &http.Server{
 		Addr:         cfg.addr,
 		ErrorLog:     app.errlog,
@@ -113,6 +218,15 @@ func main() {
 	errlog.Fatal(err)
 }
 
+// envOr returns the value of the environment variable key, or fallback if it
+// is not set.
+func envOr(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
 // put it into seperate package (maybe?)
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
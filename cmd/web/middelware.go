@@ -2,8 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/burstman/baseRegistry/cmd/web/internal/data"
 )
 
 func (app *application) applogRequest(next http.Handler) http.Handler {
@@ -53,9 +60,12 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 func (app *application) requierAuthentification(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !app.isAuthenticated(r) {
-			// Add the path that the user is trying to access to their session
-			// data.
-			app.sessionManager.Put(r.Context(), "redirectedPathAfterLogging", r.URL.Path)
+			// Add the page that the user is trying to access to their session
+			// data, so that postLogin can bring them back to it. Only GET
+			// requests can be replayed by a redirect.
+			if r.Method == http.MethodGet {
+				app.sessionManager.Put(r.Context(), "redirectPathAfterLogin", r.URL.RequestURI())
+			}
 			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 			return
 		}
@@ -64,6 +74,167 @@ func (app *application) requierAuthentification(next http.Handler) http.Handler
 	})
 }
 
+// loadSession loads the session for streamed responses. LoadAndSave cannot be
+// used for them since it buffers the whole response to write the session
+// cookie first. The session is only read: changes made to it are lost.
+func (app *application) loadSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if cookie, err := r.Cookie(app.sessionManager.Cookie.Name); err == nil {
+			token = cookie.Value
+		}
+		ctx, err := app.sessionManager.Load(r.Context(), token)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// minUploadRate is the slowest connection, in bytes per second, an upload of
+// the largest allowed file must still get through on.
+const minUploadRate = 64 << 10
+
+// allowUploadTime lifts the read timeout of the server for multipart
+// requests, which would otherwise cut any upload slower than a few megabytes
+// per second. The deadlines are sized from the largest allowed upload. It has
+// to run before the session middleware, whose response writer hides the
+// connection.
+func (app *application) allowUploadTime(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if r.Method == http.MethodPost && mediaType == "multipart/form-data" {
+			upload := 10*time.Second + time.Duration((app.maxUploadSize+1<<20)/minUploadRate)*time.Second
+			deadline := time.Now().Add(upload)
+			rc := http.NewResponseController(w)
+			err := rc.SetReadDeadline(deadline)
+			if err == nil {
+				// The write timeout runs from the end of the headers, so the
+				// response needs the same delay.
+				err = rc.SetWriteDeadline(deadline.Add(10 * time.Second))
+			}
+			// Writers without a connection, as in the tests, have no
+			// timeout to lift.
+			if err != nil && !errors.Is(err, http.ErrNotSupported) {
+				app.serverError(w, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// verifyCSRF rejects state-changing requests that do not carry the CSRF token
+// of the session, either in the csrf_token form field or in the X-CSRF-Token
+// header. Rejected requests get the bad request page.
+func (app *application) verifyCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := r.Header.Get("X-CSRF-Token")
+		if token == "" {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediaType == "multipart/form-data" {
+				// Parsing the form reads the whole upload, so limit it here
+				// rather than only in the handler.
+				r.Body = http.MaxBytesReader(w, r.Body, app.maxUploadSize+1<<20)
+				err := r.ParseMultipartForm(1 << 20)
+				if err != nil {
+					var maxBytesErr *http.MaxBytesError
+					if errors.As(err, &maxBytesErr) {
+						app.clientError(w, http.StatusRequestEntityTooLarge)
+						return
+					}
+					app.badRequest(w, r)
+					return
+				}
+			}
+			token = r.PostFormValue("csrf_token")
+		}
+
+		expected := app.sessionManager.GetString(r.Context(), "csrfToken")
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			app.badRequest(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAdmin refuses the request unless the user is an administrator. It is
+// meant to run after requierAuthentification.
+func (app *application) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.isAdmin(r) {
+			app.clientError(w, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticateToken authenticates requests carrying an API token in their
+// Authorization header. Requests without one go through unauthenticated,
+// those with an invalid one are refused.
+func (app *application) authenticateToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scheme, token, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			app.apiError(w, http.StatusUnauthorized, "invalid authorization header")
+			return
+		}
+		t, err := app.userData.AuthenticateAPIToken(strings.TrimSpace(token))
+		if err != nil {
+			if errors.Is(err, data.ErrInvalidToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				app.apiError(w, http.StatusUnauthorized, "invalid or expired token")
+				return
+			}
+			app.apiServerError(w, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), isAuthenticatedContextKey, true)
+		ctx = context.WithValue(ctx, userIDContextKey, t.UserID)
+		ctx = context.WithValue(ctx, apiTokenContextKey, t)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireScope refuses requests not authenticated with an API token granted
+// the scope.
+func (app *application) requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := app.apiToken(r)
+			if token == nil {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				app.apiError(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+			if !token.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+				app.apiError(w, http.StatusForbidden, fmt.Sprintf("this token lacks the %s scope", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func (app *application) authenticated(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Retrieve the authenticatedUserID value from the session using the
@@ -75,7 +246,10 @@ func (app *application) authenticated(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		exists, err := app.userData.Exists(id)
+		// Sessions opened before the user last changed their password carry
+		// an older session version and are no longer valid.
+		version := app.sessionManager.GetInt(r.Context(), "sessionVersion")
+		valid, admin, err := app.userData.SessionValid(id, version)
 		if err != nil {
 			app.serverError(w, err)
 			return
@@ -84,8 +258,12 @@ func (app *application) authenticated(next http.Handler) http.Handler {
 		// coming from an authenticated user who exists in our database. We
 		// create a new copy of the request (with an isAuthenticatedContextKey
 		// value of true in the request context) and assign it to r.
-		if exists {
-			r = r.WithContext(context.WithValue(r.Context(), isAuthenticatedContextKey, true))
+		if valid {
+			ctx := context.WithValue(r.Context(), isAuthenticatedContextKey, true)
+			ctx = context.WithValue(ctx, isAdminContextKey, admin)
+			r = r.WithContext(ctx)
+		} else {
+			app.sessionManager.Remove(r.Context(), "authenticatedUserID")
 		}
 		next.ServeHTTP(w, r)
 
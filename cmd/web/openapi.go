@@ -0,0 +1,453 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/burstman/baseRegistry/cmd/web/internal/data"
+)
+
+// apiOperation describes an endpoint of the JSON API. The routes of the API
+// are registered from these descriptions, which also generate its OpenAPI
+// document, so that the document cannot drift from the handlers: the request
+// and response schemas are derived from the very types the handlers decode
+// and encode.
+type apiOperation struct {
+	ID          string
+	Method      string
+	Path        string // in the httprouter syntax
+	Summary     string
+	Description string
+	Scope       string // scope the API token needs
+	Handler     http.HandlerFunc
+	Query       []any    // forms decoded from the query string
+	Omit        []string // query parameters of the forms not used by the handler
+	Body        any      // value decoded from the request body
+	Status      int      // status of a successful response
+	Response    envelope // body of a successful response, nil if empty
+	Errors      []int    // error statuses besides the ones every endpoint may return
+}
+
+// apiOperations lists the endpoints of the JSON API.
+func (app *application) apiOperations() []apiOperation {
+	pages := []any{apiPageForm{}}
+	return []apiOperation{
+		{
+			ID: "getMe", Method: http.MethodGet, Path: "/api/v1/me",
+			Summary:     "Show the user of the token",
+			Description: "Lets scripts check their token.",
+			Scope:       data.ScopeRead, Handler: app.apiMe,
+			Status:   http.StatusOK,
+			Response: envelope{"user": apiMeUser{}, "token": data.APIToken{}},
+		},
+		{
+			ID: "listProjects", Method: http.MethodGet, Path: "/api/v1/projects",
+			Summary:     "List projects",
+			Description: "Lists the projects the user is a member of, by name. The q parameter searches their name.",
+			Scope:       data.ScopeRead, Handler: app.apiListProjects,
+			Query:    append(pages, apiProjectSearch{}),
+			Status:   http.StatusOK,
+			Response: envelope{"projects": []data.Project{}, "metadata": apiMetadata{}},
+		},
+		{
+			ID: "createProject", Method: http.MethodPost, Path: "/api/v1/projects",
+			Summary:     "Create a project",
+			Description: "The user becomes the owner of the project.",
+			Scope:       data.ScopeWrite, Handler: app.apiCreateProject,
+			Body:     projectForm{},
+			Status:   http.StatusCreated,
+			Response: envelope{"project": data.Project{}},
+		},
+		{
+			ID: "getProject", Method: http.MethodGet, Path: "/api/v1/projects/:id",
+			Summary: "Show a project",
+			Scope:   data.ScopeRead, Handler: app.apiShowProject,
+			Status:   http.StatusOK,
+			Response: envelope{"project": data.Project{}},
+		},
+		{
+			ID: "updateProject", Method: http.MethodPatch, Path: "/api/v1/projects/:id",
+			Summary:     "Update a project",
+			Description: "Only the fields present in the body change. Requires the maintainer role.",
+			Scope:       data.ScopeWrite, Handler: app.apiUpdateProject,
+			Body:     projectForm{},
+			Status:   http.StatusOK,
+			Response: envelope{"project": data.Project{}},
+		},
+		{
+			ID: "deleteProject", Method: http.MethodDelete, Path: "/api/v1/projects/:id",
+			Summary:     "Delete a project",
+			Description: "Deletes the project with its tasks, comments and attachments. Requires the owner role.",
+			Scope:       data.ScopeWrite, Handler: app.apiDeleteProject,
+			Status: http.StatusNoContent,
+		},
+		{
+			ID: "listTasks", Method: http.MethodGet, Path: "/api/v1/projects/:id/tasks",
+			Summary:     "List the tasks of a project",
+			Description: "Lists the tasks with their details, filtered like the dashboard. Dates use the dd/mm/yyyy format.",
+			Scope:       data.ScopeRead, Handler: app.apiListTasks,
+			Query:    append(pages, dashboardFilterForm{}),
+			Omit:     []string{"project"},
+			Status:   http.StatusOK,
+			Response: envelope{"tasks": []data.Task{}, "metadata": apiMetadata{}},
+		},
+		{
+			ID: "createTask", Method: http.MethodPost, Path: "/api/v1/projects/:id/tasks",
+			Summary:     "Create a task",
+			Description: "project_id may be left out; when present it must be the project of the URL. Requires the member role.",
+			Scope:       data.ScopeWrite, Handler: app.apiCreateTask,
+			Body:     taskForm{},
+			Status:   http.StatusCreated,
+			Response: envelope{"task": data.Task{}},
+		},
+		{
+			ID: "getTask", Method: http.MethodGet, Path: "/api/v1/tasks/:id",
+			Summary: "Show a task",
+			Scope:   data.ScopeRead, Handler: app.apiShowTask,
+			Status:   http.StatusOK,
+			Response: envelope{"task": data.Task{}},
+		},
+		{
+			ID: "updateTask", Method: http.MethodPatch, Path: "/api/v1/tasks/:id",
+			Summary: "Update a task",
+			Description: "Only the fields present in the body change. Changing project_id moves the task, " +
+				"which requires the member role in both projects, and the status must follow the task workflow.",
+			Scope: data.ScopeWrite, Handler: app.apiUpdateTask,
+			Body:     apiTaskInput{},
+			Status:   http.StatusOK,
+			Response: envelope{"task": data.Task{}},
+			Errors:   []int{http.StatusConflict},
+		},
+		{
+			ID: "deleteTask", Method: http.MethodDelete, Path: "/api/v1/tasks/:id",
+			Summary:     "Delete a task",
+			Description: "Requires the maintainer role.",
+			Scope:       data.ScopeWrite, Handler: app.apiDeleteTask,
+			Status: http.StatusNoContent,
+		},
+		{
+			ID: "listComments", Method: http.MethodGet, Path: "/api/v1/tasks/:id/comments",
+			Summary: "List the comments of a task",
+			Scope:   data.ScopeRead, Handler: app.apiListComments,
+			Query:    pages,
+			Status:   http.StatusOK,
+			Response: envelope{"comments": []data.Comment{}, "metadata": apiMetadata{}},
+		},
+		{
+			ID: "createComment", Method: http.MethodPost, Path: "/api/v1/tasks/:id/comments",
+			Summary: "Comment a task",
+			Scope:   data.ScopeWrite, Handler: app.apiCreateComment,
+			Body:     apiCommentForm{},
+			Status:   http.StatusCreated,
+			Response: envelope{"comment": data.Comment{}},
+		},
+	}
+}
+
+// apiSchemaNames names the schemas of the types of the main package, whose
+// Go names are not meant for API clients. The other named types keep their
+// Go name.
+var apiSchemaNames = map[reflect.Type]string{
+	reflect.TypeOf(projectForm{}):    "ProjectInput",
+	reflect.TypeOf(taskForm{}):       "TaskInput",
+	reflect.TypeOf(apiTaskInput{}):   "TaskUpdate",
+	reflect.TypeOf(apiCommentForm{}): "CommentInput",
+	reflect.TypeOf(apiMeUser{}):      "CurrentUser",
+	reflect.TypeOf(apiMetadata{}):    "Metadata",
+	reflect.TypeOf(apiErrorBody{}):   "Error",
+}
+
+// The OpenAPI 3.0 objects, limited to what the document uses.
+type (
+	openAPIDocument struct {
+		OpenAPI    string                                  `json:"openapi"`
+		Info       openAPIInfo                             `json:"info"`
+		Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+		Components openAPIComponents                       `json:"components"`
+		Security   []map[string][]string                   `json:"security"`
+	}
+
+	openAPIInfo struct {
+		Title       string `json:"title"`
+		Version     string `json:"version"`
+		Description string `json:"description"`
+	}
+
+	openAPIOperation struct {
+		OperationID string                      `json:"operationId"`
+		Summary     string                      `json:"summary"`
+		Description string                      `json:"description,omitempty"`
+		Tags        []string                    `json:"tags"`
+		Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+		RequestBody *openAPIBody                `json:"requestBody,omitempty"`
+		Responses   map[string]*openAPIResponse `json:"responses"`
+	}
+
+	openAPIParameter struct {
+		Name     string         `json:"name"`
+		In       string         `json:"in"`
+		Required bool           `json:"required,omitempty"`
+		Schema   *openAPISchema `json:"schema"`
+	}
+
+	openAPIBody struct {
+		Required bool                        `json:"required"`
+		Content  map[string]openAPIMediaType `json:"content"`
+	}
+
+	openAPIResponse struct {
+		Ref         string                      `json:"$ref,omitempty"`
+		Description string                      `json:"description,omitempty"`
+		Content     map[string]openAPIMediaType `json:"content,omitempty"`
+	}
+
+	openAPIMediaType struct {
+		Schema *openAPISchema `json:"schema"`
+	}
+
+	openAPISchema struct {
+		Ref                  string                    `json:"$ref,omitempty"`
+		Type                 string                    `json:"type,omitempty"`
+		Format               string                    `json:"format,omitempty"`
+		Nullable             bool                      `json:"nullable,omitempty"`
+		Items                *openAPISchema            `json:"items,omitempty"`
+		Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+		AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+	}
+
+	openAPIComponents struct {
+		Schemas         map[string]*openAPISchema   `json:"schemas"`
+		Responses       map[string]*openAPIResponse `json:"responses"`
+		SecuritySchemes map[string]any              `json:"securitySchemes"`
+	}
+)
+
+// openAPIDescription introduces the API in its OpenAPI document.
+const openAPIDescription = `Projects, tasks and comments of the task manager.
+
+Authenticate with a personal API token, created on the API tokens page of your profile, sent in the ` +
+	"`Authorization: Bearer`" + ` header. Reads need the read scope and changes the write scope; the project roles apply as in the web interface.
+
+Every response is a JSON object. Errors have an error message, and a fields object for the invalid fields of a request. Listings take page and page_size parameters, page_size being at most 100, and return a metadata object. Dates use the dd/mm/yyyy format and timestamps RFC 3339.`
+
+// newOpenAPIDocument builds the OpenAPI document describing the operations.
+func newOpenAPIDocument(ops []apiOperation) *openAPIDocument {
+	doc := &openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title:       "Task manager API",
+			Version:     "1",
+			Description: openAPIDescription,
+		},
+		Paths: map[string]map[string]*openAPIOperation{},
+		Components: openAPIComponents{
+			Schemas:   map[string]*openAPISchema{},
+			Responses: map[string]*openAPIResponse{},
+			SecuritySchemes: map[string]any{
+				"bearerAuth": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+		Security: []map[string][]string{{"bearerAuth": {}}},
+	}
+	errorSchema := doc.schema(reflect.TypeOf(apiErrorBody{}))
+
+	for _, op := range ops {
+		path, params := openAPIPath(op.Path)
+		for _, q := range op.Query {
+			params = append(params, queryParameters(reflect.TypeOf(q), op.Omit)...)
+		}
+
+		description := fmt.Sprintf("Needs the %s scope.", op.Scope)
+		if op.Description != "" {
+			description = op.Description + " " + description
+		}
+		o := &openAPIOperation{
+			OperationID: op.ID,
+			Summary:     op.Summary,
+			Description: description,
+			Tags:        []string{openAPITag(op.Path)},
+			Parameters:  params,
+			Responses:   map[string]*openAPIResponse{},
+		}
+
+		if op.Body != nil {
+			o.RequestBody = &openAPIBody{
+				Required: true,
+				Content:  map[string]openAPIMediaType{"application/json": {Schema: doc.schema(reflect.TypeOf(op.Body))}},
+			}
+		}
+
+		success := &openAPIResponse{Description: http.StatusText(op.Status)}
+		if op.Response != nil {
+			body := &openAPISchema{Type: "object", Properties: map[string]*openAPISchema{}}
+			for name, v := range op.Response {
+				body.Properties[name] = doc.schema(reflect.TypeOf(v))
+			}
+			success.Content = map[string]openAPIMediaType{"application/json": {Schema: body}}
+		}
+		o.Responses[fmt.Sprint(op.Status)] = success
+
+		errs := []int{http.StatusUnauthorized, http.StatusForbidden}
+		if len(params) > 0 || op.Body != nil {
+			errs = append(errs, http.StatusBadRequest, http.StatusUnprocessableEntity)
+		}
+		if strings.Contains(op.Path, ":") {
+			errs = append(errs, http.StatusNotFound)
+		}
+		for _, status := range append(errs, op.Errors...) {
+			code := fmt.Sprint(status)
+			doc.Components.Responses[code] = &openAPIResponse{
+				Description: http.StatusText(status),
+				Content:     map[string]openAPIMediaType{"application/json": {Schema: errorSchema}},
+			}
+			o.Responses[code] = &openAPIResponse{Ref: "#/components/responses/" + code}
+		}
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*openAPIOperation{}
+		}
+		doc.Paths[path][strings.ToLower(op.Method)] = o
+	}
+	return doc
+}
+
+// openAPIPath converts an httprouter path into an OpenAPI path and returns its
+// parameters, all of them being IDs.
+func openAPIPath(path string) (string, []openAPIParameter) {
+	var params []openAPIParameter
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if name, ok := strings.CutPrefix(s, ":"); ok {
+			segments[i] = "{" + name + "}"
+			params = append(params, openAPIParameter{
+				Name:     name,
+				In:       "path",
+				Required: true,
+				Schema:   &openAPISchema{Type: "integer", Format: "int64"},
+			})
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// openAPITag groups the operations by the resource following the version in
+// their path.
+func openAPITag(path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/api/v1/"), "/")
+	return segments[0]
+}
+
+// queryParameters returns the query parameters decoded into a form struct,
+// named by their form tag, except the omitted ones.
+func queryParameters(t reflect.Type, omit []string) []openAPIParameter {
+	var params []openAPIParameter
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("form")
+		if !f.IsExported() || f.Anonymous || name == "" || name == "-" || contains(omit, name) {
+			continue
+		}
+		params = append(params, openAPIParameter{
+			Name:   name,
+			In:     "query",
+			Schema: scalarSchema(f.Type),
+		})
+	}
+	return params
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the schema of the JSON encoding of a type. Named structs are
+// added to the components of the document and referenced.
+func (doc *openAPIDocument) schema(t reflect.Type) *openAPISchema {
+	switch {
+	case t.Kind() == reflect.Pointer:
+		s := doc.schema(t.Elem())
+		if s.Ref != "" {
+			// Siblings of $ref are ignored in OpenAPI 3.0.
+			return &openAPISchema{Ref: s.Ref}
+		}
+		s.Nullable = true
+		return s
+	case t == timeType:
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Slice:
+		return &openAPISchema{Type: "array", Items: doc.schema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: doc.schema(t.Elem())}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		name, ok := apiSchemaNames[t]
+		if !ok {
+			name = t.Name()
+		}
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			// Reserve the name first in case the type refers to itself.
+			doc.Components.Schemas[name] = &openAPISchema{}
+			*doc.Components.Schemas[name] = *doc.object(t)
+		}
+		return &openAPISchema{Ref: "#/components/schemas/" + name}
+	case t.Kind() == reflect.Struct:
+		return doc.object(t)
+	}
+	return scalarSchema(t)
+}
+
+// object returns the schema of a struct, with the fields encoding/json
+// encodes. The fields of embedded structs are promoted.
+func (doc *openAPIDocument) object(t reflect.Type) *openAPISchema {
+	s := &openAPISchema{Type: "object", Properties: map[string]*openAPISchema{}}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for field, schema := range doc.object(f.Type).Properties {
+				if _, ok := s.Properties[field]; !ok {
+					s.Properties[field] = schema
+				}
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = doc.schema(f.Type)
+	}
+	return s
+}
+
+// scalarSchema returns the schema of a string, number or boolean type.
+func scalarSchema(t reflect.Type) *openAPISchema {
+	switch t.Kind() {
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Uint, reflect.Uint32:
+		return &openAPISchema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &openAPISchema{Type: "number"}
+	}
+	return &openAPISchema{}
+}
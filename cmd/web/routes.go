@@ -11,28 +11,106 @@ import (
 func (app *application) routes() http.Handler {
 	router := httprouter.New()
 
-	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		app.notFound(w)
-	})
+	router.NotFound = http.HandlerFunc(app.apiNotFoundHandler)
+	router.MethodNotAllowed = http.HandlerFunc(app.apiMethodNotAllowedHandler)
 
 	fileServer := http.FileServer(http.FS(ui.Files))
 
 	router.Handler(http.MethodGet, "/static/*filepath", fileServer)
 	//handler for session Manager
-	dynamic := alice.New(app.sessionManager.LoadAndSave, app.authenticated)
+	dynamic := alice.New(app.allowUploadTime, app.sessionManager.LoadAndSave, app.verifyCSRF, app.authenticated)
 	//Handlers
 	router.Handler(http.MethodGet, "/", dynamic.ThenFunc(app.home))
 	router.Handler(http.MethodGet, "/user/signup", dynamic.ThenFunc(app.getSignUp))
 	router.Handler(http.MethodPost, "/user/signup", dynamic.ThenFunc(app.postSignUp))
 	router.Handler(http.MethodGet, "/user/login", dynamic.ThenFunc(app.getLogin))
 	router.Handler(http.MethodPost, "/user/login", dynamic.ThenFunc(app.postLogin))
-	router.Handler(http.MethodPost, "/user/sendmessage", dynamic.ThenFunc(app.SendchatMessage))
-	router.Handler(http.MethodGet, "/tasks/view/:id", dynamic.ThenFunc(app.userTasksView))
-	//protected := dynamic.Append(app.requierAuthentification)
+	router.Handler(http.MethodGet, "/user/login/2fa", dynamic.ThenFunc(app.getLoginTwoFactor))
+	router.Handler(http.MethodPost, "/user/login/2fa", dynamic.ThenFunc(app.postLoginTwoFactor))
+	router.Handler(http.MethodGet, "/user/email/confirm", dynamic.ThenFunc(app.getConfirmEmail))
+	router.Handler(http.MethodGet, "/user/activate", dynamic.ThenFunc(app.getActivate))
+	router.Handler(http.MethodGet, "/user/activate/resend", dynamic.ThenFunc(app.getResendActivation))
+	router.Handler(http.MethodPost, "/user/activate/resend", dynamic.ThenFunc(app.postResendActivation))
+	router.Handler(http.MethodGet, "/user/password/forgot", dynamic.ThenFunc(app.getForgotPassword))
+	router.Handler(http.MethodPost, "/user/password/forgot", dynamic.ThenFunc(app.postForgotPassword))
+	router.Handler(http.MethodGet, "/user/password/reset", dynamic.ThenFunc(app.getResetPassword))
+	router.Handler(http.MethodPost, "/user/password/reset", dynamic.ThenFunc(app.postResetPassword))
+	protected := dynamic.Append(app.requierAuthentification)
+
+	router.Handler(http.MethodPost, "/user/logout", protected.ThenFunc(app.logoutPost))
+	router.Handler(http.MethodGet, "/user/profile", protected.ThenFunc(app.getProfile))
+	router.Handler(http.MethodPost, "/user/profile", protected.ThenFunc(app.postProfile))
+	router.Handler(http.MethodPost, "/user/profile/email", protected.ThenFunc(app.postProfileEmail))
+	router.Handler(http.MethodPost, "/user/profile/password", protected.ThenFunc(app.postProfilePassword))
+	router.Handler(http.MethodPost, "/user/profile/avatar", protected.ThenFunc(app.postProfileAvatar))
+	router.Handler(http.MethodPost, "/user/profile/avatar/remove", protected.ThenFunc(app.postProfileAvatarRemove))
+	router.Handler(http.MethodGet, "/user/avatar/:id", protected.ThenFunc(app.getAvatar))
+	router.Handler(http.MethodGet, "/user/tokens", protected.ThenFunc(app.getAPITokens))
+	router.Handler(http.MethodPost, "/user/tokens", protected.ThenFunc(app.postAPIToken))
+	router.Handler(http.MethodPost, "/user/tokens/revoke/:id", protected.ThenFunc(app.postAPITokenRevoke))
+	router.Handler(http.MethodGet, "/user/2fa", protected.ThenFunc(app.getTwoFactor))
+	router.Handler(http.MethodPost, "/user/2fa/enable", protected.ThenFunc(app.postTwoFactorEnable))
+	router.Handler(http.MethodPost, "/user/2fa/disable", protected.ThenFunc(app.postTwoFactorDisable))
+	router.Handler(http.MethodPost, "/user/sendmessage", protected.ThenFunc(app.SendchatMessage))
+	router.Handler(http.MethodGet, "/tasks/view/:id", protected.ThenFunc(app.userTasksView))
+	router.Handler(http.MethodGet, "/projects/create", protected.ThenFunc(app.getProjectCreate))
+	router.Handler(http.MethodPost, "/projects/create", protected.ThenFunc(app.postProjectCreate))
+	router.Handler(http.MethodGet, "/projects/edit/:id", protected.ThenFunc(app.getProjectEdit))
+	router.Handler(http.MethodPost, "/projects/edit/:id", protected.ThenFunc(app.postProjectEdit))
+	router.Handler(http.MethodPost, "/projects/delete/:id", protected.ThenFunc(app.postProjectDelete))
+	router.Handler(http.MethodGet, "/projects/members/:id", protected.ThenFunc(app.getProjectMembers))
+	router.Handler(http.MethodPost, "/projects/members/:id", protected.ThenFunc(app.postProjectMember))
+	router.Handler(http.MethodPost, "/projects/members/:id/remove", protected.ThenFunc(app.postProjectMemberRemove))
+	router.Handler(http.MethodGet, "/projects/webhooks/:id", protected.ThenFunc(app.getProjectWebhooks))
+	router.Handler(http.MethodPost, "/projects/webhooks/:id", protected.ThenFunc(app.postProjectWebhook))
+	router.Handler(http.MethodPost, "/webhooks/toggle/:id", protected.ThenFunc(app.postWebhookToggle))
+	router.Handler(http.MethodPost, "/webhooks/delete/:id", protected.ThenFunc(app.postWebhookDelete))
+	router.Handler(http.MethodGet, "/webhooks/deliveries/:id", protected.ThenFunc(app.getWebhookDeliveries))
+	router.Handler(http.MethodPost, "/webhooks/redeliver/:id", protected.ThenFunc(app.postWebhookRedeliver))
+	router.Handler(http.MethodGet, "/tasks/create", protected.ThenFunc(app.getTaskCreate))
+	router.Handler(http.MethodPost, "/tasks/create", protected.ThenFunc(app.postTaskCreate))
+	router.Handler(http.MethodGet, "/tasks/edit/:id", protected.ThenFunc(app.getTaskEdit))
+	router.Handler(http.MethodPost, "/tasks/edit/:id", protected.ThenFunc(app.postTaskEdit))
+	router.Handler(http.MethodPost, "/tasks/move/:id", protected.ThenFunc(app.postTaskMove))
+	router.Handler(http.MethodPost, "/tasks/status/:id", protected.ThenFunc(app.postTaskStatus))
+	router.Handler(http.MethodPost, "/tasks/assign/:id", protected.ThenFunc(app.postTaskAssign))
+	router.Handler(http.MethodPost, "/tasks/unassign/:id", protected.ThenFunc(app.postTaskUnassign))
+	router.Handler(http.MethodPost, "/tasks/attach/:id", protected.ThenFunc(app.postTaskAttach))
+	router.Handler(http.MethodGet, "/attachments/download/:id", protected.ThenFunc(app.getAttachmentDownload))
+	router.Handler(http.MethodPost, "/attachments/delete/:id", protected.ThenFunc(app.postAttachmentDelete))
+	router.Handler(http.MethodPost, "/tasks/delete/:id", protected.ThenFunc(app.postTaskDelete))
+
+	admin := protected.Append(app.requireAdmin)
+
+	router.Handler(http.MethodGet, "/admin/users", admin.ThenFunc(app.getAdminUsers))
+	router.Handler(http.MethodPost, "/admin/users/disable/:id", admin.ThenFunc(app.postAdminUserDisable))
+	router.Handler(http.MethodPost, "/admin/users/enable/:id", admin.ThenFunc(app.postAdminUserEnable))
+	router.Handler(http.MethodPost, "/admin/users/role/:id", admin.ThenFunc(app.postAdminUserRole))
+	router.Handler(http.MethodPost, "/admin/users/reset/:id", admin.ThenFunc(app.postAdminUserReset))
+	router.Handler(http.MethodPost, "/admin/users/logout/:id", admin.ThenFunc(app.postAdminUserLogout))
+	router.Handler(http.MethodPost, "/admin/users/unlock/:id", admin.ThenFunc(app.postAdminUserUnlock))
+
+	// The event stream and the chat socket cannot go through LoadAndSave,
+	// which buffers the responses. They are opened with GET requests, which
+	// need no CSRF check; the socket checks the origin of the page instead.
+	stream := alice.New(app.loadSession, app.authenticated, app.requierAuthentification)
+
+	router.Handler(http.MethodGet, "/events", stream.ThenFunc(app.getEvents))
+	router.Handler(http.MethodGet, "/chat/ws", stream.ThenFunc(app.getChatSocket))
+
+	// The API authenticates with tokens rather than sessions, so it needs
+	// neither the session nor the CSRF check. Its routes are registered from
+	// the operations of its OpenAPI document.
+	api := alice.New(app.authenticateToken)
+
+	for _, op := range app.apiOperations() {
+		router.Handler(op.Method, op.Path, api.Append(app.requireScope(op.Scope)).Then(op.Handler))
+	}
+	router.HandlerFunc(http.MethodGet, "/api/openapi.json", app.getOpenAPI)
+	router.Handler(http.MethodGet, "/api/docs", dynamic.ThenFunc(app.getAPIDocs))
 
 	//router.Handler(http.MethodPost, "/user/message", protected.ThenFunc(app.AddNewChatMessage))
 	//router.Handler(http.MethodPost, "/registry/create", protected.ThenFunc(app.addNewDataRegistry))
-	//router.Handler(http.MethodPost, "/user/logout", protected.ThenFunc(app.logoutPost))
 
 	standard := alice.New(app.recoverPanic, app.applogRequest, secureHeaders)
 
@@ -20,19 +20,32 @@ import (
 // be displayed to the user.
 
 type ChatHistory struct {
-	ChatUser    string
-	ChatTime    string
-	ChatMessage string
+	ChatUser    string `json:"user"`
+	ChatTime    string `json:"time"`
+	ChatMessage string `json:"message"`
 }
 
 type templateData struct {
 	Projects        []data.Project
+	Project         *data.Project
+	ProjectOptions  []data.Project
+	Task            *data.Task
+	Members         []data.ProjectMember
+	Webhooks        []data.Webhook
+	Webhook         *data.Webhook
+	Deliveries      []data.WebhookDelivery
+	TOTP            *totpSetup
+	APITokens       []data.APIToken
+	NewAPIToken     string // token just created, shown once
 	ChatHistories   []*ChatHistory
 	User            *data.User
 	ListUsers       []*data.User
 	Form            any
 	Flash           string //message to be displayed to the user
+	CSRFToken       string // token to include in every form posted back
 	IsAuthenticated bool   // authenticated user
+	IsAdmin         bool   // authenticated user is an administrator
+	Pagination      *pagination
 }
 
 // newTemplateCache creates a new template cache by parsing all HTML template files
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/burstman/baseRegistry/cmd/web/internal/data"
+	"github.com/burstman/baseRegistry/cmd/web/internal/dbtest"
+	"github.com/burstman/baseRegistry/cmd/web/internal/mailer"
+	"github.com/go-playground/form/v4"
+)
+
+// newTestApplication returns an application working on a fresh test
+// database. Its sessions are kept in memory and its emails are discarded.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+	db := dbtest.New(t)
+
+	templateCache, err := newTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	discard := log.New(io.Discard, "", 0)
+
+	return &application{
+		projects:       &data.ProjectManager{DB: db},
+		userData:       &data.UserDB{DB: db},
+		chatData:       &data.ChatData{DB: db},
+		errlog:         discard,
+		infolog:        discard,
+		templateCache:  templateCache,
+		sessionManager: scs.New(),
+		formDecoder:    form.NewDecoder(),
+		mailer:         &mailer.Log{Logger: discard},
+		baseURL:        "http://localhost:4000",
+	}
+}
+
+// postForm sends a form to a handler of app within a session and returns the
+// response.
+func postForm(t *testing.T, app *application, h http.HandlerFunc, path string, form url.Values) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	app.sessionManager.LoadAndSave(h).ServeHTTP(rr, req)
+	return rr.Result()
+}
@@ -0,0 +1,241 @@
+// Renders the OpenAPI document of the JSON API on the API documentation page,
+// and lets the user try its operations with one of their tokens.
+(function() {
+	'use strict';
+
+	var root = document.getElementById('apiDocs');
+	if (!root) {
+		return;
+	}
+	var doc;
+
+	// The token is kept for the browser tab only.
+	var tokenInput = document.getElementById('apiDocs__token');
+	tokenInput.value = sessionStorage.getItem('apiToken') || '';
+	tokenInput.addEventListener('input', function() {
+		sessionStorage.setItem('apiToken', tokenInput.value.trim());
+	});
+
+	// el creates an element. Children are nodes or strings, added as text so
+	// that nothing of the document is interpreted as HTML.
+	function el(tag, attrs) {
+		var node = document.createElement(tag);
+		Object.keys(attrs || {}).forEach(function(name) {
+			node.setAttribute(name, attrs[name]);
+		});
+		Array.prototype.slice.call(arguments, 2).forEach(function(child) {
+			if (child === null || child === undefined) {
+				return;
+			}
+			node.appendChild(typeof child === 'string' ? document.createTextNode(child) : child);
+		});
+		return node;
+	}
+
+	function paragraphs(text) {
+		var div = el('div', {class: 'description'});
+		(text || '').split('\n\n').forEach(function(p) {
+			div.appendChild(el('p', null, p));
+		});
+		return div;
+	}
+
+	function refName(schema) {
+		return schema.$ref.split('/').pop();
+	}
+
+	function resolve(schema) {
+		return schema.$ref ? doc.components.schemas[refName(schema)] : schema;
+	}
+
+	// typeName returns a short description of the type of a schema.
+	function typeName(schema) {
+		if (schema.$ref) {
+			return refName(schema);
+		}
+		var name = schema.type || 'any';
+		if (schema.type === 'array') {
+			name = typeName(schema.items) + '[]';
+		} else if (schema.additionalProperties) {
+			name = 'map of ' + typeName(schema.additionalProperties);
+		} else if (schema.format) {
+			name += ' (' + schema.format + ')';
+		}
+		return schema.nullable ? name + ', nullable' : name;
+	}
+
+	// typeNode is typeName with links to the schemas of the components.
+	function typeNode(schema) {
+		var target = schema.type === 'array' ? schema.items : schema;
+		if (target && target.$ref) {
+			var name = refName(target);
+			return el('a', {href: '#schema-' + name}, typeName(schema));
+		}
+		return el('span', null, typeName(schema));
+	}
+
+	function properties(schema) {
+		schema = resolve(schema);
+		var list = el('ul', {class: 'properties'});
+		Object.keys(schema.properties || {}).sort().forEach(function(name) {
+			list.appendChild(el('li', null, el('code', null, name), ': ', typeNode(schema.properties[name])));
+		});
+		return list;
+	}
+
+	// example builds a value matching a schema, used to prefill the request
+	// bodies.
+	function example(schema, depth) {
+		if (depth > 4) {
+			return null;
+		}
+		schema = resolve(schema);
+		switch (schema.type) {
+		case 'object':
+			var value = {};
+			Object.keys(schema.properties || {}).sort().forEach(function(name) {
+				value[name] = example(schema.properties[name], depth + 1);
+			});
+			return value;
+		case 'array':
+			return [];
+		case 'integer':
+		case 'number':
+			return 0;
+		case 'boolean':
+			return false;
+		case 'string':
+			return schema.format === 'date-time' ? new Date().toISOString() : '';
+		}
+		return null;
+	}
+
+	function send(method, path, op, form, output) {
+		var query = new URLSearchParams();
+		(op.parameters || []).forEach(function(p) {
+			var value = form.elements[p.name].value.trim();
+			if (p.in === 'path') {
+				path = path.replace('{' + p.name + '}', encodeURIComponent(value));
+			} else if (value !== '') {
+				query.append(p.name, value);
+			}
+		});
+		if (query.toString()) {
+			path += '?' + query.toString();
+		}
+
+		var init = {method: method.toUpperCase(), headers: {}};
+		var token = tokenInput.value.trim();
+		if (token) {
+			init.headers.Authorization = 'Bearer ' + token;
+		}
+		if (form.elements.body) {
+			init.headers['Content-Type'] = 'application/json';
+			init.body = form.elements.body.value;
+		}
+
+		output.textContent = init.method + ' ' + path + '\n...';
+		fetch(path, init).then(function(response) {
+			return response.text().then(function(text) {
+				try {
+					text = JSON.stringify(JSON.parse(text), null, 2);
+				} catch (e) {
+					// Not JSON, such as the empty body of a 204.
+				}
+				output.textContent = init.method + ' ' + path + '\n' +
+					response.status + ' ' + response.statusText + '\n\n' + text;
+			});
+		}).catch(function(err) {
+			output.textContent = init.method + ' ' + path + '\n' + err;
+		});
+	}
+
+	function operation(method, path, op) {
+		var details = el('details', {class: 'operation'},
+			el('summary', null,
+				el('span', {class: 'method method--' + method}, method.toUpperCase()), ' ',
+				el('code', null, path), ' ', op.summary));
+		details.appendChild(paragraphs(op.description));
+
+		var form = el('form', {class: 'try'});
+		if (op.parameters && op.parameters.length) {
+			details.appendChild(el('h4', null, 'Parameters'));
+			op.parameters.forEach(function(p) {
+				form.appendChild(el('label', null,
+					el('code', null, p.name), ' (' + p.in + ', ' + typeName(p.schema) + (p.required ? ', required' : '') + ')',
+					el('input', {type: 'text', name: p.name})));
+			});
+		}
+		if (op.requestBody) {
+			var schema = op.requestBody.content['application/json'].schema;
+			details.appendChild(el('h4', null, 'Body: ', typeNode(schema)));
+			details.appendChild(properties(schema));
+			var body = el('textarea', {name: 'body', rows: 8});
+			body.value = JSON.stringify(example(schema, 0), null, 2);
+			form.appendChild(body);
+		}
+
+		details.appendChild(el('h4', null, 'Responses'));
+		var responses = el('ul', {class: 'responses'});
+		Object.keys(op.responses).sort().forEach(function(code) {
+			var response = op.responses[code];
+			if (response.$ref) {
+				response = doc.components.responses[refName(response)];
+			}
+			var item = el('li', null, el('code', null, code), ' ' + response.description);
+			var content = response.content && response.content['application/json'];
+			if (content) {
+				item.appendChild(document.createTextNode(': '));
+				item.appendChild(content.schema.$ref ? typeNode(content.schema) : properties(content.schema));
+			}
+			responses.appendChild(item);
+		});
+		details.appendChild(responses);
+
+		var output = el('pre', {class: 'output'});
+		form.appendChild(el('button', {type: 'submit'}, 'Send'));
+		form.addEventListener('submit', function(e) {
+			e.preventDefault();
+			send(method, path, op, form, output);
+		});
+		details.appendChild(el('h4', null, 'Try it'));
+		details.appendChild(form);
+		details.appendChild(output);
+		return details;
+	}
+
+	function render(spec) {
+		doc = spec;
+		root.textContent = '';
+		root.appendChild(el('h3', null, doc.info.title + ' v' + doc.info.version));
+		root.appendChild(paragraphs(doc.info.description));
+
+		var tags = {};
+		Object.keys(doc.paths).sort().forEach(function(path) {
+			Object.keys(doc.paths[path]).forEach(function(method) {
+				var op = doc.paths[path][method];
+				var tag = (op.tags || ['other'])[0];
+				if (!tags[tag]) {
+					tags[tag] = el('section', null, el('h3', null, tag));
+					root.appendChild(tags[tag]);
+				}
+				tags[tag].appendChild(operation(method, path, op));
+			});
+		});
+
+		root.appendChild(el('h3', null, 'Schemas'));
+		Object.keys(doc.components.schemas).sort().forEach(function(name) {
+			root.appendChild(el('h4', {id: 'schema-' + name}, name));
+			root.appendChild(properties(doc.components.schemas[name]));
+		});
+	}
+
+	fetch(root.getAttribute('data-spec')).then(function(response) {
+		if (!response.ok) {
+			throw new Error(response.status + ' ' + response.statusText);
+		}
+		return response.json();
+	}).then(render).catch(function(err) {
+		root.textContent = 'The API description cannot be loaded: ' + err.message;
+	});
+})();
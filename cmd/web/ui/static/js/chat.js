@@ -0,0 +1,132 @@
+// Sends the chat messages through a WebSocket instead of posting the form, so
+// that the page is not reloaded for every line. The form is still posted while
+// the socket is not open.
+(function() {
+	'use strict';
+
+	var form = document.getElementById('chatForm');
+	if (!form || !window.WebSocket || !window.JSON) {
+		return;
+	}
+	var lines = document.getElementById('chatLines');
+	var typing = document.getElementById('chatTyping');
+	var input = form.elements.message;
+
+	var socket = null;
+	var attempts = 0;
+	// The line of the message waiting for its reply.
+	var pending = null;
+
+	function scroll() {
+		var history = lines.parentNode;
+		history.scrollTop = history.scrollHeight;
+	}
+
+	// line builds a line of the chat the way the template does.
+	function line(user, time, message) {
+		var node = document.createElement('div');
+		node.className = 'chat-message clearfix';
+		var content = document.createElement('div');
+		content.className = 'chat-message-content clearfix';
+		var span = document.createElement('span');
+		span.className = 'chat-time';
+		span.textContent = time;
+		var h5 = document.createElement('h5');
+		h5.textContent = user;
+		var p = document.createElement('p');
+		p.textContent = message;
+		content.appendChild(span);
+		content.appendChild(h5);
+		content.appendChild(p);
+		node.appendChild(content);
+		return node;
+	}
+
+	function append(node) {
+		lines.appendChild(node);
+		lines.appendChild(document.createElement('hr'));
+		scroll();
+	}
+
+	function done() {
+		typing.hidden = true;
+		if (pending) {
+			pending.nextSibling.remove();
+			pending.remove();
+			pending = null;
+		}
+	}
+
+	function connect() {
+		var scheme = location.protocol === 'https:' ? 'wss://' : 'ws://';
+		socket = new WebSocket(scheme + location.host + form.getAttribute('data-socket'));
+
+		socket.addEventListener('open', function() {
+			attempts = 0;
+		});
+
+		socket.addEventListener('message', function(e) {
+			var msg = JSON.parse(e.data);
+			switch (msg.type) {
+			case 'typing':
+				typing.hidden = false;
+				scroll();
+				break;
+			case 'reply':
+				done();
+				(msg.lines || []).forEach(function(l) {
+					append(line(l.user, l.time, l.message));
+				});
+				// The dashboard refreshes the projects the order changed.
+				(msg.changes || []).forEach(function(change) {
+					document.dispatchEvent(new CustomEvent('dashboard:change', {detail: change}));
+				});
+				break;
+			case 'error':
+				done();
+				append(line('Bot', '', msg.error));
+				break;
+			}
+		});
+
+		socket.addEventListener('close', function(e) {
+			socket = null;
+			if (pending) {
+				done();
+				append(line('Bot', '', 'The connection was lost, your last message may not have been handled.'));
+			}
+			// A closed session is not coming back: the form takes over and
+			// leads to the login page.
+			if (e.code === 1008) {
+				return;
+			}
+			// Reconnect, backing off up to 30 seconds.
+			var delay = Math.min(30000, 1000 * Math.pow(2, attempts)) * (0.5 + Math.random() / 2);
+			attempts++;
+			setTimeout(connect, delay);
+		});
+	}
+
+	form.addEventListener('submit', function(e) {
+		// Post the form while the socket is not open.
+		if (!socket || socket.readyState !== WebSocket.OPEN) {
+			return;
+		}
+		e.preventDefault();
+		var text = input.value.trim();
+		if (!text || pending) {
+			return;
+		}
+		socket.send(JSON.stringify({type: 'message', text: text}));
+		input.value = '';
+
+		var now = new Date();
+		pending = line(form.getAttribute('data-user') || '', ('0' + now.getHours()).slice(-2) + ':' +
+			('0' + now.getMinutes()).slice(-2), text);
+		pending.classList.add('chat-message--pending');
+		append(pending);
+	});
+
+	connect();
+	scroll();
+})();
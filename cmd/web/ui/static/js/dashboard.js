@@ -0,0 +1,145 @@
+// Keeps the dashboard up to date: the server streams the changes of the
+// projects, and the projects they concern are reloaded in place.
+(function() {
+	'use strict';
+
+	var content = document.querySelector('.content[data-events]');
+	if (!content || !window.EventSource || !window.fetch) {
+		return;
+	}
+	var status = document.getElementById('liveStatus');
+
+	// The projects to reload, or all of them.
+	var pending = {};
+	var reloadAll = false;
+	var timer = null;
+
+	function setStatus(text, on) {
+		status.hidden = false;
+		status.textContent = text;
+		status.classList.toggle('live--on', on);
+	}
+
+	// schedule reloads the pending projects shortly, so that a burst of
+	// changes, such as a task created with its assignees, is one reload.
+	function schedule(delay) {
+		if (!timer) {
+			timer = setTimeout(reload, delay || 300);
+		}
+	}
+
+	// busy reports whether the user is filling a form of a node, which is
+	// then left alone for a while.
+	function busy(node) {
+		var active = document.activeElement;
+		return active && active !== document.body && node.contains(active) &&
+			/^(INPUT|SELECT|TEXTAREA)$/.test(active.tagName);
+	}
+
+	// swap replaces a node by its new version, keeping the history of the
+	// tasks open.
+	function swap(node, fresh) {
+		var open = Array.prototype.map.call(node.querySelectorAll('details[open]'), function(d) {
+			return d.id;
+		});
+		open.forEach(function(id) {
+			var details = id && fresh.querySelector('#' + id);
+			if (details) {
+				details.open = true;
+			}
+		});
+		node.replaceWith(document.importNode(fresh, true));
+	}
+
+	function reload() {
+		timer = null;
+		var ids = Object.keys(pending);
+		var all = reloadAll;
+		pending = {};
+		reloadAll = false;
+
+		// The page is reloaded with its filters, and only the parts that
+		// changed are patched.
+		fetch(location.href, {credentials: 'same-origin', cache: 'no-store'}).then(function(response) {
+			if (!response.ok || response.redirected) {
+				throw new Error(response.status + ' ' + response.statusText);
+			}
+			return response.text();
+		}).then(function(html) {
+			var doc = new DOMParser().parseFromString(html, 'text/html');
+			var fresh = doc.querySelector('.content[data-events]');
+			if (!fresh) {
+				return;
+			}
+			if (!all) {
+				ids.forEach(function(id) {
+					var node = document.getElementById('project-' + id);
+					var freshNode = fresh.querySelector('#project-' + id);
+					if (node && busy(node)) {
+						pending[id] = true;
+						schedule(2000);
+					} else if (node && freshNode) {
+						swap(node, freshNode);
+					} else if (node) {
+						node.remove();
+					} else if (freshNode) {
+						// A project to show: its place is easier to keep by
+						// reloading them all.
+						all = true;
+					}
+				});
+			}
+			if (all) {
+				if (busy(content)) {
+					reloadAll = true;
+					schedule(2000);
+					return;
+				}
+				swap(content, fresh);
+				content = document.querySelector('.content[data-events]');
+			}
+		}).catch(function() {
+			// Try again with the next change.
+			reloadAll = true;
+		});
+	}
+
+	function changed(change) {
+		if (change.kind === 'resync' || !change.project_id) {
+			reloadAll = true;
+		} else {
+			pending[change.project_id] = true;
+		}
+		schedule();
+	}
+
+	// The chat tells about the changes its orders made, which spares waiting
+	// for the stream.
+	document.addEventListener('dashboard:change', function(e) {
+		changed(e.detail);
+	});
+
+	var connected = false;
+	var source = new EventSource(content.getAttribute('data-events'));
+	source.addEventListener('open', function() {
+		// Changes may have been missed while disconnected.
+		if (connected) {
+			reloadAll = true;
+			schedule();
+		}
+		connected = true;
+		setStatus('Live', true);
+	});
+	source.addEventListener('error', function() {
+		// The browser gives up when the stream is refused, such as after
+		// logging out.
+		if (source.readyState === EventSource.CLOSED) {
+			setStatus('Offline', false);
+		} else {
+			setStatus('Reconnecting...', false);
+		}
+	});
+	source.addEventListener('change', function(e) {
+		changed(JSON.parse(e.data));
+	});
+})();
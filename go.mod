@@ -10,5 +10,8 @@ require (
 	github.com/go-playground/form/v4 v4.2.1
 	github.com/justinas/alice v1.2.0
 	github.com/lib/pq v1.10.9
+	github.com/pquerna/otp v1.4.0
 	golang.org/x/crypto v0.22.0
 )
+
+require github.com/boombuler/barcode v1.0.1-0.20190219062509-6c824513bacc // indirect
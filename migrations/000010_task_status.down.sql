@@ -0,0 +1,3 @@
+ALTER TABLE tasks DROP CONSTRAINT IF EXISTS tasks_status_check;
+UPDATE tasks SET status = 'open' WHERE status = 'in_progress';
+ALTER TABLE tasks ALTER COLUMN status TYPE VARCHAR(10);
@@ -0,0 +1,3 @@
+ALTER TABLE tasks ALTER COLUMN status TYPE VARCHAR(20);
+ALTER TABLE tasks ADD CONSTRAINT tasks_status_check
+    CHECK (status IN ('open', 'in_progress', 'review', 'done', 'blocked', 'cancelled'));
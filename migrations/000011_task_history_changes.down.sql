@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS task_history_task_id_idx;
+ALTER TABLE task_history DROP COLUMN IF EXISTS changes;
@@ -0,0 +1,2 @@
+ALTER TABLE task_history ADD COLUMN IF NOT EXISTS changes JSONB NOT NULL DEFAULT '[]'::jsonb;
+CREATE INDEX IF NOT EXISTS task_history_task_id_idx ON task_history (task_id, changed_at);
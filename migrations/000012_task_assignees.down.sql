@@ -0,0 +1,7 @@
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS assigned_to INT REFERENCES users(user_id);
+UPDATE tasks t SET assigned_to = (
+    SELECT MIN(ta.user_id) FROM task_assignees ta WHERE ta.task_id = t.task_id
+);
+INSERT INTO attachments (task_id, uploaded_by, uploaded_at)
+    SELECT task_id, user_id, assigned_at FROM task_assignees;
+DROP TABLE IF EXISTS task_assignees;
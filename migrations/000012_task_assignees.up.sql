@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS task_assignees (
+    task_id INT NOT NULL REFERENCES tasks(task_id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    assigned_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    assigned_by INT REFERENCES users(user_id),
+    PRIMARY KEY (task_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS task_assignees_user_id_idx ON task_assignees (user_id);
+
+-- Assignments used to be stored as attachment rows (and, for tasks created
+-- from the form, in tasks.assigned_to). Move them to the new table.
+INSERT INTO task_assignees (task_id, user_id)
+    SELECT DISTINCT task_id, uploaded_by FROM attachments
+    WHERE task_id IS NOT NULL AND uploaded_by IS NOT NULL
+    ON CONFLICT DO NOTHING;
+INSERT INTO task_assignees (task_id, user_id)
+    SELECT task_id, assigned_to FROM tasks
+    WHERE assigned_to IS NOT NULL
+    ON CONFLICT DO NOTHING;
+DELETE FROM attachments;
+
+ALTER TABLE tasks DROP CONSTRAINT IF EXISTS tasks_assigned_to_fkey;
+ALTER TABLE tasks DROP COLUMN IF EXISTS assigned_to;
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS attachments_storage_key_idx;
+ALTER TABLE attachments DROP CONSTRAINT IF EXISTS attachments_task_id_checksum_key;
+ALTER TABLE attachments
+    DROP COLUMN IF EXISTS file_name,
+    DROP COLUMN IF EXISTS content_type,
+    DROP COLUMN IF EXISTS size,
+    DROP COLUMN IF EXISTS checksum,
+    DROP COLUMN IF EXISTS storage_key;
@@ -0,0 +1,8 @@
+ALTER TABLE attachments
+    ADD COLUMN IF NOT EXISTS file_name VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS content_type VARCHAR(100) NOT NULL DEFAULT 'application/octet-stream',
+    ADD COLUMN IF NOT EXISTS size BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS checksum CHAR(64) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS storage_key VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE attachments ADD CONSTRAINT attachments_task_id_checksum_key UNIQUE (task_id, checksum);
+CREATE INDEX IF NOT EXISTS attachments_storage_key_idx ON attachments (storage_key);
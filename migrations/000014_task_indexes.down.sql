@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS comments_task_id_idx;
+DROP INDEX IF EXISTS tasks_project_id_idx;
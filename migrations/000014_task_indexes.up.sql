@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS tasks_project_id_idx ON tasks (project_id);
+CREATE INDEX IF NOT EXISTS comments_task_id_idx ON comments (task_id, created_at);
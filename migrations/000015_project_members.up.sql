@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS project_members (
+    project_id INT NOT NULL REFERENCES projects(project_id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    role VARCHAR(20) NOT NULL DEFAULT 'member'
+        CHECK (role IN ('owner', 'maintainer', 'member', 'viewer')),
+    added_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (project_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS project_members_user_id_idx ON project_members (user_id);
+
+-- Project creators become owners, users who created or were assigned a task
+-- become members.
+INSERT INTO project_members (project_id, user_id, role)
+    SELECT project_id, created_by, 'owner' FROM projects
+    WHERE created_by IS NOT NULL
+    ON CONFLICT DO NOTHING;
+INSERT INTO project_members (project_id, user_id, role)
+    SELECT DISTINCT project_id, created_by, 'member' FROM tasks
+    WHERE project_id IS NOT NULL AND created_by IS NOT NULL
+    ON CONFLICT DO NOTHING;
+INSERT INTO project_members (project_id, user_id, role)
+    SELECT DISTINCT t.project_id, ta.user_id, 'member' FROM task_assignees ta
+    JOIN tasks t ON ta.task_id = t.task_id
+    WHERE t.project_id IS NOT NULL
+    ON CONFLICT DO NOTHING;
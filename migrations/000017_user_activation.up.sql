@@ -0,0 +1,11 @@
+-- Accounts created before email verification existed stay usable.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS activated BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE users ALTER COLUMN activated SET DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS user_activations (
+    token_hash BYTEA PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS user_activations_user_id_idx ON user_activations (user_id);
@@ -0,0 +1,12 @@
+-- The TOTP secret is encrypted by the application before being stored.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret BYTEA;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+-- Last time step a code was accepted for, so that a code cannot be replayed.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT;
+
+CREATE TABLE IF NOT EXISTS user_recovery_codes (
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    code_hash BYTEA NOT NULL,
+    used_at TIMESTAMP,
+    PRIMARY KEY (user_id, code_hash)
+);
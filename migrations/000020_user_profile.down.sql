@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS email_changes;
+ALTER TABLE users DROP COLUMN IF EXISTS notify_comments;
+ALTER TABLE users DROP COLUMN IF EXISTS notify_assigned;
+ALTER TABLE users DROP COLUMN IF EXISTS timezone;
+ALTER TABLE users DROP COLUMN IF EXISTS avatar_type;
+ALTER TABLE users DROP COLUMN IF EXISTS avatar_key;
+ALTER TABLE users DROP COLUMN IF EXISTS display_name;